@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ABRouter splits users between named models by weight, e.g. to compare two
+// epsilon-greedy models trained differently on live traffic. A user is
+// assigned by hashing the UserID, so the same user always gets the same
+// model. The server only serves epsilon-greedy models, see loadModel, so it
+// can't split users between other strategies yet.
+type ABRouter struct {
+	names      []string
+	cumulative []float64 // running sum of the weights, in the order of names
+}
+
+func NewABRouter() *ABRouter {
+	return &ABRouter{}
+}
+
+// Add assigns users to the model with the name in proportion to the weight.
+func (r *ABRouter) Add(name string, weight float64) error {
+	if weight <= 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+		return fmt.Errorf("the weight of %s must be a positive number", name)
+	}
+	for _, n := range r.names {
+		if n == name {
+			return fmt.Errorf("%s is added more than once", name)
+		}
+	}
+
+	total := 0.0
+	if len(r.cumulative) > 0 {
+		total = r.cumulative[len(r.cumulative)-1]
+	}
+	r.names = append(r.names, name)
+	r.cumulative = append(r.cumulative, total+weight)
+	return nil
+}
+
+// Assign returns the name of the model the user is assigned to, or the
+// empty string if no model was added.
+func (r *ABRouter) Assign(userID string) string {
+	if len(r.names) == 0 {
+		return ""
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(userID))
+	point := float64(mix64(h.Sum64())) / math.Pow(2, 64) * r.cumulative[len(r.cumulative)-1]
+	i := sort.SearchFloat64s(r.cumulative, point)
+	if i < len(r.cumulative) && r.cumulative[i] == point {
+		i++ // the buckets are half-open, [previous, cumulative)
+	}
+	return r.names[min(i, len(r.names)-1)]
+}
+
+// mix64 spreads the bits of a hash, as the high bits of FNV barely differ for
+// short IDs like "1" and "2" and we scale by them.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// parseABSplit parses a list like "current=0.9,adaptive=0.1" of model names
+// and weights.
+func parseABSplit(s string) (map[string]float64, error) {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(s, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("split %q is not of the form model=weight", part)
+		}
+		w, err := strconv.ParseFloat(weight, 64)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("the weight of %s must be a positive number", name)
+		}
+		if _, ok := weights[name]; ok {
+			return nil, fmt.Errorf("model %s is given more than once", name)
+		}
+		weights[name] = w
+	}
+	return weights, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestABRouterAssignsStablyByWeight(t *testing.T) {
+	names := []string{"current", "adaptive", "thompson"}
+	weights := []float64{0.7, 0.2, 0.1}
+	newRouter := func() *ABRouter {
+		r := NewABRouter()
+		for i, name := range names {
+			if err := r.Add(name, weights[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return r
+	}
+	r, other := newRouter(), newRouter()
+	if err := r.Add("current", 1); err == nil {
+		t.Error("Add() of a name again succeeded, want an error")
+	}
+
+	const users = 20000
+	counts := make(map[string]int)
+	for i := 0; i < users; i++ {
+		user := fmt.Sprintf("user%d", i)
+		name := r.Assign(user)
+		if again := r.Assign(user); again != name {
+			t.Fatalf("%s assigned to %s and then %s", user, name, again)
+		}
+		if got := other.Assign(user); got != name {
+			t.Fatalf("%s assigned to %s by another router with the same split, want %s", user, got, name)
+		}
+		counts[name]++
+	}
+	for i, name := range names {
+		if got := float64(counts[name]) / users; math.Abs(got-weights[i]) > 0.02 {
+			t.Errorf("%s got %.3f of the users, want %.1f", name, got, weights[i])
+		}
+	}
+}
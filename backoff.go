@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// contextFields are the names of the Context fields, as in its JSON.
+var contextFields = []string{"user_id", "time_of_day", "weekday", "device"}
+
+// withoutFields returns the context with the named fields left empty.
+func withoutFields(ctx Context, fields []string) Context {
+	for _, field := range fields {
+		switch field {
+		case "user_id":
+			ctx.UserID = ""
+		case "time_of_day":
+			ctx.TimeOfDay = ""
+		case "weekday":
+			ctx.Weekday = ""
+		case "device":
+			ctx.Device = ""
+		}
+	}
+	return ctx
+}
+
+// parseContextFields parses a list like "user_id,device".
+func parseContextFields(s string) ([]string, error) {
+	fields := []string{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if !slices.Contains(contextFields, field) {
+			return nil, fmt.Errorf("unknown context field %q, must be one of %s", field, strings.Join(contextFields, ", "))
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// popularity returns the average reward of every bandit over the rows,
+// index aligned with bandits.
+func popularity(rows []TrainingData, bandits []*Bandit, opts ContextOptions, reward RewardFunc) []float64 {
+	positions := make(map[string]int, len(bandits))
+	for i, b := range bandits {
+		positions[b.ItemID] = i
+	}
+
+	totals := make([]float64, len(bandits))
+	counts := make([]int, len(bandits))
+	for _, row := range rows {
+		i, ok := positions[row.ItemID]
+		if _, valid := opts.contextFromRow(row); !ok || !valid {
+			continue // skipped when building the bandits too
+		}
+		totals[i] += row.weightedReward(reward)
+		counts[i]++
+	}
+
+	for i, n := range counts {
+		if n > 0 {
+			totals[i] /= float64(n)
+		}
+	}
+	return totals
+}
+
+// backoff returns the rewards and counts of the contexts that match ctx on
+// the fields left after dropping those in Backoff one after another, for the
+// first level with any rewards. The rewards are averaged over the matching
+// contexts, weighted by their counts. Call with the lock held.
+func (s *EpsilonGreedyStrategy) backoff(ctx Context) ([]float64, []int) {
+	if s.HashBuckets > 0 {
+		return nil, nil // hashed contexts can't be matched on their fields
+	}
+
+	ctx = s.key(ctx)
+	for level := 1; level <= len(s.Backoff); level++ {
+		dropped := s.Backoff[:level]
+		want := withoutFields(ctx, dropped)
+
+		totals := make([]float64, len(s.Bandits))
+		counts := make([]int, len(s.Bandits))
+		for key, rewards := range s.Rewards {
+			if withoutFields(key, dropped) != want || s.checkAligned(key) != nil {
+				continue
+			}
+			for i, n := range s.Counts[key] {
+				totals[i] += rewards[i] * float64(n)
+				counts[i] += n
+			}
+		}
+		if sum(counts) == 0 {
+			continue
+		}
+
+		rewards := make([]float64, len(s.Bandits))
+		for i, n := range counts {
+			if n > 0 {
+				rewards[i] = totals[i] / float64(n)
+			}
+		}
+		return rewards, counts
+	}
+
+	return nil, nil
+}
+
+// differingFields returns the number of fields a and b differ in.
+func differingFields(a, b Context) int {
+	n := 0
+	for _, differs := range []bool{a.UserID != b.UserID, a.TimeOfDay != b.TimeOfDay, a.Weekday != b.Weekday, a.Device != b.Device} {
+		if differs {
+			n++
+		}
+	}
+	return n
+}
+
+// smooth returns the rewards of the context blended with those of its
+// neighbors, the contexts differing from it in only one field, averaged over
+// them weighted by their counts. A bandit without rewards in any neighbor
+// keeps its own. The rewards are returned as is without Smoothing. Call with
+// the lock held.
+func (s *EpsilonGreedyStrategy) smooth(key Context, rewards []float64) []float64 {
+	if s.Smoothing <= 0 || s.HashBuckets > 0 || len(rewards) != len(s.Bandits) {
+		return rewards // hashed contexts can't be compared on their fields
+	}
+
+	totals := make([]float64, len(s.Bandits))
+	counts := make([]int, len(s.Bandits))
+	for other, otherRewards := range s.Rewards {
+		if differingFields(key, other) != 1 || s.checkAligned(other) != nil {
+			continue
+		}
+		for i, n := range s.Counts[other] {
+			totals[i] += otherRewards[i] * float64(n)
+			counts[i] += n
+		}
+	}
+
+	smoothed := make([]float64, len(rewards))
+	for i, reward := range rewards {
+		smoothed[i] = reward
+		if counts[i] > 0 {
+			smoothed[i] = (1-s.Smoothing)*reward + s.Smoothing*totals[i]/float64(counts[i])
+		}
+	}
+	return smoothed
+}
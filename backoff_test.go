@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestBackoff(t *testing.T) {
+	s := newTestStrategy("a", "b", "c")
+	s.Epsilon = 0
+	s.Backoff = []string{"user_id", "device"}
+	// other users like b on mobile on monday mornings, and c on desktop
+	s.UpdateReward(Context{UserID: "u2", TimeOfDay: "morning", Weekday: "monday", Device: "mobile"}, s.Bandits[1], 1)
+	s.UpdateReward(Context{UserID: "u3", TimeOfDay: "morning", Weekday: "monday", Device: "mobile"}, s.Bandits[0], 0.2)
+	s.UpdateReward(Context{UserID: "u4", TimeOfDay: "morning", Weekday: "monday", Device: "desktop"}, s.Bandits[2], 0.4)
+
+	tests := []struct {
+		name string
+		ctx  Context
+		want string
+	}{
+		{"same time, weekday and device", Context{UserID: "new", TimeOfDay: "morning", Weekday: "monday", Device: "mobile"}, "b"},
+		{"same time and weekday", Context{UserID: "new", TimeOfDay: "morning", Weekday: "monday", Device: "tablet"}, "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, explored, err := s.SelectBanditWithInfo(tt.ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if explored || b.ItemID != tt.want {
+				t.Errorf("selected %s, explored %v, want exploiting %s", b.ItemID, explored, tt.want)
+			}
+		})
+	}
+
+	// averaged over the matching contexts by count
+	rewards, counts := s.backoff(Context{UserID: "new", TimeOfDay: "morning", Weekday: "monday", Device: "tablet"})
+	if !slices.Equal(rewards, []float64{0.2, 1, 0.4}) || !slices.Equal(counts, []int{1, 1, 1}) {
+		t.Errorf("backoff() = %v, %v, want [0.2 1 0.4], [1 1 1]", rewards, counts)
+	}
+
+	// nothing to back off to
+	if _, explored, _ := s.SelectBanditWithInfo(Context{UserID: "new", TimeOfDay: "night"}); !explored {
+		t.Error("exploited a context without anything to back off to")
+	}
+}
+
+func TestParseContextFields(t *testing.T) {
+	fields, err := parseContextFields("user_id, device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(fields, []string{"user_id", "device"}) {
+		t.Errorf("parseContextFields() = %v, want [user_id device]", fields)
+	}
+	if _, err := parseContextFields("user"); err == nil {
+		t.Error("parseContextFields() of an unknown field succeeded, want an error")
+	}
+}
+
+func TestPopularityInUnseenContexts(t *testing.T) {
+	var rows []TrainingData
+	for _, user := range []string{"u1", "u2", "u3", "u4"} {
+		rows = append(rows,
+			TrainingData{UserID: user, ItemID: "a", HasClick: false},
+			TrainingData{UserID: user, ItemID: "popular", HasClick: true},
+			TrainingData{UserID: user, ItemID: "b", HasClick: false},
+		)
+	}
+
+	share := func(usePopularity bool) float64 {
+		filename := filepath.Join(t.TempDir(), "model.gob")
+		err := trainModel(&fakeDataSource{rows: rows}, TrainConfig{
+			Reward:        defaultRewardConfig,
+			Seed:          1,
+			ModelFile:     filename,
+			Iterations:    10,
+			UsePopularity: usePopularity,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := loadModel(filename, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []float64{-0.1, 1, -0.1}; !slices.Equal(s.Popularity, want) {
+			t.Fatalf("Popularity = %v, want %v", s.Popularity, want)
+		}
+		return selectionShares(t, s, s.Bandits, Context{UserID: "new"}, 2000)[1]
+	}
+
+	if got := share(true); got < 0.9 {
+		t.Errorf("popular item picked %.2f of the time in a new context, want at least 0.9", got)
+	}
+	if got := share(false); got > 0.45 {
+		t.Errorf("popular item picked %.2f of the time in a new context without -use-popularity, want about 1/3", got)
+	}
+}
+
+func TestSmoothingMovesThinContextsTowardNeighbors(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.Epsilon = 0
+	s.UpdateReward(testContext, s.Bandits[0], 0)
+	s.UpdateReward(testContext, s.Bandits[1], 0.5)
+
+	// the neighbors differ in one field and like a, a context differing in
+	// two fields isn't a neighbor
+	tuesday, desktop, far := testContext, testContext, testContext
+	tuesday.Weekday = "tuesday"
+	desktop.Device = "desktop"
+	far.Weekday, far.Device = "sunday", "tablet"
+	for i := 0; i < 3; i++ {
+		s.UpdateReward(tuesday, s.Bandits[0], 1)
+	}
+	s.UpdateReward(desktop, s.Bandits[0], 0.6)
+	s.UpdateReward(far, s.Bandits[0], -5)
+
+	if b, err := s.SelectBandit(testContext); err != nil || b.ItemID != "b" {
+		t.Fatalf("SelectBandit() without smoothing = %v, %v, want b", b, err)
+	}
+
+	s.Smoothing = 0.6
+	// the neighbors' average of a is (3*1 + 0.6) / 4 = 0.9, b has no neighbors
+	want := []float64{0.6 * 0.9, 0.5}
+	got := s.smooth(testContext, s.Rewards[testContext])
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Errorf("smoothed reward of %s = %v, want %v", s.Bandits[i].ItemID, got[i], want[i])
+		}
+	}
+	if b, err := s.SelectBandit(testContext); err != nil || b.ItemID != "a" {
+		t.Errorf("SelectBandit() with smoothing = %v, %v, want a, which the neighbors like", b, err)
+	}
+	if s.Rewards[testContext][0] != 0 {
+		t.Errorf("smoothing changed the stored reward of a to %v", s.Rewards[testContext][0])
+	}
+}
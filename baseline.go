@@ -0,0 +1,78 @@
+package main
+
+// GreedyStrategy always picks the bandit with the highest average reward in a
+// context and never explores. It is a baseline to compare other strategies
+// with.
+type GreedyStrategy struct {
+	Bandits []*Bandit
+	Rewards map[Context][]float64
+	Counts  map[Context][]int
+}
+
+func (s *GreedyStrategy) SelectBandit(ctx Context) (*Bandit, error) {
+	if len(s.Bandits) == 0 {
+		return nil, errNoBandits
+	}
+
+	rewards := s.Rewards[ctx]
+	if len(rewards) != len(s.Bandits) {
+		return s.Bandits[0], nil
+	}
+	return s.Bandits[argmax(rewards)], nil
+}
+
+func (s *GreedyStrategy) UpdateReward(ctx Context, b *Bandit, reward float64) {
+	if s.Rewards == nil {
+		s.Rewards = make(map[Context][]float64)
+		s.Counts = make(map[Context][]int)
+	}
+	if _, ok := s.Rewards[ctx]; !ok {
+		s.Rewards[ctx] = make([]float64, len(s.Bandits))
+		s.Counts[ctx] = make([]int, len(s.Bandits))
+	}
+	for i := range s.Bandits {
+		if s.Bandits[i] == b {
+			updateAverage(s.Rewards[ctx], s.Counts[ctx], i, reward)
+		}
+	}
+}
+
+func (s *GreedyStrategy) Reset() {
+	s.Rewards = make(map[Context][]float64)
+	s.Counts = make(map[Context][]int)
+}
+
+func (s *GreedyStrategy) SaveState(filename string) error {
+	return saveModel(filename, s, ModelMetadata{})
+}
+
+func (s *GreedyStrategy) LoadState(filename string) error {
+	return loadGob(filename, s)
+}
+
+// RandomStrategy picks a bandit uniformly at random and learns nothing. It is
+// a baseline to compare other strategies with.
+type RandomStrategy struct {
+	Bandits []*Bandit
+
+	seededRand
+}
+
+func (s *RandomStrategy) SelectBandit(ctx Context) (*Bandit, error) {
+	if len(s.Bandits) == 0 {
+		return nil, errNoBandits
+	}
+	return s.Bandits[s.random().Intn(len(s.Bandits))], nil
+}
+
+func (s *RandomStrategy) UpdateReward(ctx Context, b *Bandit, reward float64) {}
+
+func (s *RandomStrategy) Reset() {}
+
+func (s *RandomStrategy) SaveState(filename string) error {
+	return saveModel(filename, s, ModelMetadata{})
+}
+
+func (s *RandomStrategy) LoadState(filename string) error {
+	return loadGob(filename, s)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGreedyNeverExplores(t *testing.T) {
+	bandits := []*Bandit{{ItemID: "a"}, {ItemID: "b"}, {ItemID: "c"}}
+	s := strategies["greedy"](bandits).(*GreedyStrategy)
+	s.UpdateReward(testContext, bandits[0], 0.2)
+	s.UpdateReward(testContext, bandits[1], 0.5)
+	s.UpdateReward(testContext, bandits[2], 0.1)
+
+	for i := 0; i < 1000; i++ {
+		b, err := s.SelectBandit(testContext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != bandits[1] {
+			t.Fatalf("selection %d = %s, want always the best b", i, b.ItemID)
+		}
+	}
+}
+
+func TestRandomIsUniform(t *testing.T) {
+	bandits := []*Bandit{{ItemID: "a"}, {ItemID: "b"}, {ItemID: "c"}, {ItemID: "d"}}
+	s := strategies["random"](bandits).(*RandomStrategy)
+	s.Seed(1)
+	s.UpdateReward(testContext, bandits[0], 1)
+
+	for i, share := range selectionShares(t, s, bandits, testContext, 20000) {
+		if math.Abs(share-0.25) > 0.02 {
+			t.Errorf("%s selected %.3f of the time, want 0.25", bandits[i].ItemID, share)
+		}
+	}
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// options holds the values of all command line flags. Every command only
+// registers the flags relevant to it, the others keep their defaults.
+type options struct {
+	// mode flags of the legacy command line without a command
+	train, stats, exportPolicy, evaluate, serve, prune, version bool
+	simulate                                                    int
+
+	modelFile string
+
+	project, dataset, query, csvPath string
+
+	timezone              string
+	skipInvalidTimestamps bool
+	timeBuckets           string
+	deviceMap             string
+	deviceMapFile         string
+
+	clickReward, noClickPenalty float64
+
+	strategy          string
+	iterations        int
+	convergenceWindow int
+	progressEvery     int
+	workers           int
+	ignoreUser        bool
+	hashBuckets       int
+	minSamples        int
+	backoff           string
+	alpha             float64
+	initialReward     float64
+	coldThreshold     int
+	smoothing         float64
+	maxContexts       int
+	adaptiveEpsilon   int
+	usePopularity     bool
+	fatigueRate       float64
+	normalizeRewards  string
+	testFraction      float64
+
+	cpuProfile, memProfile string
+
+	userID, timeOfDay, weekday, device string
+
+	addr, grpcAddr, modelFiles, redisAddr, sqlitePath, defaultItem, abSplit string
+	saveInterval                                                            time.Duration
+	clampRewards                                                            bool
+	rateLimit                                                               float64
+	trustedProxies                                                          string
+
+	topItems bool
+
+	olderThan time.Duration
+
+	mergeFrom string
+
+	simulateRows, simulateUsers, simulateItems int
+	simulateOut                                string
+
+	seed     int64
+	logLevel string
+}
+
+// The environment variables the BigQuery project and dataset default to, so
+// deployments can configure them without flags.
+const (
+	projectEnv = "GOOGLE_CLOUD_PROJECT"
+	datasetEnv = "SMOKEY_DATASET"
+)
+
+func newOptions() *options {
+	return &options{
+		modelFile:      defaultModelFile,
+		project:        os.Getenv(projectEnv),
+		dataset:        os.Getenv(datasetEnv),
+		clickReward:    defaultRewardConfig.ClickReward,
+		noClickPenalty: defaultRewardConfig.NoClickPenalty,
+		strategy:       defaultStrategy,
+		iterations:     10000,
+		workers:        1,
+		addr:           ":8080",
+		saveInterval:   time.Minute,
+		simulateRows:   1000,
+		simulateUsers:  100,
+		simulateItems:  10,
+		logLevel:       "info",
+	}
+}
+
+func (o *options) modelFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.modelFile, "model", o.modelFile, "File the model is saved to and loaded from")
+}
+
+func (o *options) dataFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.project, "project", o.project, "BigQuery project to fetch training data from, read from $"+projectEnv+" without the flag")
+	fs.StringVar(&o.dataset, "dataset", o.dataset, "BigQuery table with the training data, e.g. mydataset.impressions, read from $"+datasetEnv+" without the flag")
+	fs.StringVar(&o.query, "query", o.query, "Custom SQL query for the training data, overrides -dataset")
+	fs.StringVar(&o.csvPath, "csv", o.csvPath, "Train from a CSV file instead of BigQuery")
+	fs.BoolVar(&o.skipInvalidTimestamps, "skip-invalid-timestamps", o.skipInvalidTimestamps, "Skip rows without a valid impression time instead of bucketing them as unknown")
+	fs.Float64Var(&o.clickReward, "click-reward", o.clickReward, "Reward for an impression that got a click")
+	fs.Float64Var(&o.noClickPenalty, "no-click-penalty", o.noClickPenalty, "Penalty for an impression without a click")
+}
+
+func (o *options) bucketFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.timeBuckets, "time-buckets", o.timeBuckets, "Time of day buckets as startHour:label pairs, e.g. 0:night,6:day,18:evening")
+}
+
+func (o *options) timezoneFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.timezone, "timezone", o.timezone, "IANA time zone used for time of day and weekday, e.g. Europe/Stockholm (default UTC)")
+}
+
+func (o *options) deviceFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.deviceMap, "device-map", o.deviceMap, "Devices to count as another device as spelling=device pairs, e.g. iphone=ios,ipad=ios,android=android, other devices count as other")
+	fs.StringVar(&o.deviceMapFile, "device-map-file", o.deviceMapFile, "File with a spelling=device pair per line, like -device-map")
+}
+
+func (o *options) trainFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.strategy, "strategy", o.strategy, "Strategy to train ["+strings.Join(strategyNames(), "|")+"]")
+	fs.IntVar(&o.iterations, "iterations", o.iterations, "Number of training iterations per context")
+	fs.IntVar(&o.convergenceWindow, "convergence-window", o.convergenceWindow, "Stop training a context when its best item hasn't changed for this many iterations, 0 disables")
+	fs.IntVar(&o.progressEvery, "progress-every", o.progressEvery, "Log training progress every N contexts, 0 logs about every 10%")
+	fs.IntVar(&o.workers, "workers", o.workers, "Number of contexts of the epsilon strategy to train at once, 0 uses one per CPU, more than 1 makes training differ between runs with the same seed")
+	fs.BoolVar(&o.ignoreUser, "ignore-user", o.ignoreUser, "Leave the user out of the context when training, so the model generalizes across users")
+	fs.IntVar(&o.hashBuckets, "hash-buckets", o.hashBuckets, "Hash contexts into this many buckets to bound the model size, 0 keeps every context")
+	fs.IntVar(&o.minSamples, "min-samples", o.minSamples, "Number of rewards a context needs before the model exploits it instead of exploring")
+	fs.StringVar(&o.backoff, "backoff", o.backoff, "Context fields to leave out one after another for contexts without rewards, e.g. user_id,device")
+	fs.Float64Var(&o.alpha, "alpha", o.alpha, "Learning rate of an exponential moving average of the rewards, so recent rewards count more, 0 uses the plain average")
+	fs.Float64Var(&o.initialReward, "initial-reward", o.initialReward, "Reward of every item in a context before it has any, above the rewards to expect to try every item early")
+	fs.IntVar(&o.coldThreshold, "cold-threshold", o.coldThreshold, "Only explore the items with fewer rewards than this in the context, or every item if none has that few, 0 explores every item")
+	fs.Float64Var(&o.smoothing, "smoothing", o.smoothing, "Weight of the average rewards of the contexts differing in only one field, blended into the rewards of a context when selecting, 0 disables")
+	fs.IntVar(&o.adaptiveEpsilon, "adaptive-epsilon", o.adaptiveEpsilon, "Explore contexts with this many rewards half as often as new ones, and better known ones less still, 0 explores every context as often")
+	fs.IntVar(&o.maxContexts, "max-contexts", o.maxContexts, "Keep at most this many contexts, forgetting the least recently updated ones when training and serving, 0 keeps every context")
+	fs.BoolVar(&o.usePopularity, "use-popularity", o.usePopularity, "Recommend the items with the highest reward over all the training data in contexts without rewards, instead of exploring them at random")
+	fs.Float64Var(&o.fatigueRate, "fatigue-rate", o.fatigueRate, "Extra penalty for an impression without a click for every time the item was already shown in the context while training, 0 disables")
+	fs.StringVar(&o.normalizeRewards, "normalize-rewards", o.normalizeRewards, "Bring the rewards of the contexts into [0, 1] before training by clamping them, or rescaling them from their range [clamp|minmax] (default none)")
+	fs.Float64Var(&o.testFraction, "test-fraction", o.testFraction, "Fraction of the training data to hold out for evaluation, e.g. 0.2")
+}
+
+func (o *options) profileFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.cpuProfile, "cpuprofile", o.cpuProfile, "Write a pprof CPU profile of training to this file")
+	fs.StringVar(&o.memProfile, "memprofile", o.memProfile, "Write a pprof memory profile after training to this file")
+}
+
+func (o *options) userFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.userID, "user", o.userID, "User ID")
+}
+
+func (o *options) contextFlags(fs *flag.FlagSet) {
+	o.userFlags(fs)
+	fs.StringVar(&o.timeOfDay, "time", o.timeOfDay, "Time of day [morning|afternoon|evening|night] (default the current one in -timezone)")
+	fs.StringVar(&o.weekday, "weekday", o.weekday, "Weekday (default the current one in -timezone)")
+	fs.StringVar(&o.device, "device", o.device, "Device")
+}
+
+func (o *options) serveFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.addr, "addr", o.addr, "Address to serve HTTP on")
+	fs.StringVar(&o.grpcAddr, "grpc-addr", o.grpcAddr, "Address to also serve gRPC on, e.g. :9090")
+	fs.StringVar(&o.modelFiles, "models", o.modelFiles, "Models to serve as name=file pairs, e.g. homepage=homepage.gob,email=email.gob (default default=<-model>)")
+	fs.StringVar(&o.redisAddr, "redis-addr", o.redisAddr, "Share the model with other instances through the Redis server at this address")
+	fs.StringVar(&o.sqlitePath, "sqlite", o.sqlitePath, "Keep the model in the SQLite database at this path, saving every reward as it comes instead of rewriting the model file")
+	fs.StringVar(&o.defaultItem, "default-item", o.defaultItem, "Item to recommend when the model has no items or only negative rewards in the context")
+	fs.StringVar(&o.abSplit, "ab-split", o.abSplit, "Split users between models by weight, e.g. current=0.9,adaptive=0.1, all epsilon models")
+	fs.BoolVar(&o.clampRewards, "clamp-rewards", o.clampRewards, "Clamp the rewards posted to the server to [0, 1]")
+	fs.Float64Var(&o.rateLimit, "rate-limit", o.rateLimit, "Requests per second every client IP may make to /recommend, /recommend/batch and /reward, 0 disables")
+	fs.StringVar(&o.trustedProxies, "trusted-proxies", o.trustedProxies, "IPs or networks of the proxies -rate-limit takes the client IP from X-Forwarded-For of, e.g. 10.0.0.0/8")
+	fs.DurationVar(&o.saveInterval, "save-interval", o.saveInterval, "How often rewards received while serving are saved to the model")
+}
+
+func (o *options) statsFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.topItems, "top-items", o.topItems, "Only print in how many contexts every item has the highest reward")
+}
+
+func (o *options) pruneFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.olderThan, "older-than", o.olderThan, "Forget the contexts without a reward for longer than this, e.g. 720h")
+}
+
+func (o *options) mergeFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.mergeFrom, "from", o.mergeFrom, "Models to merge into the model, e.g. eu.gob,us.gob")
+}
+
+func (o *options) simulateFlags(fs *flag.FlagSet) {
+	fs.IntVar(&o.simulateRows, "rows", o.simulateRows, "Number of impressions to simulate")
+	fs.IntVar(&o.simulateUsers, "users", o.simulateUsers, "Number of users to simulate impressions for")
+	fs.IntVar(&o.simulateItems, "items", o.simulateItems, "Number of items to simulate impressions of")
+	fs.StringVar(&o.simulateOut, "out", o.simulateOut, "CSV file to write the impressions to (default stdout)")
+}
+
+func (o *options) commonFlags(fs *flag.FlagSet) {
+	fs.Int64Var(&o.seed, "seed", o.seed, "Seed for the random number generator, 0 seeds from the clock")
+	fs.StringVar(&o.logLevel, "log-level", o.logLevel, "Log level [debug|info|warn|error]")
+}
+
+// commands are the commands of the command line, in the order of the usage,
+// with the flag groups each of them takes.
+var commands = []struct {
+	name  string
+	usage string
+	flags []func(o *options, fs *flag.FlagSet)
+}{
+	{"train", "Train a model", []func(*options, *flag.FlagSet){
+		(*options).modelFlags, (*options).dataFlags, (*options).bucketFlags, (*options).timezoneFlags, (*options).deviceFlags, (*options).trainFlags, (*options).profileFlags, (*options).commonFlags}},
+	{"evaluate", "Evaluate a model on held out data", []func(*options, *flag.FlagSet){
+		(*options).modelFlags, (*options).dataFlags, (*options).bucketFlags, (*options).timezoneFlags, (*options).deviceFlags, (*options).commonFlags}},
+	{"recommend", "Recommend an item for a context", []func(*options, *flag.FlagSet){
+		(*options).modelFlags, (*options).contextFlags, (*options).bucketFlags, (*options).timezoneFlags, (*options).deviceFlags, (*options).commonFlags}},
+	{"serve", "Serve recommendations over HTTP and gRPC", []func(*options, *flag.FlagSet){
+		(*options).modelFlags, (*options).serveFlags, (*options).bucketFlags, (*options).timezoneFlags, (*options).deviceFlags, (*options).commonFlags}},
+	{"inspect", "Print the reward of every item in a context", []func(*options, *flag.FlagSet){
+		(*options).modelFlags, (*options).contextFlags, (*options).bucketFlags, (*options).timezoneFlags, (*options).deviceFlags, (*options).commonFlags}},
+	{"stats", "Print a summary of a model", []func(*options, *flag.FlagSet){
+		(*options).modelFlags, (*options).statsFlags, (*options).commonFlags}},
+	{"export-policy", "Write the recommended item for every context as CSV", []func(*options, *flag.FlagSet){
+		(*options).modelFlags, (*options).commonFlags}},
+	{"prune", "Forget the contexts of a model that haven't had a reward in a while", []func(*options, *flag.FlagSet){
+		(*options).modelFlags, (*options).pruneFlags, (*options).commonFlags}},
+	{"forget-user", "Forget everything a model learned from a user", []func(*options, *flag.FlagSet){
+		(*options).modelFlags, (*options).userFlags, (*options).commonFlags}},
+	{"merge", "Merge other models into a model", []func(*options, *flag.FlagSet){
+		(*options).modelFlags, (*options).mergeFlags, (*options).commonFlags}},
+	{"simulate", "Write simulated training data as CSV", []func(*options, *flag.FlagSet){
+		(*options).simulateFlags, (*options).commonFlags}},
+	{"version", "Print the version of smokey", nil},
+}
+
+// errFlags is returned for flags the flag set already reported to the user.
+var errFlags = errors.New("invalid flags")
+
+// command is a parsed command line.
+type command struct {
+	name string
+	opts *options
+}
+
+// parseArgs parses the command line, either a command followed by its flags,
+// e.g. train -csv impressions.csv, or the legacy flags without a command,
+// e.g. -train -csv impressions.csv.
+func parseArgs(args []string) (*command, error) {
+	o := newOptions()
+
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fs := flag.NewFlagSet("smokey", flag.ContinueOnError)
+		fs.Usage = func() {
+			printUsage(fs.Output())
+			fmt.Fprintln(fs.Output(), "\nFlags without a command are deprecated, but still supported for every command but inspect, merge and forget-user:")
+			fs.PrintDefaults()
+		}
+		o.legacyFlags(fs)
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, flagsError(err)
+		}
+		return &command{name: o.legacyCommand(), opts: o}, nil
+	}
+
+	for _, c := range commands {
+		if c.name != args[0] {
+			continue
+		}
+		fs := flag.NewFlagSet("smokey "+c.name, flag.ContinueOnError)
+		for _, register := range c.flags {
+			register(o, fs)
+		}
+		err := fs.Parse(args[1:])
+		if err != nil {
+			return nil, flagsError(err)
+		}
+		if fs.NArg() > 0 {
+			return nil, fmt.Errorf("unexpected argument %q to %s", fs.Arg(0), c.name)
+		}
+		return &command{name: c.name, opts: o}, nil
+	}
+
+	return nil, fmt.Errorf("unknown command %q, run smokey -h for the commands", args[0])
+}
+
+func flagsError(err error) error {
+	if errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	return errFlags
+}
+
+// legacyFlags registers every flag, plus the flags picking what to do that
+// the commands replaced.
+func (o *options) legacyFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.train, "train", false, "Train the model")
+	fs.BoolVar(&o.stats, "stats", false, "Print a summary of the model without retraining")
+	fs.BoolVar(&o.exportPolicy, "export-policy", false, "Write the recommended item for every context in the model as CSV to stdout")
+	fs.BoolVar(&o.evaluate, "evaluate", false, "Evaluate the model on the data given by -dataset, -query or -csv")
+	fs.BoolVar(&o.serve, "serve", false, "Load the model once and serve recommendations over HTTP")
+	fs.BoolVar(&o.prune, "prune", false, "Forget the contexts older than -older-than in the model")
+	fs.IntVar(&o.simulate, "simulate", 0, "Write N rows of simulated training data as CSV")
+	fs.BoolVar(&o.version, "version", false, "Print the version of smokey and exit")
+	o.modelFlags(fs)
+	o.dataFlags(fs)
+	o.bucketFlags(fs)
+	o.timezoneFlags(fs)
+	o.deviceFlags(fs)
+	o.trainFlags(fs)
+	o.profileFlags(fs)
+	o.contextFlags(fs)
+	o.serveFlags(fs)
+	o.statsFlags(fs)
+	o.pruneFlags(fs)
+	o.simulateFlags(fs)
+	o.commonFlags(fs)
+}
+
+// legacyCommand returns the command the legacy mode flags pick, recommend
+// if there are none.
+func (o *options) legacyCommand() string {
+	switch {
+	case o.version:
+		return "version"
+	case o.train:
+		return "train"
+	case o.evaluate:
+		return "evaluate"
+	case o.stats:
+		return "stats"
+	case o.exportPolicy:
+		return "export-policy"
+	case o.serve:
+		return "serve"
+	case o.prune:
+		return "prune"
+	case o.simulate > 0:
+		o.simulateRows = o.simulate
+		return "simulate"
+	}
+	return "recommend"
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: smokey <command> [flags]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-15s%s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(w, "\nRun smokey <command> -h for the flags of a command.")
+}
+
+// trainConfig checks the flags and builds the configuration the commands run
+// with.
+func (o *options) trainConfig() (TrainConfig, error) {
+	cfg := TrainConfig{
+		Reward:            RewardConfig{ClickReward: o.clickReward, NoClickPenalty: o.noClickPenalty},
+		ModelFile:         o.modelFile,
+		Strategy:          o.strategy,
+		Seed:              o.seed,
+		Iterations:        o.iterations,
+		ConvergenceWindow: o.convergenceWindow,
+		ProgressEvery:     o.progressEvery,
+		Workers:           o.workers,
+		HashBuckets:       o.hashBuckets,
+		MinSamples:        o.minSamples,
+		Alpha:             o.alpha,
+		InitialReward:     o.initialReward,
+		ColdThreshold:     o.coldThreshold,
+		Smoothing:         o.smoothing,
+		MaxContexts:       o.maxContexts,
+		AdaptiveEpsilon:   o.adaptiveEpsilon,
+		UsePopularity:     o.usePopularity,
+		NormalizeRewards:  o.normalizeRewards,
+		TestFraction:      o.testFraction,
+	}
+	if err := normalizeRewards(nil, o.normalizeRewards); err != nil {
+		return TrainConfig{}, fmt.Errorf("invalid -normalize-rewards: %w", err)
+	}
+	if o.fatigueRate < 0 {
+		return TrainConfig{}, errors.New("-fatigue-rate must not be negative")
+	}
+	if o.fatigueRate > 0 {
+		cfg.FatiguePenalty = LinearFatigue(o.fatigueRate)
+	}
+	if o.backoff != "" {
+		fields, err := parseContextFields(o.backoff)
+		if err != nil {
+			return TrainConfig{}, fmt.Errorf("invalid -backoff: %w", err)
+		}
+		cfg.Backoff = fields
+	}
+	if o.alpha < 0 || o.alpha > 1 {
+		return TrainConfig{}, errors.New("-alpha must be between 0 and 1")
+	}
+	if o.adaptiveEpsilon < 0 {
+		return TrainConfig{}, errors.New("-adaptive-epsilon must not be negative")
+	}
+	if o.maxContexts < 0 {
+		return TrainConfig{}, errors.New("-max-contexts must not be negative")
+	}
+	if o.smoothing < 0 || o.smoothing > 1 {
+		return TrainConfig{}, errors.New("-smoothing must be between 0 and 1")
+	}
+	if _, err := newStrategy(o.strategy, nil); err != nil {
+		return TrainConfig{}, fmt.Errorf("invalid -strategy: %w", err)
+	}
+	if o.hashBuckets < 0 {
+		return TrainConfig{}, errors.New("-hash-buckets must not be negative")
+	}
+	cfg.Context.SkipInvalidTimestamps = o.skipInvalidTimestamps
+	cfg.Context.IgnoreUser = o.ignoreUser
+	if o.timeBuckets != "" {
+		buckets, err := parseTimeOfDayBuckets(o.timeBuckets)
+		if err != nil {
+			return TrainConfig{}, fmt.Errorf("invalid -time-buckets: %w", err)
+		}
+		cfg.Context.TimeOfDayBuckets = buckets
+	}
+	if o.timezone != "" {
+		loc, err := time.LoadLocation(o.timezone)
+		if err != nil {
+			return TrainConfig{}, fmt.Errorf("invalid -timezone: %w", err)
+		}
+		cfg.Context.Location = loc
+	}
+	if o.deviceMap != "" && o.deviceMapFile != "" {
+		return TrainConfig{}, errors.New("only one of -device-map and -device-map-file can be given")
+	}
+	if o.deviceMapFile != "" {
+		b, err := os.ReadFile(o.deviceMapFile)
+		if err != nil {
+			return TrainConfig{}, fmt.Errorf("invalid -device-map-file: %w", err)
+		}
+		cfg.Context.Devices, err = parseDeviceMap(string(b))
+		if err != nil {
+			return TrainConfig{}, fmt.Errorf("invalid -device-map-file: %w", err)
+		}
+	}
+	if o.deviceMap != "" {
+		devices, err := parseDeviceMap(o.deviceMap)
+		if err != nil {
+			return TrainConfig{}, fmt.Errorf("invalid -device-map: %w", err)
+		}
+		cfg.Context.Devices = devices
+	}
+	return cfg, nil
+}
+
+// run runs the command, exiting with 2 for invalid flags and 1 if the
+// command fails.
+func run(cmd *command) {
+	o := cmd.opts
+	if cmd.name == "version" {
+		fmt.Println(versionString())
+		return
+	}
+
+	err := setupLogging(o.logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -log-level: %v\n", err)
+		os.Exit(2)
+	}
+	if o.train || o.evaluate || o.stats || o.exportPolicy || o.serve || o.prune || o.simulate > 0 {
+		slog.Warn("Flags like -" + cmd.name + " are deprecated, run smokey " + cmd.name + " instead. inspect, merge and forget-user only run as commands")
+	}
+
+	cfg, err := o.trainConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	switch cmd.name {
+	case "train", "evaluate":
+		source, err := dataSourceFromFlags(o.csvPath, o.project, o.dataset, o.query)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if cmd.name == "train" {
+			err = withProfiles(o.cpuProfile, o.memProfile, func() error {
+				return trainModel(source, cfg)
+			})
+		} else {
+			err = evaluateModel(source, cfg)
+		}
+		if err != nil {
+			fatal(authHint(err))
+		}
+	case "stats":
+		strategy, err := loadModel(o.modelFile, o.seed)
+		if err != nil {
+			fatal(err)
+		}
+		if o.topItems {
+			err = printTopItems(os.Stdout, strategy.TopItemsReport())
+		} else {
+			err = printStats(os.Stdout, strategy.Stats())
+		}
+		if err != nil {
+			fatal(err)
+		}
+	case "export-policy":
+		strategy, err := loadModel(o.modelFile, o.seed)
+		if err != nil {
+			fatal(err)
+		}
+		err = strategy.ExportPolicyCSV(os.Stdout)
+		if err != nil {
+			fatal(err)
+		}
+	case "prune":
+		if o.olderThan <= 0 {
+			fmt.Fprintln(os.Stderr, "prune needs a positive -older-than")
+			os.Exit(2)
+		}
+		err = pruneModel(o.modelFile, o.olderThan, o.seed)
+		if err != nil {
+			fatal(err)
+		}
+	case "forget-user":
+		if o.userID == "" {
+			fmt.Fprintln(os.Stderr, "forget-user needs a -user")
+			os.Exit(2)
+		}
+		err = forgetUser(o.modelFile, o.userID, o.seed)
+		if err != nil {
+			fatal(err)
+		}
+	case "merge":
+		if o.mergeFrom == "" {
+			fmt.Fprintln(os.Stderr, "merge needs the models to merge -from")
+			os.Exit(2)
+		}
+		err = mergeModels(o.modelFile, strings.Split(o.mergeFrom, ","), o.seed)
+		if err != nil {
+			fatal(err)
+		}
+	case "simulate":
+		if o.simulateRows < 0 || o.simulateUsers <= 0 || o.simulateItems <= 0 {
+			fmt.Fprintln(os.Stderr, "simulate needs positive -users and -items, and -rows not below 0")
+			os.Exit(2)
+		}
+		err = simulate(o.simulateOut, SimulationConfig{
+			Rows:  o.simulateRows,
+			Users: o.simulateUsers,
+			Items: o.simulateItems,
+			Seed:  o.seed,
+		})
+		if err != nil {
+			fatal(err)
+		}
+	case "serve":
+		files := map[string]string{defaultModelName: o.modelFile}
+		if o.modelFiles != "" {
+			files, err = parseModelFiles(o.modelFiles)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid -models: %v\n", err)
+				os.Exit(2)
+			}
+		}
+		if o.rateLimit < 0 {
+			fmt.Fprintln(os.Stderr, "-rate-limit must be 0 or more")
+			os.Exit(2)
+		}
+		var proxies []netip.Prefix
+		if o.trustedProxies != "" {
+			proxies, err = parseTrustedProxies(o.trustedProxies)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid -trusted-proxies: %v\n", err)
+				os.Exit(2)
+			}
+		}
+		var split map[string]float64
+		if o.abSplit != "" {
+			split, err = parseABSplit(o.abSplit)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid -ab-split: %v\n", err)
+				os.Exit(2)
+			}
+		}
+		if o.redisAddr != "" && o.sqlitePath != "" {
+			fmt.Fprintln(os.Stderr, "-redis-addr and -sqlite can't be used together")
+			os.Exit(2)
+		}
+		var client *redis.Client
+		if o.redisAddr != "" {
+			client = redis.NewClient(&redis.Options{Addr: o.redisAddr})
+		}
+		models, err := loadModels(files, client, o.sqlitePath, o.seed)
+		if err != nil {
+			fatal(err)
+		}
+		err = serve(models, ServeConfig{
+			Addr:           o.addr,
+			GRPCAddr:       o.grpcAddr,
+			SaveInterval:   o.saveInterval,
+			DefaultItem:    o.defaultItem,
+			ABSplit:        split,
+			Context:        cfg.Context,
+			ClampRewards:   o.clampRewards,
+			RateLimit:      o.rateLimit,
+			TrustedProxies: proxies,
+		})
+		if err != nil {
+			fatal(err)
+		}
+	case "recommend", "inspect":
+		ctx, err := cfg.Context.contextAt(time.Now(), o.userID, o.timeOfDay, o.weekday, o.device)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -time or -weekday: %v\n", err)
+			os.Exit(2)
+		}
+		if cmd.name == "recommend" {
+			err = loadModelAndSelectAnItem(o.modelFile, ctx, o.seed)
+		} else {
+			err = inspectContext(os.Stdout, o.modelFile, ctx, o.seed)
+		}
+		if err != nil {
+			fatal(err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mainArgsEnv holds the arguments to run main with in a test binary started
+// by runMain, separated by newlines.
+const mainArgsEnv = "SMOKEY_TEST_MAIN_ARGS"
+
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv(mainArgsEnv); ok {
+		os.Args = append([]string{"smokey"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs smokey with the arguments in a new process and returns what
+// it printed to stdout, and an *exec.ExitError if it didn't exit with 0.
+func runMain(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), mainArgsEnv+"="+strings.Join(args, "\n"))
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+func TestModelFlag(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "models", "homepage.gob")
+	if err := os.Mkdir(filepath.Dir(filename), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, err := parseArgs([]string{"train", "-model", filename, "-csv", "testdata/training.csv", "-iterations", "10", "-seed", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := cmd.opts.trainConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.modelFile() != filename {
+		t.Fatalf("modelFile() = %q, want %q", cfg.modelFile(), filename)
+	}
+	source, err := dataSourceFromFlags(cmd.opts.csvPath, cmd.opts.project, cmd.opts.dataset, cmd.opts.query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := trainModel(source, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatalf("model not saved to -model: %v", err)
+	}
+	if _, err := os.Stat(defaultModelFile); err == nil {
+		t.Errorf("model also saved to %s", defaultModelFile)
+	}
+	s, err := loadModel(filename, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := itemIDs(s.Bandits); len(got) != 2 {
+		t.Errorf("loaded bandits %v, want the 2 items of the training data", got)
+	}
+	if err := loadModelAndSelectAnItem(filename, testContext, 1); err != nil {
+		t.Errorf("loadModelAndSelectAnItem() error = %v", err)
+	}
+}
+
+func TestModelFlagDefault(t *testing.T) {
+	cmd, err := parseArgs([]string{"stats"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.opts.modelFile != defaultModelFile {
+		t.Errorf("-model defaults to %q, want %q", cmd.opts.modelFile, defaultModelFile)
+	}
+	if got := (TrainConfig{}).modelFile(); got != defaultModelFile {
+		t.Errorf("modelFile() = %q, want %q", got, defaultModelFile)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	for _, args := range [][]string{{"version"}, {"-version"}} {
+		out, err := runMain(t, args...)
+		if err != nil {
+			t.Fatalf("smokey %s: %v", args[0], err)
+		}
+		if want := versionString() + "\n"; out != want {
+			t.Errorf("smokey %s printed %q, want %q", args[0], out, want)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args  []string
+		name  string
+		check func(o *options) bool
+	}{
+		{[]string{"train", "-csv", "rows.csv", "-strategy", "ucb1"}, "train", func(o *options) bool { return o.csvPath == "rows.csv" && o.strategy == "ucb1" }},
+		{[]string{"evaluate", "-csv", "rows.csv"}, "evaluate", func(o *options) bool { return o.csvPath == "rows.csv" }},
+		{[]string{"recommend", "-user", "u1", "-time", "morning", "-timezone", "Europe/Stockholm"}, "recommend", func(o *options) bool {
+			return o.userID == "u1" && o.timeOfDay == "morning" && o.timezone == "Europe/Stockholm"
+		}},
+		{[]string{"serve", "-addr", ":9000"}, "serve", func(o *options) bool { return o.addr == ":9000" }},
+		{[]string{"inspect", "-user", "u1", "-timezone", "Europe/Stockholm", "-time-buckets", "0:night,12:day"}, "inspect", func(o *options) bool {
+			return o.userID == "u1" && o.timezone == "Europe/Stockholm" && o.timeBuckets == "0:night,12:day"
+		}},
+		{[]string{"stats", "-top-items"}, "stats", func(o *options) bool { return o.topItems }},
+		{[]string{"export-policy", "-model", "m.gob"}, "export-policy", func(o *options) bool { return o.modelFile == "m.gob" }},
+		{[]string{"prune", "-older-than", "720h"}, "prune", func(o *options) bool { return o.olderThan == 720*time.Hour }},
+		{[]string{"forget-user", "-user", "u1"}, "forget-user", func(o *options) bool { return o.userID == "u1" }},
+		{[]string{"merge", "-from", "eu.gob,us.gob"}, "merge", func(o *options) bool { return o.mergeFrom == "eu.gob,us.gob" }},
+		{[]string{"simulate", "-rows", "50"}, "simulate", func(o *options) bool { return o.simulateRows == 50 }},
+		{[]string{"version"}, "version", func(o *options) bool { return true }},
+		// the deprecated flags without a command
+		{[]string{"-train", "-csv", "rows.csv"}, "train", func(o *options) bool { return o.csvPath == "rows.csv" }},
+		{[]string{"-serve", "-addr", ":9000"}, "serve", func(o *options) bool { return o.addr == ":9000" }},
+		{[]string{"-simulate", "50"}, "simulate", func(o *options) bool { return o.simulateRows == 50 }},
+		{[]string{"-user", "u1"}, "recommend", func(o *options) bool { return o.userID == "u1" }},
+		{nil, "recommend", func(o *options) bool { return o.modelFile == defaultModelFile }},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			cmd, err := parseArgs(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmd.name != tt.name {
+				t.Errorf("command = %q, want %q", cmd.name, tt.name)
+			}
+			if !tt.check(cmd.opts) {
+				t.Errorf("options = %+v, want the flags parsed", *cmd.opts)
+			}
+		})
+	}
+
+	for _, args := range [][]string{
+		{"bogus"},
+		{"recommend", "-addr", ":9000"}, // a flag of another command
+		{"stats", "extra"},
+	} {
+		if _, err := parseArgs(args); err == nil {
+			t.Errorf("parseArgs(%q) succeeded, want an error", args)
+		}
+	}
+}
+
+func TestProjectAndDatasetFromEnv(t *testing.T) {
+	t.Setenv(projectEnv, "env-project")
+	t.Setenv(datasetEnv, "env.impressions")
+
+	source := func(args ...string) (*BigQueryDataSource, error) {
+		t.Helper()
+		cmd, err := parseArgs(append([]string{"train"}, args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		o := cmd.opts
+		s, err := dataSourceFromFlags(o.csvPath, o.project, o.dataset, o.query)
+		if err != nil {
+			return nil, err
+		}
+		return s.(*BigQueryDataSource), nil
+	}
+
+	s, err := source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Project != "env-project" || s.Query != trainingDataQuery("env.impressions") {
+		t.Errorf("source without flags = %+v, want the project and dataset of the environment", s)
+	}
+
+	s, err = source("-project", "flag-project", "-dataset", "flag.impressions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Project != "flag-project" || s.Query != trainingDataQuery("flag.impressions") {
+		t.Errorf("source with flags = %+v, want the flags to override the environment", s)
+	}
+
+	t.Setenv(projectEnv, "")
+	if _, err := source(); err == nil || !strings.Contains(err.Error(), projectEnv) {
+		t.Errorf("error without a project = %v, want one naming %s", err, projectEnv)
+	}
+}
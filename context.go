@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/civil"
+)
+
+// TimeOfDayBucket labels the hours from StartHour up to the start of the next
+// bucket.
+type TimeOfDayBucket struct {
+	StartHour int
+	Label     string
+}
+
+// TimeOfDayBuckets must be sorted by StartHour. Hours before the first bucket
+// belong to the last one, so a bucket can wrap around midnight.
+type TimeOfDayBuckets []TimeOfDayBucket
+
+var defaultTimeOfDayBuckets = TimeOfDayBuckets{
+	{0, "night"},
+	{4, "morning"},
+	{12, "afternoon"},
+	{18, "evening"},
+	{22, "night"},
+}
+
+// unknown is the device of rows where it is NULL or empty, and the time of
+// day and weekday of rows without a valid impression time.
+const unknown = "unknown"
+
+// otherDevice is the device of contexts whose device isn't in the DeviceMap.
+const otherDevice = "other"
+
+// DeviceMap maps the spellings of devices, like "iphone" and "iOS", to the
+// device they count as, so rewards for equivalent devices end up in the same
+// context. Keys are lowercase, and every device maps to itself.
+type DeviceMap map[string]string
+
+// Normalize returns the device the spelling counts as: unknown for an empty
+// device and other for one not in the map. Without a map the device is
+// returned as is.
+func (m DeviceMap) Normalize(device string) string {
+	if len(m) == 0 {
+		return device
+	}
+	device = normalizeContextValue(device)
+	if device == unknown {
+		return unknown
+	}
+	if d, ok := m[device]; ok {
+		return d
+	}
+	return otherDevice
+}
+
+// parseDeviceMap parses a list like "iphone=ios,ipad=ios,android=android" of
+// spellings and the devices they count as, one pair per line or separated by
+// commas. Spellings are case insensitive.
+func parseDeviceMap(s string) (DeviceMap, error) {
+	m := DeviceMap{}
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		spelling, device, ok := strings.Cut(part, "=")
+		spelling, device = normalizeContextValue(spelling), normalizeContextValue(device)
+		if !ok || spelling == unknown || device == unknown {
+			return nil, fmt.Errorf("device %q is not of the form spelling=device", strings.TrimSpace(part))
+		}
+		if d, ok := m[spelling]; ok && d != device {
+			return nil, fmt.Errorf("%s maps to both %s and %s", spelling, d, device)
+		}
+		m[spelling] = device
+	}
+	for _, device := range m {
+		if d, ok := m[device]; ok && d != device {
+			return nil, fmt.Errorf("%s maps to %s but is also a device", device, d)
+		}
+		m[device] = device
+	}
+	return m, nil
+}
+
+// ContextOptions controls how a Context is derived from a training row.
+// The zero value uses the default buckets in UTC.
+type ContextOptions struct {
+	TimeOfDayBuckets TimeOfDayBuckets
+	Location         *time.Location // impression times are stored in UTC and converted to this zone
+
+	// SkipInvalidTimestamps drops rows without a valid impression time
+	// instead of bucketing them in the unknown time of day and weekday.
+	SkipInvalidTimestamps bool
+
+	// IgnoreUser leaves the UserID empty so users share contexts.
+	IgnoreUser bool
+
+	// Devices, unless empty, maps the device of every context, see DeviceMap.
+	Devices DeviceMap
+}
+
+func (o ContextOptions) timeOfDayBuckets() TimeOfDayBuckets {
+	if len(o.TimeOfDayBuckets) == 0 {
+		return defaultTimeOfDayBuckets
+	}
+	return o.TimeOfDayBuckets
+}
+
+// bucketTime maps a timestamp to the time of day and weekday used in a Context.
+// Training from BigQuery and from CSV both go through here so the contexts
+// always match.
+func (o ContextOptions) bucketTime(dt civil.DateTime) (timeOfDay string, weekday string) {
+	loc := o.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t := dt.In(time.UTC).In(loc)
+
+	timeOfDay = bucketTimeOfDay(t.Hour(), o.timeOfDayBuckets())
+	weekday = strings.ToLower(t.Weekday().String())
+
+	return timeOfDay, weekday
+}
+
+// contextFromRow derives the Context a training row was shown in. It returns
+// false if the row should be skipped.
+func (o ContextOptions) contextFromRow(row TrainingData) (Context, bool) {
+	// Determine time of day and day of week.
+	timeOfDay, weekday := unknown, unknown
+	if row.Timestamp.Valid {
+		timeOfDay, weekday = o.bucketTime(row.Timestamp.DateTime)
+	} else if o.SkipInvalidTimestamps {
+		return Context{}, false
+	}
+
+	userID := row.UserID
+	if o.IgnoreUser {
+		userID = ""
+	}
+
+	// Rows without a device get the unknown device from newContext
+	ctx, err := o.newContext(userID, timeOfDay, weekday, row.Device.StringVal)
+	if err != nil {
+		return Context{}, false
+	}
+	return ctx, true
+}
+
+// NewContext builds a Context from user input with the default time of day
+// buckets, see ContextOptions.newContext.
+func NewContext(userID, timeOfDay, weekday, device string) (Context, error) {
+	return ContextOptions{}.newContext(userID, timeOfDay, weekday, device)
+}
+
+// contextAt builds the context of a recommendation with newContext, so it has
+// the same key as the contexts trained. Without a time of day or weekday it
+// gets the one of now, bucketed like the impression times were. Serving,
+// recommend and inspect all build their contexts with it.
+func (o ContextOptions) contextAt(now time.Time, userID, timeOfDay, weekday, device string) (Context, error) {
+	if strings.TrimSpace(timeOfDay) == "" || strings.TrimSpace(weekday) == "" {
+		nowTimeOfDay, nowWeekday := o.bucketTime(civil.DateTimeOf(now.UTC()))
+		if strings.TrimSpace(timeOfDay) == "" {
+			timeOfDay = nowTimeOfDay
+		}
+		if strings.TrimSpace(weekday) == "" {
+			weekday = nowWeekday
+		}
+	}
+	return o.newContext(userID, timeOfDay, weekday, device)
+}
+
+// newContext builds a Context the same way for training and serving, so the
+// contexts always match. It trims the values, lowercases the time of day,
+// weekday and device, fills in unknown for the empty ones and maps the device
+// with the Devices. The time of day must be one of the bucket labels and the
+// weekday a weekday name.
+func (o ContextOptions) newContext(userID, timeOfDay, weekday, device string) (Context, error) {
+	ctx := Context{
+		UserID:    strings.TrimSpace(userID),
+		TimeOfDay: normalizeContextValue(timeOfDay),
+		Weekday:   normalizeContextValue(weekday),
+		Device:    o.Devices.Normalize(normalizeContextValue(device)),
+	}
+	err := o.validateContext(ctx)
+	if err != nil {
+		return Context{}, err
+	}
+	return ctx, nil
+}
+
+func normalizeContextValue(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return unknown
+	}
+	return s
+}
+
+func bucketTimeOfDay(hour int, buckets TimeOfDayBuckets) string {
+	if len(buckets) == 0 {
+		return ""
+	}
+
+	label := buckets[len(buckets)-1].Label
+	for _, bucket := range buckets {
+		if hour < bucket.StartHour {
+			break
+		}
+		label = bucket.Label
+	}
+
+	return label
+}
+
+// validateContext checks that the time of day is one of the bucket labels and
+// the weekday a lowercase weekday name, or unknown. Empty values are allowed.
+func (o ContextOptions) validateContext(ctx Context) error {
+	if ctx.TimeOfDay != "" && ctx.TimeOfDay != unknown {
+		labels := []string{}
+		valid := false
+		for _, bucket := range o.timeOfDayBuckets() {
+			if bucket.Label == ctx.TimeOfDay {
+				valid = true
+			}
+			if !slices.Contains(labels, bucket.Label) {
+				labels = append(labels, bucket.Label)
+			}
+		}
+		if !valid {
+			return fmt.Errorf("time of day %q must be one of %s", ctx.TimeOfDay, strings.Join(labels, ", "))
+		}
+	}
+
+	if ctx.Weekday != "" && ctx.Weekday != unknown {
+		valid := false
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if strings.ToLower(d.String()) == ctx.Weekday {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("weekday %q must be a weekday name, e.g. monday", ctx.Weekday)
+		}
+	}
+
+	return nil
+}
+
+// hashContext maps a context to one of n bucket contexts by hashing its
+// fields with FNV-1a.
+func hashContext(ctx Context, n int) Context {
+	h := fnv.New32a()
+	writeFields(h, ctx)
+	return Context{UserID: "bucket:" + strconv.Itoa(int(h.Sum32()%uint32(n)))}
+}
+
+// Hash returns a short ID of the context, the FNV-1a hash of its fields in
+// hex, to correlate the logs about it. It is the same in every process and on
+// every platform.
+func (c Context) Hash() string {
+	h := fnv.New64a()
+	writeFields(h, c)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// writeFields writes the fields of the context to the hash.
+func writeFields(h hash.Hash, ctx Context) {
+	for _, field := range []string{ctx.UserID, ctx.TimeOfDay, ctx.Weekday, ctx.Device} {
+		h.Write([]byte(field))
+		h.Write([]byte{0}) // keeps "ab"+"c" apart from "a"+"bc"
+	}
+}
+
+// parseTimeOfDayBuckets parses a list like "0:night,6:day,18:evening". Labels
+// are lowercased like the time of day of a context.
+func parseTimeOfDayBuckets(s string) (TimeOfDayBuckets, error) {
+	buckets := TimeOfDayBuckets{}
+	for _, part := range strings.Split(s, ",") {
+		start, label, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok || label == "" {
+			return nil, fmt.Errorf("bucket %q is not of the form startHour:label", part)
+		}
+		hour, err := strconv.Atoi(start)
+		if err != nil || hour < 0 || hour > 23 {
+			return nil, fmt.Errorf("bucket %q must start at an hour between 0 and 23", part)
+		}
+		buckets = append(buckets, TimeOfDayBucket{hour, strings.ToLower(label)})
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].StartHour < buckets[j].StartHour
+	})
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].StartHour == buckets[i-1].StartHour {
+			return nil, fmt.Errorf("more than one bucket starts at hour %d", buckets[i].StartHour)
+		}
+	}
+
+	return buckets, nil
+}
+
+// contextLess orders contexts by UserID, TimeOfDay, Weekday and Device.
+func contextLess(a, b Context) bool {
+	if a.UserID != b.UserID {
+		return a.UserID < b.UserID
+	}
+	if a.TimeOfDay != b.TimeOfDay {
+		return a.TimeOfDay < b.TimeOfDay
+	}
+	if a.Weekday != b.Weekday {
+		return a.Weekday < b.Weekday
+	}
+	return a.Device < b.Device
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+// dateTime returns the civil date time of the hour on 1 May 2023, a Monday.
+func dateTime(hour, minute int) civil.DateTime {
+	return civil.DateTime{Date: civil.Date{Year: 2023, Month: 5, Day: 1}, Time: civil.Time{Hour: hour, Minute: minute}}
+}
+
+func TestBucketTimeDefaultBuckets(t *testing.T) {
+	tests := []struct {
+		hour, minute int
+		want         string
+	}{
+		{0, 0, "night"},
+		{3, 59, "night"},
+		{4, 0, "morning"},
+		{11, 59, "morning"},
+		{12, 0, "afternoon"},
+		{17, 59, "afternoon"},
+		{18, 0, "evening"},
+		{21, 59, "evening"},
+		{22, 0, "night"},
+		{23, 59, "night"},
+	}
+	for _, tt := range tests {
+		timeOfDay, weekday := ContextOptions{}.bucketTime(dateTime(tt.hour, tt.minute))
+		if timeOfDay != tt.want || weekday != "monday" {
+			t.Errorf("bucketTime(%02d:%02d) = %s, %s, want %s, monday", tt.hour, tt.minute, timeOfDay, weekday, tt.want)
+		}
+	}
+}
+
+func TestBucketTimeCustomBuckets(t *testing.T) {
+	buckets, err := parseTimeOfDayBuckets("18:Evening, 6:day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := ContextOptions{TimeOfDayBuckets: buckets}
+
+	tests := []struct {
+		hour int
+		want string
+	}{
+		{0, "evening"}, // before the first bucket wraps around to the last
+		{5, "evening"},
+		{6, "day"},
+		{17, "day"},
+		{18, "evening"},
+		{23, "evening"},
+	}
+	for _, tt := range tests {
+		timeOfDay, _ := opts.bucketTime(dateTime(tt.hour, 0))
+		if timeOfDay != tt.want {
+			t.Errorf("bucketTime(%02d:00) = %s, want %s", tt.hour, timeOfDay, tt.want)
+		}
+	}
+}
+
+func TestParseTimeOfDayBucketsErrors(t *testing.T) {
+	for _, s := range []string{"", "6", "6:", "24:late", "-1:early", "x:day", "6:day,6:morning"} {
+		_, err := parseTimeOfDayBuckets(s)
+		if err == nil {
+			t.Errorf("parseTimeOfDayBuckets(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestBucketTimeLocation(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+
+	tests := []struct {
+		name          string
+		loc           *time.Location
+		dt            civil.DateTime
+		wantTimeOfDay string
+		wantWeekday   string
+	}{
+		{"utc by default", nil, dateTime(2, 0), "night", "monday"},
+		{"ahead of utc", time.FixedZone("JST", 9*60*60), dateTime(2, 0), "morning", "monday"},
+		{"behind utc, the day before", newYork, dateTime(2, 0), "night", "sunday"},
+		{"summer time", newYork, dateTime(16, 0), "afternoon", "monday"},
+		{"winter time", newYork, civil.DateTime{Date: civil.Date{Year: 2023, Month: 1, Day: 2}, Time: civil.Time{Hour: 16}}, "morning", "monday"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeOfDay, weekday := ContextOptions{Location: tt.loc}.bucketTime(tt.dt)
+			if timeOfDay != tt.wantTimeOfDay || weekday != tt.wantWeekday {
+				t.Errorf("bucketTime(%s) = %s, %s, want %s, %s", tt.dt, timeOfDay, weekday, tt.wantTimeOfDay, tt.wantWeekday)
+			}
+		})
+	}
+}
+
+func TestContextFromRowDevice(t *testing.T) {
+	tests := []struct {
+		name   string
+		device bigquery.NullString
+		want   string
+	}{
+		{"null", bigquery.NullString{}, unknown},
+		{"empty", bigquery.NullString{StringVal: "", Valid: true}, unknown},
+		{"blank", bigquery.NullString{StringVal: "  ", Valid: true}, unknown},
+		{"set", bigquery.NullString{StringVal: " Mobile", Valid: true}, "mobile"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, ok := ContextOptions{}.contextFromRow(TrainingData{UserID: "u1", Device: tt.device})
+			if !ok {
+				t.Fatal("row skipped")
+			}
+			if ctx.Device != tt.want {
+				t.Errorf("device = %q, want %q", ctx.Device, tt.want)
+			}
+		})
+	}
+}
+
+func TestContextFromRowInvalidTimestamp(t *testing.T) {
+	row := TrainingData{UserID: "u1", ItemID: "a", Device: bigquery.NullString{StringVal: "mobile", Valid: true}}
+
+	ctx, ok := ContextOptions{}.contextFromRow(row)
+	want := Context{UserID: "u1", TimeOfDay: unknown, Weekday: unknown, Device: "mobile"}
+	if !ok || ctx != want {
+		t.Errorf("contextFromRow() = %+v, %v, want %+v, true", ctx, ok, want)
+	}
+
+	opts := ContextOptions{SkipInvalidTimestamps: true}
+	if _, ok := opts.contextFromRow(row); ok {
+		t.Error("row without a timestamp wasn't skipped with SkipInvalidTimestamps")
+	}
+	contexts, bandits := buildBandits([]TrainingData{row}, opts, defaultRewardConfig.Func())
+	if len(contexts) != 0 || len(bandits) != 0 {
+		t.Errorf("buildBandits() = %d contexts and %d bandits, want none from the skipped row", len(contexts), len(bandits))
+	}
+}
+
+func TestHashContextCollides(t *testing.T) {
+	contexts := []Context{
+		{UserID: "u1", TimeOfDay: "morning", Weekday: "monday", Device: "mobile"},
+		{UserID: "u2", TimeOfDay: "night", Weekday: "sunday", Device: "desktop"},
+		{UserID: "u3", TimeOfDay: "evening", Weekday: "friday", Device: "tablet"},
+	}
+
+	// three contexts in two buckets, so at least two of them collide
+	buckets := make(map[Context]int)
+	for _, ctx := range contexts {
+		buckets[hashContext(ctx, 2)]++
+	}
+	if len(buckets) > 2 {
+		t.Errorf("%d buckets, want at most 2", len(buckets))
+	}
+	if hashContext(contexts[0], 2) != hashContext(contexts[0], 2) {
+		t.Error("the same context hashes to different buckets")
+	}
+
+	s := newTestStrategy("a", "b")
+	s.HashBuckets = 1
+	s.UpdateReward(contexts[0], s.Bandits[1], 1)
+	if mean, n := s.Confidence(contexts[1], "b"); mean != 1 || n != 1 {
+		t.Errorf("reward of b in a colliding context = %v from %d rewards, want the shared 1 from 1", mean, n)
+	}
+	if len(s.Rewards) != 1 {
+		t.Errorf("%d contexts kept, want 1 bucket", len(s.Rewards))
+	}
+}
+
+func TestIgnoreUserSharesContexts(t *testing.T) {
+	rows := []TrainingData{
+		{UserID: "u1", ItemID: "a", Timestamp: bigquery.NullDateTime{DateTime: dateTime(8, 0), Valid: true}, HasClick: true},
+		{UserID: "u2", ItemID: "a", Timestamp: bigquery.NullDateTime{DateTime: dateTime(9, 0), Valid: true}, HasClick: true},
+	}
+	opts := ContextOptions{IgnoreUser: true}
+	contexts, bandits := buildBandits(rows, opts, defaultRewardConfig.Func())
+	want := Context{TimeOfDay: "morning", Weekday: "monday", Device: unknown}
+	if len(contexts) != 1 || contexts[0] != want {
+		t.Errorf("contexts = %+v, want only %+v", contexts, want)
+	}
+	if got := bandits[0].ContextRewards[want]; got != 2 {
+		t.Errorf("shared context reward = %v, want 2", got)
+	}
+
+	// serving drops the user the same way
+	s := newTestStrategy("a", "b")
+	s.IgnoreUser = true
+	s.UpdateReward(Context{UserID: "u1", TimeOfDay: "morning"}, s.Bandits[1], 1)
+	if mean, n := s.Confidence(Context{UserID: "u2", TimeOfDay: "morning"}, "b"); mean != 1 || n != 1 {
+		t.Errorf("reward of b for another user = %v from %d rewards, want the shared 1 from 1", mean, n)
+	}
+}
+
+func TestNewContextValidation(t *testing.T) {
+	tests := []struct {
+		name               string
+		timeOfDay, weekday string
+		wantErr            bool
+	}{
+		{"valid", "morning", "monday", false},
+		{"any case", "Morning", "MONDAY", false},
+		{"empty", "", "", false},
+		{"misspelled time", "mornign", "monday", true},
+		{"misspelled weekday", "morning", "mondy", true},
+		{"abbreviated weekday", "morning", "mon", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewContext("u1", tt.timeOfDay, tt.weekday, "mobile")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewContext(%q, %q) error = %v, want an error: %v", tt.timeOfDay, tt.weekday, err, tt.wantErr)
+			}
+		})
+	}
+
+	// a custom bucket label is only valid with the custom buckets
+	buckets, err := parseTimeOfDayBuckets("0:night,6:day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (ContextOptions{TimeOfDayBuckets: buckets}).newContext("u1", "day", "monday", ""); err != nil {
+		t.Errorf("newContext() with a custom bucket label: %v", err)
+	}
+	if _, err := NewContext("u1", "day", "monday", ""); err == nil {
+		t.Error("NewContext() with a label of other buckets succeeded, want an error")
+	}
+}
+
+func TestNewContextNormalizes(t *testing.T) {
+	got, err := NewContext(" u1 ", " Morning", "MONDAY ", "Mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != testContext {
+		t.Errorf("NewContext() = %+v, want %+v", got, testContext)
+	}
+
+	got, err = NewContext("u1", "", " ", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Context{UserID: "u1", TimeOfDay: unknown, Weekday: unknown, Device: unknown}); got != want {
+		t.Errorf("NewContext() of empty values = %+v, want %+v", got, want)
+	}
+}
+
+func TestDeviceMap(t *testing.T) {
+	devices, err := parseDeviceMap("iphone=ios, iOS=ios,ipad=ios\nandroid=Android")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := ContextOptions{Devices: devices}
+
+	tests := []struct {
+		spelling string
+		want     string
+	}{
+		{"iOS", "ios"},
+		{"ios", "ios"},
+		{" iPhone ", "ios"},
+		{"IPAD", "ios"},
+		{"Android", "android"},
+		{"android", "android"},
+		{"blackberry", otherDevice},
+		{"", unknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spelling, func(t *testing.T) {
+			// training and serving map the device the same way
+			row := TrainingData{UserID: "u1", Device: bigquery.NullString{StringVal: tt.spelling, Valid: true}}
+			trained, ok := opts.contextFromRow(row)
+			if !ok {
+				t.Fatal("row skipped")
+			}
+			served, err := opts.newContext("u1", "", "", tt.spelling)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if trained.Device != tt.want || served.Device != tt.want {
+				t.Errorf("%q counts as %q training and %q serving, want %q", tt.spelling, trained.Device, served.Device, tt.want)
+			}
+		})
+	}
+
+	for _, s := range []string{"iphone", "=ios", "iphone=ios,iphone=android"} {
+		if _, err := parseDeviceMap(s); err == nil {
+			t.Errorf("parseDeviceMap(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestContextHash(t *testing.T) {
+	// the hash must not change between runs or platforms, as logs of
+	// different processes are correlated by it
+	if got, want := testContext.Hash(), "f0000ea60e6e54eb"; got != want {
+		t.Errorf("Hash() = %s, want %s", got, want)
+	}
+	same := testContext
+	if same.Hash() != testContext.Hash() {
+		t.Error("Hash() differs for the same context")
+	}
+
+	seen := map[string]Context{testContext.Hash(): testContext}
+	for _, ctx := range []Context{
+		{UserID: "u2", TimeOfDay: "morning", Weekday: "monday", Device: "mobile"},
+		{UserID: "u1", TimeOfDay: "evening", Weekday: "monday", Device: "mobile"},
+		{UserID: "u1", TimeOfDay: "morning", Weekday: "tuesday", Device: "mobile"},
+		{UserID: "u1", TimeOfDay: "morning", Weekday: "monday", Device: "desktop"},
+		{UserID: "u1m", TimeOfDay: "orning", Weekday: "monday", Device: "mobile"},
+		{},
+	} {
+		h := ctx.Hash()
+		if other, ok := seen[h]; ok {
+			t.Errorf("%+v and %+v both hash to %s", ctx, other, h)
+		}
+		seen[h] = ctx
+	}
+}
+
+func TestContextAt(t *testing.T) {
+	// a Monday 02:00 in UTC, and still Sunday evening in UTC-5
+	now := time.Date(2023, 5, 1, 2, 0, 0, 0, time.UTC)
+	opts := ContextOptions{Location: time.FixedZone("UTC-5", -5*60*60)}
+
+	tests := []struct {
+		timeOfDay, weekday string
+		want               Context
+	}{
+		{"", "", Context{UserID: "u1", TimeOfDay: "evening", Weekday: "sunday", Device: "mobile"}},
+		{"Morning", "", Context{UserID: "u1", TimeOfDay: "morning", Weekday: "sunday", Device: "mobile"}},
+		{" ", "friday", Context{UserID: "u1", TimeOfDay: "evening", Weekday: "friday", Device: "mobile"}},
+		{"morning", "monday", testContext},
+	}
+	for _, tt := range tests {
+		got, err := opts.contextAt(now, "u1", tt.timeOfDay, tt.weekday, "Mobile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("contextAt(%q, %q) = %+v, want %+v", tt.timeOfDay, tt.weekday, got, tt.want)
+		}
+	}
+
+	if _, err := opts.contextAt(now, "u1", "brunch", "", ""); err == nil {
+		t.Error("contextAt() with an invalid time of day succeeded, want an error")
+	}
+}
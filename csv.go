@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+var csvColumns = []string{"user_id", "item_id", "impression_time", "was_clicked", "device"}
+
+// weightColumn is an optional column with the Weight of every row.
+const weightColumn = "weight"
+
+// CSVDataSource reads training rows from a CSV file with a header row naming
+// the same columns as the BigQuery table.
+type CSVDataSource struct {
+	Path string
+}
+
+func (s *CSVDataSource) Fetch(ctx context.Context) ([]TrainingData, error) {
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rows, err := readTrainingCSV(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.Path, err)
+	}
+
+	return rows, nil
+}
+
+func readTrainingCSV(r io.Reader) ([]TrainingData, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	// Columns may come in any order
+	index := make(map[string]int)
+	for i, name := range header {
+		index[strings.TrimSpace(name)] = i
+	}
+	for _, name := range csvColumns {
+		if _, ok := index[name]; !ok {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	rows := []TrainingData{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		row := TrainingData{
+			UserID: record[index["user_id"]],
+			ItemID: record[index["item_id"]],
+		}
+		if v := record[index["device"]]; v != "" {
+			row.Device = bigquery.NullString{StringVal: v, Valid: true}
+		}
+		if row.HasClick, err = strconv.ParseBool(record[index["was_clicked"]]); err != nil {
+			return nil, fmt.Errorf("line %d: invalid was_clicked: %w", line, err)
+		}
+		if v := record[index["impression_time"]]; v != "" {
+			dt, err := parseDateTime(v)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid impression_time: %w", line, err)
+			}
+			row.Timestamp.DateTime = dt
+			row.Timestamp.Valid = true
+		}
+		if i, ok := index[weightColumn]; ok && record[i] != "" {
+			weight, err := strconv.ParseFloat(record[i], 64)
+			if err != nil || !validWeight(weight) {
+				return nil, fmt.Errorf("line %d: invalid weight %q, must be a number not below 0", line, record[i])
+			}
+			row.Weight = bigquery.NullFloat64{Float64: weight, Valid: true}
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// writeTrainingCSV writes the rows as CSV that readTrainingCSV reads back.
+func writeTrainingCSV(w io.Writer, rows []TrainingData) error {
+	// The weight column is only written when there are weights, so data
+	// without them reads the same with older versions
+	weighted := false
+	for _, row := range rows {
+		weighted = weighted || row.Weight.Valid
+	}
+	columns := csvColumns
+	if weighted {
+		columns = append(slices.Clip(csvColumns), weightColumn)
+	}
+
+	writer := csv.NewWriter(w)
+	err := writer.Write(columns)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		var impressionTime string
+		if row.Timestamp.Valid {
+			impressionTime = row.Timestamp.DateTime.In(time.UTC).Format(time.DateTime)
+		}
+		var device string
+		if row.Device.Valid {
+			device = row.Device.StringVal
+		}
+		record := []string{row.UserID, row.ItemID, impressionTime, strconv.FormatBool(row.HasClick), device}
+		if weighted {
+			var weight string
+			if row.Weight.Valid {
+				weight = strconv.FormatFloat(row.Weight.Float64, 'g', -1, 64)
+			}
+			record = append(record, weight)
+		}
+		err = writer.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// parseDateTime accepts both the BigQuery DATETIME export format
+// ("2023-05-01 13:04:05") and RFC 3339 timestamps.
+func parseDateTime(v string) (civil.DateTime, error) {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return civil.DateTimeOf(t.UTC()), nil
+	}
+	return civil.ParseDateTime(strings.Replace(v, " ", "T", 1))
+}
+
+// ExportPolicyCSV writes the recommended item and its reward for every
+// context, sorted by context. When other items tie with it, serving picks
+// between them at random, so they are listed in tied_item_ids.
+func (s *EpsilonGreedyStrategy) ExportPolicyCSV(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"user_id", "time_of_day", "weekday", "device", "item_id", "reward", "tied_item_ids"})
+	if err != nil {
+		return err
+	}
+
+	for _, ctx := range s.sortedContexts() {
+		rewards := s.Rewards[ctx]
+		if len(rewards) == 0 || s.checkAligned(ctx) != nil {
+			continue
+		}
+		ties := argmaxTies(rewards)
+		best := ties[0]
+		tied := make([]string, 0, len(ties)-1)
+		for _, i := range ties[1:] {
+			tied = append(tied, s.Bandits[i].ItemID)
+		}
+		err = writer.Write([]string{
+			ctx.UserID, ctx.TimeOfDay, ctx.Weekday, ctx.Device,
+			s.Bandits[best].ItemID, strconv.FormatFloat(rewards[best], 'g', -1, 64),
+			strings.Join(tied, ","),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCSVDataSource(t *testing.T) {
+	source := &CSVDataSource{Path: "testdata/training.csv"}
+	rows, err := source.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contexts, bandits := buildBandits(rows, ContextOptions{}, defaultRewardConfig.Func())
+
+	mondayMorning := Context{UserID: "u1", TimeOfDay: "morning", Weekday: "monday", Device: "mobile"}
+	saturdayEvening := Context{UserID: "u2", TimeOfDay: "evening", Weekday: "saturday", Device: unknown}
+	noTime := Context{UserID: "u3", TimeOfDay: unknown, Weekday: unknown, Device: "desktop"}
+	wantContexts := []Context{mondayMorning, saturdayEvening, noTime}
+	if !slices.Equal(contexts, wantContexts) {
+		t.Errorf("contexts = %+v, want %+v", contexts, wantContexts)
+	}
+
+	wantRewards := map[string]map[Context]float64{
+		"a": {mondayMorning: 0.9, saturdayEvening: 1},
+		"b": {mondayMorning: 1, noTime: -0.1},
+	}
+	if len(bandits) != len(wantRewards) {
+		t.Fatalf("%d bandits, want %d", len(bandits), len(wantRewards))
+	}
+	for _, b := range bandits {
+		want := wantRewards[b.ItemID]
+		if len(b.ContextRewards) != len(want) {
+			t.Errorf("%s: rewards = %v, want %v", b.ItemID, b.ContextRewards, want)
+			continue
+		}
+		for ctx, reward := range want {
+			if math.Abs(b.ContextRewards[ctx]-reward) > 1e-9 {
+				t.Errorf("%s: reward in %+v = %v, want %v", b.ItemID, ctx, b.ContextRewards[ctx], reward)
+			}
+		}
+	}
+}
+
+func TestExportPolicyCSV(t *testing.T) {
+	s := newTestStrategy("a", "b", "c")
+	other := Context{UserID: "u0", TimeOfDay: "night", Weekday: "sunday", Device: "desktop"}
+	s.UpdateReward(testContext, s.Bandits[0], 0.2)
+	s.UpdateReward(testContext, s.Bandits[1], 0.75)
+	s.UpdateReward(other, s.Bandits[2], 0)
+
+	var out strings.Builder
+	err := s.ExportPolicyCSV(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "user_id,time_of_day,weekday,device,item_id,reward,tied_item_ids\n" +
+		"u0,night,sunday,desktop,a,0,\"b,c\"\n" + // nothing better than 0 yet
+		"u1,morning,monday,mobile,b,0.75,\n"
+	if out.String() != want {
+		t.Errorf("ExportPolicyCSV() =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestCSVWeightScalesReward(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "weighted.csv")
+	err := os.WriteFile(path, []byte(`user_id,item_id,impression_time,was_clicked,device,weight
+u1,a,2023-05-01 08:15:00,true,mobile,2
+u1,b,2023-05-01 09:00:00,true,mobile,
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := (&CSVDataSource{Path: path}).Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bandits := buildBandits(rows, ContextOptions{}, defaultRewardConfig.Func())
+
+	rewards := map[string]float64{}
+	for _, b := range bandits {
+		rewards[b.ItemID] = b.ContextRewards[testContext]
+	}
+	if rewards["b"] == 0 || math.Abs(rewards["a"]-2*rewards["b"]) > 1e-9 {
+		t.Errorf("rewards = %v, want the click weighted 2 to count twice the unweighted one", rewards)
+	}
+}
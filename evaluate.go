@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"math/rand"
+)
+
+// EvalResult summarizes an offline replay of logged impressions.
+type EvalResult struct {
+	Rows          int     // impressions replayed
+	Matches       int     // impressions where the strategy picked the logged item
+	Clicks        int     // matches that got a click
+	CTR           float64 // Clicks / Matches
+	AverageReward float64 // mean reward over the matches
+}
+
+// Evaluate replays logged impressions through the strategy. Only the
+// impressions where the strategy selects the item that was actually shown
+// tell us anything about the strategy, so the metrics are computed over
+// those matches (the replay method).
+func Evaluate(s Strategy, data []TrainingData, opts ContextOptions, reward RewardFunc) (EvalResult, error) {
+	result := EvalResult{}
+	totalReward := 0.0
+	for _, row := range data {
+		ctx, ok := opts.contextFromRow(row)
+		if !ok {
+			continue
+		}
+		result.Rows++
+
+		bandit, err := s.SelectBandit(ctx)
+		if err != nil {
+			return result, err
+		}
+		if bandit.ItemID != row.ItemID {
+			continue
+		}
+
+		result.Matches++
+		if row.HasClick {
+			result.Clicks++
+		}
+		totalReward += row.weightedReward(reward)
+	}
+
+	if result.Matches > 0 {
+		result.CTR = float64(result.Clicks) / float64(result.Matches)
+		result.AverageReward = totalReward / float64(result.Matches)
+	}
+
+	return result, nil
+}
+
+// splitTrainTest randomly holds out a fraction of the rows for testing. The
+// split only depends on the rows and the random number generator, so a seeded
+// generator gives the same split every time.
+func splitTrainTest(rows []TrainingData, testFraction float64, rng *rand.Rand) (train []TrainingData, test []TrainingData) {
+	nTest := int(math.Round(float64(len(rows)) * testFraction))
+	if nTest > len(rows) {
+		nTest = len(rows)
+	}
+
+	perm := rng.Perm(len(rows))
+	test = make([]TrainingData, 0, nTest)
+	train = make([]TrainingData, 0, len(rows)-nTest)
+	for i, j := range perm {
+		if i < nTest {
+			test = append(test, rows[j])
+		} else {
+			train = append(train, rows[j])
+		}
+	}
+
+	return train, test
+}
+
+// evaluateModel evaluates the saved model on the rows from the data source.
+func evaluateModel(source DataSource, cfg TrainConfig) error {
+	slog.Info("Loading model", "file", cfg.modelFile())
+	strategy, err := loadAnyModel(cfg.modelFile(), cfg.Seed)
+	if err != nil {
+		return err
+	}
+
+	rows, err := source.Fetch(context.Background())
+	if err != nil {
+		return err
+	}
+	slog.Info("Fetched evaluation data", "rows", len(rows))
+
+	result, err := Evaluate(strategy, rows, cfg.Context, cfg.rewardFunc())
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Evaluated model", "rows", result.Rows, "matches", result.Matches,
+		"ctr", result.CTR, "avg_reward", result.AverageReward)
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	u1 := Context{UserID: "u1", TimeOfDay: unknown, Weekday: unknown, Device: unknown}
+	u2 := Context{UserID: "u2", TimeOfDay: unknown, Weekday: unknown, Device: unknown}
+	s := newTestStrategy("a", "b")
+	s.Epsilon = 0
+	s.UpdateReward(u1, s.Bandits[0], 1)
+	s.UpdateReward(u2, s.Bandits[1], 1)
+
+	data := []TrainingData{
+		{UserID: "u1", ItemID: "a", HasClick: true},
+		{UserID: "u1", ItemID: "a", HasClick: false},
+		{UserID: "u1", ItemID: "b", HasClick: true}, // not what the strategy picks
+		{UserID: "u2", ItemID: "b", HasClick: true},
+	}
+	result, err := Evaluate(s, data, ContextOptions{}, defaultRewardConfig.Func())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Rows != 4 || result.Matches != 3 || result.Clicks != 2 {
+		t.Errorf("rows, matches, clicks = %d, %d, %d, want 4, 3, 2", result.Rows, result.Matches, result.Clicks)
+	}
+	if math.Abs(result.CTR-2.0/3) > 1e-9 {
+		t.Errorf("CTR = %v, want 2/3", result.CTR)
+	}
+	if math.Abs(result.AverageReward-1.9/3) > 1e-9 {
+		t.Errorf("average reward = %v, want 1.9/3", result.AverageReward)
+	}
+}
+
+func TestSplitTrainTest(t *testing.T) {
+	rows := make([]TrainingData, 10)
+	for i := range rows {
+		rows[i] = TrainingData{UserID: fmt.Sprintf("u%d", i)}
+	}
+
+	train, test := splitTrainTest(rows, 0.2, rand.New(rand.NewSource(1)))
+	if len(train) != 8 || len(test) != 2 {
+		t.Fatalf("split into %d train and %d test rows, want 8 and 2", len(train), len(test))
+	}
+	seen := make(map[string]bool)
+	for _, row := range append(train, test...) {
+		if seen[row.UserID] {
+			t.Errorf("row %s is in both sets", row.UserID)
+		}
+		seen[row.UserID] = true
+	}
+	if len(seen) != len(rows) {
+		t.Errorf("%d rows in the sets, want all %d", len(seen), len(rows))
+	}
+
+	_, again := splitTrainTest(rows, 0.2, rand.New(rand.NewSource(1)))
+	for i := range test {
+		if test[i].UserID != again[i].UserID {
+			t.Errorf("test sets with the same seed differ: %v and %v", test, again)
+			break
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import "math"
+
+// EXP3Strategy keeps a weight for every bandit in a context and picks bandits
+// at random in proportion to them, mixed with Gamma of uniform exploration.
+// Rewards grow the weight of the pulled bandit by how unlikely it was to be
+// picked, so it adapts when rewards shift, even adversarially. Rewards are
+// clamped to [0, 1].
+//
+// Unlike textbook EXP3, every update also shares Alpha of the total weight
+// with every bandit, like EXP3.S does. Without it the weight of a bandit that
+// did badly for a long time shrinks without bound, and it takes about as long
+// to catch up once it becomes the best, so EXP3 would barely adapt to rewards
+// that switch. Alpha 0 is plain EXP3.
+type EXP3Strategy struct {
+	Gamma   float64 // share of uniform exploration, between 0 and 1
+	Alpha   float64 // share of the total weight given to every bandit on update
+	Bandits []*Bandit
+	Weights map[Context][]float64
+
+	seededRand
+}
+
+func (s *EXP3Strategy) SelectBandit(ctx Context) (*Bandit, error) {
+	if len(s.Bandits) == 0 {
+		return nil, errNoBandits
+	}
+
+	s.initContext(ctx)
+
+	r := s.random().Float64()
+	for i, p := range s.probabilities(ctx) {
+		r -= p
+		if r < 0 {
+			return s.Bandits[i], nil
+		}
+	}
+	return s.Bandits[len(s.Bandits)-1], nil // rounding
+}
+
+func (s *EXP3Strategy) UpdateReward(ctx Context, b *Bandit, reward float64) {
+	s.initContext(ctx)
+
+	probs := s.probabilities(ctx)
+	weights := s.Weights[ctx]
+	k := float64(len(s.Bandits))
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	for i := range s.Bandits {
+		if s.Bandits[i] == b {
+			estimate := math.Min(math.Max(reward, 0), 1) / probs[i]
+			weights[i] *= math.Exp(s.Gamma * estimate / k)
+		}
+		weights[i] += math.E * s.Alpha / k * total
+	}
+
+	// Scale the weights down so they don't overflow, only their ratios matter
+	maxWeight := weights[argmax(weights)]
+	for i := range weights {
+		weights[i] /= maxWeight
+	}
+}
+
+func (s *EXP3Strategy) Reset() {
+	s.Weights = make(map[Context][]float64)
+}
+
+func (s *EXP3Strategy) SaveState(filename string) error {
+	return saveModel(filename, s, ModelMetadata{})
+}
+
+func (s *EXP3Strategy) LoadState(filename string) error {
+	return loadGob(filename, s)
+}
+
+// probabilities returns the chance of picking each bandit in the context.
+func (s *EXP3Strategy) probabilities(ctx Context) []float64 {
+	weights := s.Weights[ctx]
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+
+	k := float64(len(s.Bandits))
+	probs := make([]float64, len(weights))
+	for i, w := range weights {
+		probs[i] = (1-s.Gamma)*w/total + s.Gamma/k
+	}
+	return probs
+}
+
+// initContext gives every bandit the same weight in a context we haven't seen
+// yet.
+func (s *EXP3Strategy) initContext(ctx Context) {
+	if s.Weights == nil {
+		s.Weights = make(map[Context][]float64)
+	}
+	if _, ok := s.Weights[ctx]; ok {
+		return
+	}
+	s.Weights[ctx] = make([]float64, len(s.Bandits))
+	for i := range s.Bandits {
+		s.Weights[ctx][i] = 1
+	}
+}
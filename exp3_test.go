@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestEXP3AdaptsToSwitchingRewards(t *testing.T) {
+	// a is the best item for the first 500 rounds, b for the next 500
+	const rounds = 500
+	bestShare := func(s Strategy, bandits []*Bandit) float64 {
+		picks := 0
+		for i := 0; i < 2*rounds; i++ {
+			b, err := s.SelectBandit(testContext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			best := bandits[i/rounds]
+			reward := 0.0
+			if b == best {
+				reward = 1
+			}
+			s.UpdateReward(testContext, b, reward)
+			if i >= 2*rounds-rounds/2 && b == best {
+				picks++
+			}
+		}
+		// the share of the last 250 rounds the best item was picked in
+		return float64(picks) / (rounds / 2)
+	}
+
+	bandits := []*Bandit{{ItemID: "a"}, {ItemID: "b"}}
+	exp3 := &EXP3Strategy{Gamma: 0.2, Alpha: 1e-3, Bandits: bandits}
+	exp3.Seed(1)
+	epsilon := newTestStrategy("a", "b")
+
+	if share := bestShare(exp3, bandits); share < 0.7 {
+		t.Errorf("EXP3 picked the new best item %.2f of the time after the switch, want at least 0.7", share)
+	}
+	if share := bestShare(epsilon, epsilon.Bandits); share > 0.3 {
+		t.Errorf("epsilon-greedy picked the new best item %.2f of the time after the switch, want it to lag", share)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+
+	"smokey/smokeypb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer serves the default model of the HTTP server, or the model the
+// user is assigned to with an A/B split, so rewards from both end up in the
+// same strategy and are saved together.
+type grpcServer struct {
+	smokeypb.UnimplementedRecommenderServer
+	srv *server
+}
+
+func (g *grpcServer) Recommend(ctx context.Context, req *smokeypb.RecommendRequest) (*smokeypb.RecommendResponse, error) {
+	model, err := g.srv.model("", req.GetContext().GetUserId())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	c, err := g.srv.contextFromProto(req.GetContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	bandit, explored, err := model.strategy.SelectBanditWithInfo(c)
+	if g.srv.useDefault(model, c, err) {
+		itemID := g.srv.defaultResponse(model).ItemID
+		logRecommendation(model.name, c, itemID, "default")
+		return &smokeypb.RecommendResponse{ItemId: itemID}, nil
+	}
+	if errors.Is(err, errNoBandits) {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	g.srv.metrics.recommended(model.name, bandit, explored)
+	logRecommendation(model.name, c, bandit.ItemID, decision(explored))
+	return &smokeypb.RecommendResponse{ItemId: bandit.ItemID}, nil
+}
+
+func (g *grpcServer) UpdateReward(ctx context.Context, req *smokeypb.UpdateRewardRequest) (*smokeypb.UpdateRewardResponse, error) {
+	if math.IsNaN(req.GetReward()) || math.IsInf(req.GetReward(), 0) {
+		return nil, status.Error(codes.InvalidArgument, "reward must be a number")
+	}
+	weight := 1.0
+	if req.Weight != nil {
+		weight = req.GetWeight()
+		if !validWeight(weight) {
+			return nil, status.Error(codes.InvalidArgument, "weight must be a number not below 0")
+		}
+	}
+
+	model, err := g.srv.model("", req.GetContext().GetUserId())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	c, err := g.srv.contextFromProto(req.GetContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	bandit := model.strategy.FindBandit(req.GetItemId())
+	if bandit == nil {
+		return nil, status.Errorf(codes.NotFound, "unknown item_id %s", req.GetItemId())
+	}
+
+	reward := g.srv.reward(req.GetReward(), weight)
+	model.strategy.UpdateReward(c, bandit, reward)
+	g.srv.metrics.rewardUpdates.WithLabelValues(model.name).Inc()
+	logReward(model.name, c, bandit.ItemID, reward)
+	model.dirty.Store(true)
+	err = model.persist(ctx, c, bandit, reward)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not save reward: %v", err)
+	}
+
+	return &smokeypb.UpdateRewardResponse{}, nil
+}
+
+// contextFromProto builds the context of a call like the HTTP server does,
+// see server.context.
+func (srv *server) contextFromProto(c *smokeypb.Context) (Context, error) {
+	return srv.context(c.GetUserId(), c.GetTimeOfDay(), c.GetWeekday(), c.GetDevice())
+}
+
+// serveGRPC serves until ctx is done, then lets the calls in flight finish.
+func serveGRPC(ctx context.Context, addr string, srv *server) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s := grpc.NewServer()
+	smokeypb.RegisterRecommenderServer(s, &grpcServer{srv: srv})
+	go func() {
+		<-ctx.Done()
+		s.GracefulStop()
+	}()
+
+	slog.Info("Serving gRPC recommendations", "addr", addr)
+	return s.Serve(lis)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"smokey/smokeypb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestGRPCClient serves srv over gRPC in process and returns a client
+// connected to it.
+func newTestGRPCClient(t *testing.T, srv *server) smokeypb.RecommenderClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	smokeypb.RegisterRecommenderServer(s, &grpcServer{srv: srv})
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return smokeypb.NewRecommenderClient(conn)
+}
+
+func TestGRPCRecommend(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.Epsilon = 0
+	s.UpdateReward(testContext, s.Bandits[1], 1)
+	client := newTestGRPCClient(t, newTestServer(t, s))
+
+	pbContext := &smokeypb.Context{UserId: "u1", TimeOfDay: "Morning", Weekday: "monday", Device: "mobile"}
+	resp, err := client.Recommend(context.Background(), &smokeypb.RecommendRequest{Context: pbContext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetItemId() != "b" {
+		t.Errorf("item_id = %q, want the rewarded b", resp.GetItemId())
+	}
+
+	_, err = client.Recommend(context.Background(), &smokeypb.RecommendRequest{
+		Context: &smokeypb.Context{UserId: "u1", TimeOfDay: "brunch", Weekday: "monday"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Recommend() with an invalid time of day: error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestGRPCUpdateReward(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	client := newTestGRPCClient(t, newTestServer(t, s))
+
+	pbContext := &smokeypb.Context{UserId: "u1", TimeOfDay: "morning", Weekday: "monday", Device: "mobile"}
+	_, err := client.UpdateReward(context.Background(), &smokeypb.UpdateRewardRequest{Context: pbContext, ItemId: "a", Reward: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mean, n := s.Confidence(testContext, "a"); mean != 1 || n != 1 {
+		t.Errorf("reward of a = %v from %d rewards, want 1 from 1", mean, n)
+	}
+
+	_, err = client.UpdateReward(context.Background(), &smokeypb.UpdateRewardRequest{Context: pbContext, ItemId: "c", Reward: 1})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("UpdateReward() of an unknown item: error = %v, want NotFound", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// JSON can't use the Context struct as a map key, so the context keyed maps
+// are written as lists of {context, value(s)} objects sorted by context.
+
+type contextValueJSON struct {
+	Context Context `json:"context"`
+	Value   float64 `json:"value"`
+}
+
+type contextRewardsJSON struct {
+	Context Context   `json:"context"`
+	Values  []float64 `json:"values"`
+}
+
+type contextCountsJSON struct {
+	Context Context `json:"context"`
+	Values  []int   `json:"values"`
+}
+
+type contextTimeJSON struct {
+	Context Context   `json:"context"`
+	Time    time.Time `json:"time"`
+}
+
+type banditJSON struct {
+	ItemID         string             `json:"item_id"`
+	ContextRewards []contextValueJSON `json:"context_rewards"`
+}
+
+// epsilonGreedyFields has the fields of EpsilonGreedyStrategy but not its
+// methods, so embedding it in epsilonGreedyJSON picks up the plain fields
+// while the context keyed ones are shadowed.
+type epsilonGreedyFields EpsilonGreedyStrategy
+
+type epsilonGreedyJSON struct {
+	*epsilonGreedyFields
+	Bandits           []banditJSON
+	Rewards           []contextRewardsJSON
+	Counts            []contextCountsJSON
+	LastUpdated       []contextTimeJSON
+	SquaredDeviations []contextRewardsJSON
+}
+
+// SaveStateJSON writes the strategy as indented JSON so it can be inspected
+// and diffed.
+func (s *EpsilonGreedyStrategy) SaveStateJSON(filename string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	state := epsilonGreedyJSON{epsilonGreedyFields: (*epsilonGreedyFields)(s)}
+
+	for _, b := range s.Bandits {
+		bj := banditJSON{ItemID: b.ItemID, ContextRewards: []contextValueJSON{}}
+		for _, ctx := range sortContexts(b.ContextRewards) {
+			bj.ContextRewards = append(bj.ContextRewards, contextValueJSON{ctx, b.ContextRewards[ctx]})
+		}
+		state.Bandits = append(state.Bandits, bj)
+	}
+	for _, ctx := range s.sortedContexts() {
+		state.Rewards = append(state.Rewards, contextRewardsJSON{ctx, s.Rewards[ctx]})
+	}
+	for _, ctx := range sortContexts(s.Counts) {
+		state.Counts = append(state.Counts, contextCountsJSON{ctx, s.Counts[ctx]})
+	}
+	for _, ctx := range sortContexts(s.LastUpdated) {
+		state.LastUpdated = append(state.LastUpdated, contextTimeJSON{ctx, s.LastUpdated[ctx]})
+	}
+	for _, ctx := range sortContexts(s.SquaredDeviations) {
+		state.SquaredDeviations = append(state.SquaredDeviations, contextRewardsJSON{ctx, s.SquaredDeviations[ctx]})
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func (s *EpsilonGreedyStrategy) LoadStateJSON(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := epsilonGreedyJSON{epsilonGreedyFields: (*epsilonGreedyFields)(s)}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+
+	s.Bandits = make([]*Bandit, len(state.Bandits))
+	for i, bj := range state.Bandits {
+		b := &Bandit{ItemID: bj.ItemID, ContextRewards: make(map[Context]float64)}
+		for _, cv := range bj.ContextRewards {
+			b.ContextRewards[cv.Context] = cv.Value
+		}
+		s.Bandits[i] = b
+	}
+	s.Rewards = make(map[Context][]float64)
+	for _, cr := range state.Rewards {
+		s.Rewards[cr.Context] = cr.Values
+	}
+	s.Counts = make(map[Context][]int)
+	for _, cc := range state.Counts {
+		s.Counts[cc.Context] = cc.Values
+	}
+	s.LastUpdated = nil
+	if len(state.LastUpdated) > 0 {
+		s.LastUpdated = make(map[Context]time.Time, len(state.LastUpdated))
+		for _, ct := range state.LastUpdated {
+			s.LastUpdated[ct.Context] = ct.Time
+		}
+	}
+	s.SquaredDeviations = nil
+	if len(state.SquaredDeviations) > 0 {
+		s.SquaredDeviations = make(map[Context][]float64, len(state.SquaredDeviations))
+		for _, cd := range state.SquaredDeviations {
+			s.SquaredDeviations[cd.Context] = cd.Values
+		}
+	}
+	s.lru = nil // rebuilt from the loaded LastUpdated
+
+	return nil
+}
+
+// sortedContexts returns the contexts of the strategy ordered by UserID,
+// TimeOfDay, Weekday and Device, so reports and exports list them the same
+// way every time. Call with the lock held.
+func (s *EpsilonGreedyStrategy) sortedContexts() []Context {
+	return sortContexts(s.Rewards)
+}
+
+// sortContexts returns the keys of a context keyed map in a stable order.
+func sortContexts[V any](m map[Context]V) []Context {
+	contexts := make([]Context, 0, len(m))
+	for ctx := range m {
+		contexts = append(contexts, ctx)
+	}
+	sort.Slice(contexts, func(i, j int) bool {
+		return contextLess(contexts[i], contexts[j])
+	})
+
+	return contexts
+}
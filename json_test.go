@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSaveStateJSONRoundTrip(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.EpsilonDecay = 0.99
+	other := Context{UserID: "u2", TimeOfDay: "night", Weekday: "sunday", Device: "desktop"}
+	s.UpdateReward(testContext, s.Bandits[0], 1)
+	s.UpdateReward(testContext, s.Bandits[1], 0)
+	s.UpdateReward(other, s.Bandits[1], 0.5)
+	s.Bandits[0].ContextRewards[testContext] = 3
+
+	filename := filepath.Join(t.TempDir(), "model.json")
+	err := s.SaveStateJSON(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &EpsilonGreedyStrategy{}
+	err = loaded.LoadStateJSON(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.Epsilon != s.Epsilon || loaded.EpsilonDecay != s.EpsilonDecay {
+		t.Errorf("loaded Epsilon, EpsilonDecay = %v, %v, want %v, %v", loaded.Epsilon, loaded.EpsilonDecay, s.Epsilon, s.EpsilonDecay)
+	}
+	if !reflect.DeepEqual(itemIDs(loaded.Bandits), itemIDs(s.Bandits)) {
+		t.Errorf("loaded bandits %v, want %v", itemIDs(loaded.Bandits), itemIDs(s.Bandits))
+	}
+	if got := loaded.Bandits[0].ContextRewards[testContext]; got != 3 {
+		t.Errorf("loaded context reward = %v, want 3", got)
+	}
+	if !reflect.DeepEqual(loaded.Rewards, s.Rewards) {
+		t.Errorf("loaded Rewards = %v, want %v", loaded.Rewards, s.Rewards)
+	}
+	if !reflect.DeepEqual(loaded.Counts, s.Counts) {
+		t.Errorf("loaded Counts = %v, want %v", loaded.Counts, s.Counts)
+	}
+	if !reflect.DeepEqual(loaded.SquaredDeviations, s.SquaredDeviations) {
+		t.Errorf("loaded SquaredDeviations = %v, want %v", loaded.SquaredDeviations, s.SquaredDeviations)
+	}
+	for ctx, updated := range s.LastUpdated {
+		if !loaded.LastUpdated[ctx].Equal(updated) {
+			t.Errorf("loaded LastUpdated[%+v] = %v, want %v", ctx, loaded.LastUpdated[ctx], updated)
+		}
+	}
+}
+
+func TestLoadStateJSONEvictsByLastUpdated(t *testing.T) {
+	older := Context{UserID: "older"}
+	newer := Context{UserID: "newer"}
+	s := newTestStrategy("a")
+	s.MaxContexts = 2
+	s.UpdateReward(older, s.Bandits[0], 1)
+	s.UpdateReward(newer, s.Bandits[0], 1)
+	now := time.Now().UTC()
+	s.LastUpdated[older] = now.Add(-time.Hour)
+	s.LastUpdated[newer] = now
+
+	filename := filepath.Join(t.TempDir(), "model.json")
+	err := s.SaveStateJSON(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &EpsilonGreedyStrategy{}
+	err = loaded.LoadStateJSON(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded.UpdateReward(Context{UserID: "new"}, loaded.Bandits[0], 1)
+	if _, ok := loaded.Rewards[older]; ok {
+		t.Error("the least recently updated context wasn't evicted")
+	}
+	if _, ok := loaded.Rewards[newer]; !ok {
+		t.Error("the most recently updated context was evicted")
+	}
+}
+
+func TestSortedContexts(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	var contexts []Context
+	for _, user := range []string{"u2", "u1", "u10"} {
+		for _, timeOfDay := range []string{"night", "morning"} {
+			for _, device := range []string{"mobile", "desktop"} {
+				ctx := Context{UserID: user, TimeOfDay: timeOfDay, Weekday: "monday", Device: device}
+				contexts = append(contexts, ctx)
+				s.UpdateReward(ctx, s.Bandits[len(contexts)%2], 1)
+			}
+		}
+	}
+
+	first := s.sortedContexts()
+	if !slices.IsSortedFunc(first, func(a, b Context) int {
+		if contextLess(a, b) {
+			return -1
+		}
+		return 1
+	}) || len(first) != len(contexts) {
+		t.Fatalf("sortedContexts() = %v, want all %d contexts by user, time of day, weekday and device", first, len(contexts))
+	}
+	if want := (Context{UserID: "u1", TimeOfDay: "morning", Weekday: "monday", Device: "desktop"}); first[0] != want {
+		t.Errorf("first context = %+v, want %+v", first[0], want)
+	}
+
+	var firstCSV bytes.Buffer
+	if err := s.ExportPolicyCSV(&firstCSV); err != nil {
+		t.Fatal(err)
+	}
+	firstStats := s.Stats()
+	for i := 0; i < 10; i++ {
+		if again := s.sortedContexts(); !slices.Equal(again, first) {
+			t.Fatalf("sortedContexts() = %v, then %v", first, again)
+		}
+		var csv bytes.Buffer
+		if err := s.ExportPolicyCSV(&csv); err != nil {
+			t.Fatal(err)
+		}
+		if csv.String() != firstCSV.String() {
+			t.Fatalf("ExportPolicyCSV() wrote\n%s\nthen\n%s", firstCSV.String(), csv.String())
+		}
+		if stats := s.Stats(); !reflect.DeepEqual(stats, firstStats) {
+			t.Fatal("Stats() differs between calls")
+		}
+	}
+}
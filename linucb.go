@@ -0,0 +1,153 @@
+package main
+
+import "math"
+
+// LinUCBStrategy learns, for every bandit, a linear model of the reward from
+// the features of a context: one-hot encodings of the time of day, weekday
+// and device, plus a bias. It picks the bandit with the highest upper
+// confidence bound on the predicted reward, so what is learned in one context
+// carries over to contexts that share features with it.
+//
+// The models are ridge regressions, kept as the inverse of A = I + sum(x x^T)
+// and b = sum(reward x) per bandit. Features are added as they are seen,
+// which keeps A^-1 exact since a new feature only adds an identity row and
+// column.
+type LinUCBStrategy struct {
+	Alpha    float64 // width of the confidence bound, higher explores more
+	Bandits  []*Bandit
+	Features map[string]int // feature name to index in the vectors
+	AInv     [][][]float64  // per bandit, index aligned with Bandits
+	B        [][]float64    // per bandit, index aligned with Bandits
+}
+
+func (s *LinUCBStrategy) SelectBandit(ctx Context) (*Bandit, error) {
+	if len(s.Bandits) == 0 {
+		return nil, errNoBandits
+	}
+
+	x := s.featureVector(ctx)
+
+	maxBound := math.Inf(-1)
+	maxIndex := 0
+	for i := range s.Bandits {
+		ax := mulVec(s.AInv[i], x)
+		bound := dot(mulVec(s.AInv[i], s.B[i]), x) + s.Alpha*math.Sqrt(dot(x, ax))
+		if bound > maxBound {
+			maxBound = bound
+			maxIndex = i
+		}
+	}
+
+	return s.Bandits[maxIndex], nil
+}
+
+func (s *LinUCBStrategy) UpdateReward(ctx Context, b *Bandit, reward float64) {
+	x := s.featureVector(ctx)
+	for i := range s.Bandits {
+		if s.Bandits[i] != b {
+			continue
+		}
+
+		// Sherman-Morrison: (A + x x^T)^-1 = A^-1 - (A^-1 x)(A^-1 x)^T / (1 + x^T A^-1 x)
+		ax := mulVec(s.AInv[i], x)
+		denom := 1 + dot(x, ax)
+		for r := range s.AInv[i] {
+			for c := range s.AInv[i][r] {
+				s.AInv[i][r][c] -= ax[r] * ax[c] / denom
+			}
+		}
+		for j := range x {
+			s.B[i][j] += reward * x[j]
+		}
+	}
+}
+
+func (s *LinUCBStrategy) Reset() {
+	s.Features = nil
+	s.AInv = nil
+	s.B = nil
+}
+
+func (s *LinUCBStrategy) SaveState(filename string) error {
+	return saveModel(filename, s, ModelMetadata{})
+}
+
+func (s *LinUCBStrategy) LoadState(filename string) error {
+	return loadGob(filename, s)
+}
+
+// contextFeatures returns the names of the features of a context.
+func contextFeatures(ctx Context) []string {
+	return []string{
+		"bias",
+		"time_of_day=" + ctx.TimeOfDay,
+		"weekday=" + ctx.Weekday,
+		"device=" + ctx.Device,
+	}
+}
+
+// featureVector returns the one-hot feature vector of the context, adding
+// features that haven't been seen before.
+func (s *LinUCBStrategy) featureVector(ctx Context) []float64 {
+	if s.Features == nil {
+		s.Features = make(map[string]int)
+	}
+	for len(s.AInv) < len(s.Bandits) {
+		s.AInv = append(s.AInv, identity(len(s.Features)))
+		s.B = append(s.B, make([]float64, len(s.Features)))
+	}
+
+	names := contextFeatures(ctx)
+	for _, name := range names {
+		if _, ok := s.Features[name]; ok {
+			continue
+		}
+		s.Features[name] = len(s.Features)
+		for i := range s.AInv {
+			s.AInv[i] = growIdentity(s.AInv[i])
+			s.B[i] = append(s.B[i], 0)
+		}
+	}
+
+	x := make([]float64, len(s.Features))
+	for _, name := range names {
+		x[s.Features[name]] = 1
+	}
+	return x
+}
+
+func identity(n int) [][]float64 {
+	m := make([][]float64, n)
+	for i := range m {
+		m[i] = make([]float64, n)
+		m[i][i] = 1
+	}
+	return m
+}
+
+// growIdentity adds a row and column of the identity matrix to m.
+func growIdentity(m [][]float64) [][]float64 {
+	n := len(m)
+	for i := range m {
+		m[i] = append(m[i], 0)
+	}
+	row := make([]float64, n+1)
+	row[n] = 1
+	return append(m, row)
+}
+
+func mulVec(m [][]float64, v []float64) []float64 {
+	out := make([]float64, len(m))
+	for i, row := range m {
+		out[i] = dot(row, v)
+	}
+	return out
+}
+
+func dot(a, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestLinUCBRegretBelowEpsilonOnLinearRewards(t *testing.T) {
+	// The reward of an item is the sum of a weight per feature of the context,
+	// so the best item depends on the time of day and device
+	times := []string{"morning", "afternoon", "evening", "night"}
+	weekdays := []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"}
+	devices := []string{"mobile", "desktop", "tablet"}
+	items := []string{"news", "sports", "games"}
+	weights := map[string][]float64{
+		"morning":   {0.6, 0.2, 0},
+		"afternoon": {0.2, 0.4, 0.1},
+		"evening":   {0, 0.3, 0.5},
+		"night":     {0, 0, 0.6},
+		"mobile":    {0.1, 0, 0.3},
+		"desktop":   {0.3, 0.1, 0},
+		"tablet":    {0, 0.2, 0.1},
+	}
+	expected := func(ctx Context, item int) float64 {
+		return weights[ctx.TimeOfDay][item] + weights[ctx.Device][item]
+	}
+
+	regret := func(s Strategy, bandits []*Bandit) float64 {
+		rng := rand.New(rand.NewSource(1))
+		total := 0.0
+		for i := 0; i < 3000; i++ {
+			ctx := Context{
+				UserID:    "u1",
+				TimeOfDay: times[rng.Intn(len(times))],
+				Weekday:   weekdays[rng.Intn(len(weekdays))],
+				Device:    devices[rng.Intn(len(devices))],
+			}
+			b, err := s.SelectBandit(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			best := 0.0
+			for j := range items {
+				best = max(best, expected(ctx, j))
+			}
+			reward := expected(ctx, indexOf(bandits, b))
+			total += best - reward
+			s.UpdateReward(ctx, b, reward+rng.NormFloat64()*0.1)
+		}
+		return total
+	}
+
+	linucb := strategies["linucb"](newTestStrategy(items...).Bandits).(*LinUCBStrategy)
+	epsilon := newTestStrategy(items...)
+
+	linucbRegret, epsilonRegret := regret(linucb, linucb.Bandits), regret(epsilon, epsilon.Bandits)
+	if linucbRegret >= epsilonRegret {
+		t.Errorf("LinUCB regret = %.1f, want below the %.1f of epsilon-greedy", linucbRegret, epsilonRegret)
+	}
+}
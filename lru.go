@@ -0,0 +1,114 @@
+package main
+
+import (
+	"container/list"
+	"sort"
+)
+
+// contextLRU orders contexts from the most to the least recently updated, to
+// evict the least recently updated ones when there are more than
+// MaxContexts.
+type contextLRU struct {
+	order    *list.List // of Context, most recently updated first
+	elements map[Context]*list.Element
+}
+
+// newContextLRU orders the contexts of the strategy by when they were last
+// updated, those without a time being the least recent. Call with the lock
+// held.
+func newContextLRU(s *EpsilonGreedyStrategy) *contextLRU {
+	contexts := make([]Context, 0, len(s.Rewards))
+	for ctx := range s.Rewards {
+		contexts = append(contexts, ctx)
+	}
+	sort.Slice(contexts, func(i, j int) bool {
+		return s.LastUpdated[contexts[i]].After(s.LastUpdated[contexts[j]])
+	})
+
+	l := &contextLRU{order: list.New(), elements: make(map[Context]*list.Element, len(contexts))}
+	for _, ctx := range contexts {
+		l.elements[ctx] = l.order.PushBack(ctx)
+	}
+	return l
+}
+
+// touch makes the context the most recently updated.
+func (l *contextLRU) touch(ctx Context) {
+	if e, ok := l.elements[ctx]; ok {
+		l.order.MoveToFront(e)
+		return
+	}
+	l.elements[ctx] = l.order.PushFront(ctx)
+}
+
+// removeOldest removes the least recently updated context and returns it,
+// or false if there are none.
+func (l *contextLRU) removeOldest() (Context, bool) {
+	e := l.order.Back()
+	if e == nil {
+		return Context{}, false
+	}
+	ctx := l.order.Remove(e).(Context)
+	delete(l.elements, ctx)
+	return ctx, true
+}
+
+// LimitContexts sets MaxContexts and evicts the least recently updated
+// contexts above it right away. It returns how many it evicted.
+func (s *EpsilonGreedyStrategy) LimitContexts(maxContexts int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.MaxContexts = maxContexts
+	s.lru = nil // rebuilt from LastUpdated
+	return s.evictContexts()
+}
+
+// touchContext marks the context as the most recently updated and evicts
+// the least recently updated contexts above MaxContexts. Call with the lock
+// held.
+func (s *EpsilonGreedyStrategy) touchContext(key Context) {
+	if s.MaxContexts <= 0 {
+		return
+	}
+	if s.lru == nil {
+		s.lru = newContextLRU(s)
+	}
+	s.lru.touch(key)
+	s.evictContexts()
+}
+
+// evictContexts forgets the least recently updated contexts until there are
+// no more than MaxContexts, and returns how many it forgot. Selection backs
+// off in an evicted context like in any other context without rewards. Call
+// with the lock held.
+func (s *EpsilonGreedyStrategy) evictContexts() int {
+	if s.MaxContexts <= 0 {
+		return 0
+	}
+	if s.lru == nil {
+		s.lru = newContextLRU(s)
+	}
+
+	evicted := 0
+	for len(s.Rewards) > s.MaxContexts {
+		ctx, ok := s.lru.removeOldest()
+		if !ok {
+			// contexts were added without being touched, start over
+			s.lru = newContextLRU(s)
+			if s.lru.order.Len() == 0 {
+				break
+			}
+			continue
+		}
+		if _, ok := s.Rewards[ctx]; !ok {
+			continue // already forgotten, e.g. pruned
+		}
+		delete(s.Rewards, ctx)
+		delete(s.Counts, ctx)
+		delete(s.LastUpdated, ctx)
+		delete(s.SquaredDeviations, ctx)
+		evicted++
+	}
+	return evicted
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaxContextsEvictsLeastRecentlyUpdated(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.MaxContexts = 2
+	c1, c2, c3 := Context{UserID: "u1"}, Context{UserID: "u2"}, Context{UserID: "u3"}
+
+	s.UpdateReward(c1, s.Bandits[0], 1)
+	s.UpdateReward(c2, s.Bandits[0], 1)
+	s.UpdateReward(c1, s.Bandits[1], 1) // c2 is now the least recently updated
+	s.UpdateReward(c3, s.Bandits[0], 1)
+
+	if len(s.Rewards) != 2 {
+		t.Fatalf("%d contexts kept, want 2", len(s.Rewards))
+	}
+	if _, ok := s.Rewards[c2]; ok {
+		t.Error("c2 kept, want the least recently updated context evicted")
+	}
+	for _, ctx := range []Context{c1, c3} {
+		if _, ok := s.Rewards[ctx]; !ok {
+			t.Errorf("%s evicted, want it kept", ctx.UserID)
+		}
+	}
+	if _, ok := s.Counts[c2]; ok {
+		t.Error("counts of c2 kept after evicting it")
+	}
+	if _, err := s.SelectBandit(c2); err != nil {
+		t.Errorf("SelectBandit() in an evicted context error = %v", err)
+	}
+}
+
+func TestLimitContexts(t *testing.T) {
+	s := newTestStrategy("a")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, id := range []string{"u1", "u2", "u3", "u4"} {
+		ctx := Context{UserID: id}
+		s.UpdateReward(ctx, s.Bandits[0], 1)
+		s.LastUpdated[ctx] = start.Add(time.Duration(i) * time.Hour)
+	}
+
+	if evicted := s.LimitContexts(2); evicted != 2 {
+		t.Errorf("LimitContexts() = %d, want 2", evicted)
+	}
+	for _, id := range []string{"u3", "u4"} {
+		if _, ok := s.Rewards[Context{UserID: id}]; !ok {
+			t.Errorf("%s evicted, want the 2 most recently updated contexts kept", id)
+		}
+	}
+}
@@ -1,24 +1,42 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/gob"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
 	"math/rand"
+	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Context struct {
-	UserID    string
-	TimeOfDay string
-	Weekday   string
-	Device    string
+	UserID    string `json:"user_id"`
+	TimeOfDay string `json:"time_of_day"`
+	Weekday   string `json:"weekday"`
+	Device    string `json:"device"`
 }
 
 type Bandit struct {
@@ -35,16 +53,282 @@ func (b *Bandit) Pull(ctx Context) float64 {
 	return reward
 }
 
+var errNoBandits = errors.New("no bandits available")
+
 type Strategy interface {
-	SelectBandit(ctx Context) *Bandit
+	SelectBandit(ctx Context) (*Bandit, error)
 	UpdateReward(ctx Context, b *Bandit, reward float64)
+	Reset()
 }
 
 type EpsilonGreedyStrategy struct {
-	Epsilon float64
+	Epsilon      float64
+	EpsilonDecay float64 // multiplied into Epsilon after every update, 0 disables decay
+	MinEpsilon   float64 // floor for the decayed Epsilon
+
+	// AdaptiveEpsilon, when above 0, scales Epsilon in every context by
+	// AdaptiveEpsilon/(AdaptiveEpsilon+n) with n its number of rewards, so
+	// new contexts explore at Epsilon, a context with AdaptiveEpsilon rewards
+	// at half of it and well known contexts hardly at all. 0 explores every
+	// context at Epsilon.
+	AdaptiveEpsilon int
+
 	Bandits []*Bandit
-	Rewards map[Context][]float64
-	Counts  map[Context][]int
+	Rewards map[Context][]float64 // per context, index aligned with Bandits
+	Counts  map[Context][]int     // per context, index aligned with Bandits
+
+	// LastUpdated is when every context last got a reward, so contexts that
+	// haven't in a while can be dropped with PruneOlderThan.
+	LastUpdated map[Context]time.Time
+
+	// SquaredDeviations sums, per context and index aligned with Bandits,
+	// the squared deviations of the rewards from their mean, see Variance.
+	SquaredDeviations map[Context][]float64
+
+	// HashBuckets, when above 0, hashes contexts into this many buckets before
+	// they are used as keys in Rewards and Counts. Colliding contexts share
+	// their rewards, which bounds memory with many unique users.
+	HashBuckets int
+
+	// IgnoreUser drops the UserID from contexts so the model learns per time
+	// of day, weekday and device across all users.
+	IgnoreUser bool
+
+	// MinSamples is the number of rewards a context needs before its best
+	// bandit is exploited, until then selections always explore.
+	MinSamples int
+
+	// Backoff lists context fields to leave out, one after another, when a
+	// context has no rewards yet. With user_id,device a new user gets the
+	// rewards learned for the time of day, weekday and device, or failing
+	// that for the time of day and weekday.
+	Backoff []string
+
+	// Alpha, when above 0, makes the rewards an exponential moving average
+	// with this learning rate instead of the plain average, so recent rewards
+	// count more as preferences drift.
+	Alpha float64
+
+	// Popularity is the average reward of every bandit over all the training
+	// data, index aligned with Bandits. With UsePopularity it is exploited in
+	// contexts without rewards, instead of exploring them at random.
+	Popularity    []float64
+	UsePopularity bool
+
+	// InitialReward is the reward of every bandit in a context before it has
+	// any rewards. An optimistic value, above the rewards to expect, makes
+	// the strategy try every bandit in a context early on, as each one it
+	// tries drops to its actual reward.
+	InitialReward float64
+
+	// ColdThreshold, when above 0, makes exploration pick among the bandits
+	// with fewer than this many rewards in the context, so it isn't spent on
+	// bandits that are already well known there. If every bandit has as many,
+	// it picks among all of them.
+	ColdThreshold int
+
+	// Smoothing, when above 0, blends the rewards selection exploits in a
+	// context with the average rewards of its neighbors, the contexts that
+	// differ from it in only one field, with this weight. Thin contexts
+	// borrow strength from similar ones this way, at the cost of a scan of
+	// all the contexts on every selection.
+	Smoothing float64
+
+	// MaxContexts, when above 0, caps the number of contexts kept. Updating a
+	// context beyond it forgets the least recently updated one, so the model
+	// stays bounded while serving.
+	MaxContexts int
+
+	// FatiguePenalty, if set, is subtracted from every reward that isn't
+	// positive, e.g. an impression without a click, given how many times the
+	// bandit was already shown in the context. A penalty growing with the
+	// count captures fatigue from showing the same item again and again. It
+	// isn't saved with the model.
+	FatiguePenalty PenaltyFunc `json:"-"`
+
+	// CumulativeRegret sums, over all updates, how much less reward we got
+	// than the best bandit would have given in that context.
+	CumulativeRegret float64
+
+	// metadata is read from and written to the header of the model file
+	metadata ModelMetadata
+
+	// filter, if set, is the item filter given to SetItemFilter
+	filter func(ctx Context, b *Bandit) bool
+
+	// lru orders the contexts for evicting them with MaxContexts, built
+	// from LastUpdated when first needed
+	lru *contextLRU
+
+	mu sync.RWMutex // guards the fields above
+	seededRand
+}
+
+// PenaltyFunc returns the penalty for a reward given how many times the
+// bandit was already shown in the context.
+type PenaltyFunc func(shown int) float64
+
+// LinearFatigue is a PenaltyFunc growing by rate for every time the bandit
+// was already shown.
+func LinearFatigue(rate float64) PenaltyFunc {
+	return func(shown int) float64 {
+		return rate * float64(shown)
+	}
+}
+
+// RewardConfig sets how much a click adds to an item's reward in a context
+// and how much an impression without a click takes away.
+type RewardConfig struct {
+	ClickReward    float64
+	NoClickPenalty float64
+}
+
+var defaultRewardConfig = RewardConfig{ClickReward: 1.0, NoClickPenalty: 0.1}
+
+// RewardFunc computes the reward of a training row, e.g. from dwell time or
+// purchase value.
+type RewardFunc func(row TrainingData) float64
+
+// Func returns the RewardFunc for clicks and non-clicks.
+func (c RewardConfig) Func() RewardFunc {
+	return func(row TrainingData) float64 {
+		if row.HasClick {
+			return c.ClickReward
+		}
+		return -c.NoClickPenalty // a small penalty for not getting a click
+	}
+}
+
+// TrainConfig holds the settings for a training run.
+type TrainConfig struct {
+	Context    ContextOptions
+	Reward     RewardConfig
+	RewardFunc RewardFunc // overrides Reward when set
+	Seed       int64
+	ModelFile  string // where the model is saved, defaults to strategy.gob
+	Strategy   string // kind of strategy to train, see newStrategy, defaults to epsilon
+
+	// Iterations is the number of pulls per context, training on a context
+	// stops early when the best bandit hasn't changed for ConvergenceWindow
+	// pulls (0 never stops early).
+	Iterations        int
+	ConvergenceWindow int
+
+	// ProgressEvery is the number of contexts between progress log lines,
+	// 0 logs about every 10%.
+	ProgressEvery int
+
+	// Workers is the number of contexts trained at once, 0 trains one per
+	// CPU. See trainStrategy.
+	Workers int
+
+	// HashBuckets is copied to the trained strategy, 0 keeps every context.
+	HashBuckets int
+
+	// MinSamples, Backoff, Alpha, InitialReward, ColdThreshold, Smoothing
+	// and AdaptiveEpsilon are copied to the trained strategy.
+	MinSamples      int
+	Backoff         []string
+	Alpha           float64
+	InitialReward   float64
+	ColdThreshold   int
+	Smoothing       float64
+	AdaptiveEpsilon int
+
+	// MaxContexts, when above 0, is set on the trained strategy, which
+	// keeps only this many of the most recently trained contexts.
+	MaxContexts int
+
+	// UsePopularity makes the trained strategy exploit the popularity of
+	// the bandits over all the training data in contexts without rewards.
+	UsePopularity bool
+
+	// FatiguePenalty is set on the strategy while training, nil disables it.
+	FatiguePenalty PenaltyFunc
+
+	// NormalizeRewards, unless empty, brings the rewards of the contexts into
+	// [0, 1] before training, see normalizeRewards.
+	NormalizeRewards string
+
+	// TestFraction of the rows are held out from training and used to
+	// evaluate the model afterwards.
+	TestFraction float64
+}
+
+const defaultModelFile = "strategy.gob"
+
+func (c TrainConfig) modelFile() string {
+	if c.ModelFile == "" {
+		return defaultModelFile
+	}
+	return c.ModelFile
+}
+
+func (c TrainConfig) workers() int {
+	if c.Workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return c.Workers
+}
+
+func (c TrainConfig) strategy() string {
+	if c.Strategy == "" {
+		return defaultStrategy
+	}
+	return c.Strategy
+}
+
+// Ways to bring the rewards into [0, 1] for TrainConfig.NormalizeRewards.
+const (
+	normalizeClamp  = "clamp"  // rewards outside [0, 1] are clamped to it
+	normalizeMinMax = "minmax" // rewards are rescaled from their range to [0, 1]
+)
+
+// normalizeRewards brings the rewards of the bandits into [0, 1] the given
+// way, so strategies that expect such rewards, like Thompson sampling, can be
+// trained with click rewards and no-click penalties. Min-max counts 0, the
+// reward of contexts a bandit has none in, in the range.
+func normalizeRewards(bandits []*Bandit, how string) error {
+	switch how {
+	case "":
+		return nil
+	case normalizeClamp:
+		for _, b := range bandits {
+			for ctx, r := range b.ContextRewards {
+				b.ContextRewards[ctx] = clampReward(r)
+			}
+		}
+		return nil
+	case normalizeMinMax:
+		lo, hi := 0.0, 0.0
+		for _, b := range bandits {
+			for _, r := range b.ContextRewards {
+				lo, hi = min(lo, r), max(hi, r)
+			}
+		}
+		if hi == lo {
+			return nil
+		}
+		for _, b := range bandits {
+			for ctx, r := range b.ContextRewards {
+				b.ContextRewards[ctx] = (r - lo) / (hi - lo)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown reward normalization %q, must be %s or %s", how, normalizeClamp, normalizeMinMax)
+}
+
+// clampReward clamps a reward to [0, 1].
+func clampReward(r float64) float64 {
+	return min(max(r, 0), 1)
+}
+
+func (c TrainConfig) rewardFunc() RewardFunc {
+	if c.RewardFunc != nil {
+		return c.RewardFunc
+	}
+	return c.Reward.Func()
 }
 
 type TrainingData struct {
@@ -52,61 +336,898 @@ type TrainingData struct {
 	ItemID    string                `bigquery:"item_id"`
 	Timestamp bigquery.NullDateTime `bigquery:"impression_time"`
 	HasClick  bool                  `bigquery:"was_clicked"`
-	Device    string                `bigquery:"device"`
+	Device    bigquery.NullString   `bigquery:"device"`
+
+	// Weight scales the reward of the row, e.g. to correct for the position
+	// the item was shown at. Rows without one count once.
+	Weight bigquery.NullFloat64 `bigquery:"weight"`
+}
+
+// weightedReward returns the reward of the row scaled by its Weight.
+func (row TrainingData) weightedReward(reward RewardFunc) float64 {
+	if row.Weight.Valid {
+		return reward(row) * row.Weight.Float64
+	}
+	return reward(row)
+}
+
+// validWeight reports whether w can be the Weight of a reward, a number not
+// below 0.
+func validWeight(w float64) bool {
+	return w >= 0 && !math.IsInf(w, 0)
 }
 
-func (s *EpsilonGreedyStrategy) SelectBandit(ctx Context) *Bandit {
-	if rand.Float64() < s.Epsilon || len(s.Rewards[ctx]) == 0 {
+func (s *EpsilonGreedyStrategy) SelectBandit(ctx Context) (*Bandit, error) {
+	b, _, err := s.SelectBanditWithInfo(ctx)
+	return b, err
+}
+
+// SelectBanditWithInfo is SelectBandit that also reports whether the
+// selection explored (true) or exploited the best known bandit (false).
+func (s *EpsilonGreedyStrategy) SelectBanditWithInfo(ctx Context) (*Bandit, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.selectBandit(ctx)
+}
+
+// SelectBatch selects a bandit for every context, in order, taking the lock
+// once for all of them. Like SelectBanditWithInfo it also reports whether
+// every selection explored.
+func (s *EpsilonGreedyStrategy) SelectBatch(ctxs []Context) ([]*Bandit, []bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bandits := make([]*Bandit, len(ctxs))
+	explored := make([]bool, len(ctxs))
+	for i, ctx := range ctxs {
+		b, e, err := s.selectBandit(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		bandits[i], explored[i] = b, e
+	}
+	return bandits, explored, nil
+}
+
+// selectBandit does the work of SelectBanditWithInfo, call with the lock held.
+func (s *EpsilonGreedyStrategy) selectBandit(ctx Context) (*Bandit, bool, error) {
+	if len(s.Bandits) == 0 {
+		return nil, false, errNoBandits
+	}
+
+	key := s.key(ctx)
+	err := s.checkAligned(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	rewards, mustExplore := s.selectionRewards(ctx)
+
+	candidates := s.candidates(ctx)
+	if len(candidates) == 0 {
+		return nil, false, errNoBandits
+	}
+
+	rng := s.random()
+	if rng.Float64() < s.contextEpsilon(key) || mustExplore {
 		// Explore
-		return s.Bandits[rand.Intn(len(s.Bandits))]
+		explore := s.coldCandidates(key, candidates)
+		return s.Bandits[explore[rng.Intn(len(explore))]], true, nil
+	}
+
+	// Exploit, picking at random among tied bandits so e.g. a context where
+	// every reward is still 0 doesn't always get the first bandit
+	candidateRewards := make([]float64, len(candidates))
+	for i, c := range candidates {
+		candidateRewards[i] = rewards[c]
+	}
+	return s.Bandits[candidates[argmaxRandom(candidateRewards, rng)]], false, nil
+}
+
+// contextEpsilon returns the share of the selections in the context that
+// explore, see AdaptiveEpsilon. Call with the lock held.
+func (s *EpsilonGreedyStrategy) contextEpsilon(key Context) float64 {
+	if s.AdaptiveEpsilon <= 0 {
+		return s.Epsilon
 	}
+	n := sum(s.Counts[key])
+	return s.Epsilon * float64(s.AdaptiveEpsilon) / float64(s.AdaptiveEpsilon+n)
+}
+
+// coldCandidates returns the candidates with fewer than ColdThreshold rewards
+// in the context, or all of them if there are none or no ColdThreshold. Call
+// with the lock held.
+func (s *EpsilonGreedyStrategy) coldCandidates(key Context, candidates []int) []int {
+	counts := s.Counts[key]
+	if s.ColdThreshold <= 0 || len(counts) != len(s.Bandits) {
+		return candidates
+	}
+	cold := make([]int, 0, len(candidates))
+	for _, c := range candidates {
+		if counts[c] < s.ColdThreshold {
+			cold = append(cold, c)
+		}
+	}
+	if len(cold) == 0 {
+		return candidates
+	}
+	return cold
+}
 
-	// Exploit
-	maxReward := s.Rewards[ctx][0]
+// selectionRewards returns the rewards selection exploits in the context:
+// its own, smoothed with Smoothing, those it backs off to when it has none,
+// or failing that the Popularity with UsePopularity. It also reports whether
+// there are too few rewards to exploit. Call with the lock held.
+func (s *EpsilonGreedyStrategy) selectionRewards(ctx Context) ([]float64, bool) {
+	key := s.key(ctx)
+	rewards, counts := s.Rewards[key], s.Counts[key]
+	if sum(counts) == 0 {
+		rewards, counts = s.backoff(ctx)
+	} else {
+		rewards = s.smooth(key, rewards)
+	}
+	if sum(counts) == 0 && s.UsePopularity && len(s.Popularity) == len(s.Bandits) {
+		return s.Popularity, false
+	}
+	return rewards, len(rewards) == 0 || sum(counts) < s.MinSamples
+}
+
+// AlwaysExplores reports whether selection in the context explores every
+// time, because it has too few rewards to exploit.
+func (s *EpsilonGreedyStrategy) AlwaysExplores(ctx Context) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, mustExplore := s.selectionRewards(ctx)
+	return mustExplore
+}
+
+// SetItemFilter makes selection only pick the bandits the filter allows in a
+// context, e.g. to keep some items from being shown in the morning. Selection
+// fails with errNoBandits in a context where the filter allows none. A nil
+// filter allows every bandit.
+func (s *EpsilonGreedyStrategy) SetItemFilter(filter func(ctx Context, b *Bandit) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.filter = filter
+}
+
+// candidates returns the indexes of the bandits the item filter allows in the
+// context, call with the lock held.
+func (s *EpsilonGreedyStrategy) candidates(ctx Context) []int {
+	candidates := make([]int, 0, len(s.Bandits))
+	for i, b := range s.Bandits {
+		if s.filter == nil || s.filter(ctx, b) {
+			candidates = append(candidates, i)
+		}
+	}
+	return candidates
+}
+
+func sum(counts []int) int {
+	n := 0
+	for _, count := range counts {
+		n += count
+	}
+	return n
+}
+
+// argmax returns the index of the highest reward, the first one on ties.
+func argmax(rewards []float64) int {
+	maxReward := rewards[0]
 	maxIndex := 0
-	for i, reward := range s.Rewards[ctx] {
+	for i, reward := range rewards {
 		if reward > maxReward {
 			maxReward = reward
 			maxIndex = i
 		}
 	}
 
-	return s.Bandits[maxIndex]
+	return maxIndex
+}
+
+// argmaxTies returns the indexes of the highest reward, more than one on
+// ties, which selection picks between at random, see argmaxRandom.
+func argmaxTies(rewards []float64) []int {
+	best := argmax(rewards)
+	ties := []int{best}
+	for i := best + 1; i < len(rewards); i++ {
+		if rewards[i] == rewards[best] {
+			ties = append(ties, i)
+		}
+	}
+	return ties
+}
+
+// argmaxRandom returns the index of the highest reward, picked uniformly at
+// random on ties.
+func argmaxRandom(rewards []float64, rng *rand.Rand) int {
+	maxIndex := 0
+	ties := 1
+	for i := 1; i < len(rewards); i++ {
+		switch {
+		case rewards[i] > rewards[maxIndex]:
+			maxIndex, ties = i, 1
+		case rewards[i] == rewards[maxIndex]:
+			// reservoir sampling keeps each tied index with probability 1/ties
+			ties++
+			if rng.Intn(ties) == 0 {
+				maxIndex = i
+			}
+		}
+	}
+	return maxIndex
+}
+
+// SelectTopK returns the k bandits with the highest reward for the context,
+// best first. Ties are broken by ItemID so the result is reproducible.
+func (s *EpsilonGreedyStrategy) SelectTopK(ctx Context, k int) []*Bandit {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rewards := s.Rewards[s.key(ctx)]
+	reward := func(i int) float64 {
+		if i < len(rewards) {
+			return rewards[i]
+		}
+		return 0.0
+	}
+
+	indices := make([]int, len(s.Bandits))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.Slice(indices, func(a, b int) bool {
+		ra, rb := reward(indices[a]), reward(indices[b])
+		if ra != rb {
+			return ra > rb
+		}
+		return s.Bandits[indices[a]].ItemID < s.Bandits[indices[b]].ItemID
+	})
+
+	if k > len(indices) {
+		k = len(indices)
+	}
+	if k < 0 {
+		k = 0
+	}
+	top := make([]*Bandit, k)
+	for i := range top {
+		top[i] = s.Bandits[indices[i]]
+	}
+
+	return top
+}
+
+// ScoreContext returns a score for every item in the context, the softmax of
+// their rewards, for ranking or blending with other systems. The scores sum
+// to 1 and are uniform for a context without rewards.
+func (s *EpsilonGreedyStrategy) ScoreContext(ctx Context) map[string]float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	scores := make(map[string]float64, len(s.Bandits))
+	if len(s.Bandits) == 0 {
+		return scores
+	}
+
+	key := s.key(ctx)
+	rewards, counts := s.Rewards[key], s.Counts[key]
+	if sum(counts) == 0 {
+		rewards, _ = s.backoff(ctx)
+	}
+	if len(rewards) != len(s.Bandits) {
+		for _, b := range s.Bandits {
+			scores[b.ItemID] = 1 / float64(len(s.Bandits))
+		}
+		return scores
+	}
+
+	for i, p := range softmax(rewards, 1.0) {
+		scores[s.Bandits[i].ItemID] = p
+	}
+	return scores
+}
+
+// BestReward returns the highest reward of any bandit in the context, backing
+// off like selection does when the context has no rewards. It returns false
+// if there are no rewards to go by.
+func (s *EpsilonGreedyStrategy) BestReward(ctx Context) (float64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := s.key(ctx)
+	if s.checkAligned(key) != nil {
+		return 0, false
+	}
+	rewards, counts := s.Rewards[key], s.Counts[key]
+	if sum(counts) == 0 {
+		rewards, counts = s.backoff(ctx)
+	}
+	if len(rewards) == 0 || sum(counts) == 0 {
+		return 0, false
+	}
+	return slices.Max(rewards), true
+}
+
+// lowConfidenceSamples is the number of rewards below which an item's
+// estimated reward is considered too uncertain to rely on.
+const lowConfidenceSamples = 10
+
+// Confidence returns the estimated reward of the item in the context and the
+// number of rewards it is based on, 0 for an item or context without any.
+func (s *EpsilonGreedyStrategy) Confidence(ctx Context, itemID string) (mean float64, n int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := s.key(ctx)
+	if s.checkAligned(key) != nil {
+		return 0, 0
+	}
+	rewards, counts := s.Rewards[key], s.Counts[key]
+	for i, b := range s.Bandits {
+		if b.ItemID == itemID && i < len(rewards) {
+			return rewards[i], counts[i]
+		}
+	}
+	return 0, 0
+}
+
+// Variance returns the sample variance of the rewards of the item in the
+// context and the number of rewards it is based on, so items with the same
+// mean but a different spread can be told apart. It is 0 with fewer than two
+// rewards. With Alpha it is an exponentially weighted variance around the
+// moving average, so recent rewards count more.
+func (s *EpsilonGreedyStrategy) Variance(ctx Context, itemID string) (variance float64, n int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := s.key(ctx)
+	if s.checkAligned(key) != nil {
+		return 0, 0
+	}
+	deviations, counts := s.SquaredDeviations[key], s.Counts[key]
+	for i, b := range s.Bandits {
+		if b.ItemID != itemID || i >= len(counts) {
+			continue
+		}
+		if len(deviations) != len(s.Bandits) || counts[i] < 2 {
+			return 0, counts[i]
+		}
+		if s.Alpha > 0 {
+			return deviations[i], counts[i]
+		}
+		return deviations[i] / float64(counts[i]-1), counts[i]
+	}
+	return 0, 0
+}
+
+// squaredDeviation returns the SquaredDeviations of the bandit i in the
+// context, 0 if there are none. Call with the lock held.
+func (s *EpsilonGreedyStrategy) squaredDeviation(key Context, i int) float64 {
+	if deviations := s.SquaredDeviations[key]; i < len(deviations) {
+		return deviations[i]
+	}
+	return 0
+}
+
+// updateDeviations adds the reward r of the bandit i in the context to its
+// SquaredDeviations with Welford's algorithm, given the mean and count of its
+// rewards before r. Call with the lock held.
+func (s *EpsilonGreedyStrategy) updateDeviations(key Context, i int, r float64, mean float64, n int) {
+	if s.SquaredDeviations == nil {
+		s.SquaredDeviations = make(map[Context][]float64)
+	}
+	if len(s.SquaredDeviations[key]) != len(s.Bandits) {
+		// a context from before the deviations were kept starts over
+		s.SquaredDeviations[key] = make([]float64, len(s.Bandits))
+	}
+	if n == 0 {
+		return // the mean before the first reward is only the InitialReward
+	}
+
+	d := r - mean
+	if s.Alpha > 0 {
+		s.SquaredDeviations[key][i] = (1 - s.Alpha) * (s.SquaredDeviations[key][i] + s.Alpha*d*d)
+		return
+	}
+	s.SquaredDeviations[key][i] += d * (r - s.Rewards[key][i])
+}
+
+// LowConfidence reports whether an estimate based on n rewards is too
+// uncertain to rely on.
+func LowConfidence(n int) bool {
+	return n < lowConfidenceSamples
 }
 
 func (s *EpsilonGreedyStrategy) UpdateReward(ctx Context, b *Bandit, reward float64) {
+	if b == nil {
+		slog.Warn("Skipping reward update without an item", "reward", reward)
+		return
+	}
+	if math.IsNaN(reward) || math.IsInf(reward, 0) {
+		// averaged in, it would stick to the bandit for good
+		slog.Warn("Skipping reward update with a reward that isn't a number", "reward", reward, "item", b.ItemID)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := s.key(ctx)
+	if _, ok := s.Rewards[key]; !ok {
+		// first feedback for a context that wasn't in the training data
+		s.initContext(key)
+	}
+	err := s.checkAligned(key)
+	if err != nil {
+		slog.Warn("Skipping reward update", "err", err)
+		return
+	}
+	if s.LastUpdated == nil {
+		s.LastUpdated = make(map[Context]time.Time)
+	}
+	s.LastUpdated[key] = time.Now().UTC()
+	s.touchContext(key)
+
+	bestReward := math.Inf(-1)
 	for i := range s.Bandits {
 		if s.Bandits[i] == b {
-			// calculate running average of the reward
-			s.Counts[ctx][i]++
-			s.Rewards[ctx][i] = ((s.Rewards[ctx][i] * float64(s.Counts[ctx][i]-1)) + reward) / float64(s.Counts[ctx][i])
+			r := reward
+			if s.FatiguePenalty != nil && r <= 0 {
+				r -= s.FatiguePenalty(s.Counts[key][i])
+			}
+			mean, n := s.Rewards[key][i], s.Counts[key][i]
+			if s.Alpha > 0 {
+				updateMovingAverage(s.Rewards[key], s.Counts[key], i, r, s.Alpha)
+			} else {
+				updateAverage(s.Rewards[key], s.Counts[key], i, r)
+			}
+			s.updateDeviations(key, i, r, mean, n)
+		}
+		bestReward = math.Max(bestReward, s.Bandits[i].Pull(ctx))
+	}
+	s.CumulativeRegret += bestReward - reward
+	s.decayEpsilon()
+}
+
+// Regret returns the cumulative regret over all updates so far.
+func (s *EpsilonGreedyStrategy) Regret() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.CumulativeRegret
+}
+
+// key returns the key of the context in Rewards and Counts.
+func (s *EpsilonGreedyStrategy) key(ctx Context) Context {
+	if s.IgnoreUser {
+		ctx.UserID = ""
+	}
+	if s.HashBuckets > 0 {
+		return hashContext(ctx, s.HashBuckets)
+	}
+	return ctx
+}
+
+// checkAligned verifies that the rewards and counts of a context line up with
+// Bandits, since the exploit step maps a reward index straight to a bandit.
+// Contexts without data are fine.
+func (s *EpsilonGreedyStrategy) checkAligned(ctx Context) error {
+	rewards, hasRewards := s.Rewards[ctx]
+	counts, hasCounts := s.Counts[ctx]
+	if !hasRewards && !hasCounts {
+		return nil
+	}
+	if len(rewards) != len(s.Bandits) || len(counts) != len(s.Bandits) {
+		return fmt.Errorf("context %+v has %d rewards and %d counts for %d bandits",
+			ctx, len(rewards), len(counts), len(s.Bandits))
+	}
+	return nil
+}
+
+// FindBandit returns the bandit for the item, or nil if there is none.
+func (s *EpsilonGreedyStrategy) FindBandit(itemID string) *Bandit {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, b := range s.Bandits {
+		if b.ItemID == itemID {
+			return b
 		}
 	}
+	return nil
+}
+
+// NumBandits returns the number of items to choose from.
+func (s *EpsilonGreedyStrategy) NumBandits() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.Bandits)
+}
+
+// AddBandit adds a new item to choose from, with no rewards in any context yet.
+func (s *EpsilonGreedyStrategy) AddBandit(b *Bandit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addBandit(b)
+}
+
+func (s *EpsilonGreedyStrategy) addBandit(b *Bandit) {
+	s.Bandits = append(s.Bandits, b)
+	for ctx := range s.Rewards {
+		s.Rewards[ctx] = append(s.Rewards[ctx], s.InitialReward)
+		s.Counts[ctx] = append(s.Counts[ctx], 0)
+	}
+	for ctx := range s.SquaredDeviations {
+		s.SquaredDeviations[ctx] = append(s.SquaredDeviations[ctx], 0)
+	}
+	if len(s.Popularity) > 0 {
+		s.Popularity = append(s.Popularity, 0)
+	}
+}
+
+// initContext starts the rewards of every bandit in the context at
+// InitialReward, call with the lock held.
+func (s *EpsilonGreedyStrategy) initContext(key Context) {
+	rewards := make([]float64, len(s.Bandits))
+	for i := range rewards {
+		rewards[i] = s.InitialReward
+	}
+	s.Rewards[key] = rewards
+	s.Counts[key] = make([]int, len(s.Bandits))
+}
+
+// UpdateFromRow learns from a single training row as it arrives, e.g. from a
+// stream of impressions. Items that haven't been seen before are added as new
+// bandits. It returns false if the row was skipped.
+func (s *EpsilonGreedyStrategy) UpdateFromRow(row TrainingData, opts ContextOptions, reward RewardFunc) bool {
+	ctx, ok := opts.contextFromRow(row)
+	if !ok {
+		return false
+	}
+	r := row.weightedReward(reward)
+
+	s.mu.Lock()
+	var bandit *Bandit
+	for _, b := range s.Bandits {
+		if b.ItemID == row.ItemID {
+			bandit = b
+			break
+		}
+	}
+	if bandit == nil {
+		bandit = &Bandit{ItemID: row.ItemID, ContextRewards: make(map[Context]float64)}
+		s.addBandit(bandit)
+	}
+	bandit.ContextRewards[ctx] += r // same as buildBandits, so Pull sees the row
+	s.mu.Unlock()
+
+	s.UpdateReward(ctx, bandit, r)
+	return true
+}
+
+// RemoveBandit removes the item from the bandits and from the rewards and
+// counts of every context, keeping them aligned with Bandits.
+func (s *EpsilonGreedyStrategy) RemoveBandit(itemID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, b := range s.Bandits {
+		if b.ItemID != itemID {
+			continue
+		}
+		s.Bandits = append(s.Bandits[:i:i], s.Bandits[i+1:]...)
+		for ctx := range s.Rewards {
+			s.Rewards[ctx] = append(s.Rewards[ctx][:i:i], s.Rewards[ctx][i+1:]...)
+			s.Counts[ctx] = append(s.Counts[ctx][:i:i], s.Counts[ctx][i+1:]...)
+		}
+		for ctx, deviations := range s.SquaredDeviations {
+			if i < len(deviations) {
+				s.SquaredDeviations[ctx] = append(deviations[:i:i], deviations[i+1:]...)
+			}
+		}
+		if i < len(s.Popularity) {
+			s.Popularity = append(s.Popularity[:i:i], s.Popularity[i+1:]...)
+		}
+		return
+	}
+}
+
+// seededRand is the random number generator of a strategy, which the
+// strategies embed so -seed makes their selections reproducible. Being
+// unexported, it isn't saved with the model.
+type seededRand struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// seeder is a strategy with a seededRand.
+type seeder interface {
+	Seed(seed int64)
+}
+
+// Seed makes the selections reproducible. A seed of 0 seeds from the clock.
+func (r *seededRand) Seed(seed int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rng = newRand(seed)
+}
+
+// random returns the strategy's random number generator, which is safe for
+// concurrent use. It is seeded from the clock unless Seed was called.
+func (r *seededRand) random() *rand.Rand {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.rng == nil {
+		r.rng = newRand(0)
+	}
+	return r.rng
+}
+
+func newRand(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(&lockedSource{src: rand.NewSource(seed)})
+}
+
+// lockedSource makes a rand.Source safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (r *lockedSource) Int63() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.src.Int63()
+}
+
+func (r *lockedSource) Seed(seed int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.src.Seed(seed)
+}
+
+// Reset forgets everything learned while keeping the bandits and Epsilon.
+func (s *EpsilonGreedyStrategy) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Rewards = make(map[Context][]float64)
+	s.Counts = make(map[Context][]int)
+	s.LastUpdated = nil
+	s.SquaredDeviations = nil
+	s.CumulativeRegret = 0
+	s.lru = nil
+}
+
+// Clone returns a deep copy of the strategy, so experiments on the clone
+// leave the original untouched. The clone gets its own random number
+// generator, seeded from the clock.
+func (s *EpsilonGreedyStrategy) Clone() *EpsilonGreedyStrategy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.clone()
+}
+
+// clone is Clone. Call with the lock held.
+func (s *EpsilonGreedyStrategy) clone() *EpsilonGreedyStrategy {
+	clone := &EpsilonGreedyStrategy{
+		Epsilon:          s.Epsilon,
+		EpsilonDecay:     s.EpsilonDecay,
+		MinEpsilon:       s.MinEpsilon,
+		AdaptiveEpsilon:  s.AdaptiveEpsilon,
+		Bandits:          make([]*Bandit, len(s.Bandits)),
+		Rewards:          make(map[Context][]float64, len(s.Rewards)),
+		Counts:           make(map[Context][]int, len(s.Counts)),
+		LastUpdated:      maps.Clone(s.LastUpdated),
+		HashBuckets:      s.HashBuckets,
+		IgnoreUser:       s.IgnoreUser,
+		MinSamples:       s.MinSamples,
+		Backoff:          slices.Clone(s.Backoff),
+		Alpha:            s.Alpha,
+		Popularity:       slices.Clone(s.Popularity),
+		UsePopularity:    s.UsePopularity,
+		InitialReward:    s.InitialReward,
+		ColdThreshold:    s.ColdThreshold,
+		Smoothing:        s.Smoothing,
+		MaxContexts:      s.MaxContexts,
+		FatiguePenalty:   s.FatiguePenalty,
+		CumulativeRegret: s.CumulativeRegret,
+		metadata:         s.metadata,
+		filter:           s.filter,
+	}
+	for i, b := range s.Bandits {
+		clone.Bandits[i] = &Bandit{ItemID: b.ItemID, ContextRewards: maps.Clone(b.ContextRewards)}
+	}
+	for ctx, rewards := range s.Rewards {
+		clone.Rewards[ctx] = slices.Clone(rewards)
+	}
+	for ctx, counts := range s.Counts {
+		clone.Counts[ctx] = slices.Clone(counts)
+	}
+	if s.SquaredDeviations != nil {
+		clone.SquaredDeviations = make(map[Context][]float64, len(s.SquaredDeviations))
+		for ctx, deviations := range s.SquaredDeviations {
+			clone.SquaredDeviations[ctx] = slices.Clone(deviations)
+		}
+	}
+
+	return clone
+}
+
+// decayEpsilon lowers the exploration rate one step, exploiting more as the
+// model learns. Epsilon is stored on the strategy so the decay survives a
+// save and load.
+func (s *EpsilonGreedyStrategy) decayEpsilon() {
+	if s.EpsilonDecay <= 0 {
+		return
+	}
+	s.Epsilon = math.Max(s.Epsilon*s.EpsilonDecay, s.MinEpsilon)
+}
+
+// Encode writes the strategy as gob to w.
+func (s *EpsilonGreedyStrategy) Encode(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return gob.NewEncoder(w).Encode(s)
+}
+
+// Decode reads a strategy written by Encode, gzipped or not.
+func (s *EpsilonGreedyStrategy) Decode(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lru = nil // rebuilt from the decoded LastUpdated
+	return decodeGob(r, s)
 }
 
 func (s *EpsilonGreedyStrategy) SaveState(filename string) error {
-	file, err := os.Create(filename)
+	return saveModel(filename, s, s.Metadata())
+}
+
+// SaveStateCompressed is like SaveState but gzips the file. LoadState
+// detects and reads both formats.
+func (s *EpsilonGreedyStrategy) SaveStateCompressed(filename string) error {
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		err := writeModelHeader(w, s, s.Metadata())
+		if err != nil {
+			return err
+		}
+		return encodeCompressed(w, s.Encode)
+	})
+}
+
+func (s *EpsilonGreedyStrategy) LoadState(filename string) error {
+	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	encoder := gob.NewEncoder(file)
-	err = encoder.Encode(s)
+
+	r := bufio.NewReader(file)
+	meta, err := checkModelHeader(r, s)
+	if err != nil {
+		return err
+	}
+	err = s.Decode(r)
 	if err != nil {
 		return err
 	}
 
+	s.mu.Lock()
+	s.metadata = meta
+	s.mu.Unlock()
 	return nil
 }
 
-func (s *EpsilonGreedyStrategy) LoadState(filename string) error {
+// Metadata returns how the model was trained, as recorded in the model file.
+func (s *EpsilonGreedyStrategy) Metadata() ModelMetadata {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.metadata
+}
+
+// LoadStateCompressed is the same as LoadState, which handles both formats.
+func (s *EpsilonGreedyStrategy) LoadStateCompressed(filename string) error {
+	return s.LoadState(filename)
+}
+
+// updateAverage adds reward to the running average of arm i.
+func updateAverage(rewards []float64, counts []int, i int, reward float64) {
+	counts[i]++
+	rewards[i] = ((rewards[i] * float64(counts[i]-1)) + reward) / float64(counts[i])
+}
+
+// updateMovingAverage is updateAverage with an exponential moving average.
+func updateMovingAverage(rewards []float64, counts []int, i int, reward float64, alpha float64) {
+	counts[i]++
+	rewards[i] = (1-alpha)*rewards[i] + alpha*reward
+}
+
+// encodeCompressed gzips everything encode writes to w.
+func encodeCompressed(w io.Writer, encode func(w io.Writer) error) error {
+	zw := gzip.NewWriter(w)
+	err := encode(zw)
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeFileAtomic writes to a temporary file next to filename and renames it
+// over filename once everything is written, so a crash or a failed write
+// never leaves a truncated file behind.
+func writeFileAtomic(filename string, write func(w io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // no-op once renamed
+
+	// CreateTemp makes the file private, keep the permissions os.Create gave
+	err = file.Chmod(0644)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = write(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filename)
+}
+
+func loadGob(filename string, s Strategy) error {
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	decoder := gob.NewDecoder(file)
-	err = decoder.Decode(s)
+
+	r := bufio.NewReader(file)
+	_, err = checkModelHeader(r, s)
+	if err != nil {
+		return err
+	}
+	return decodeGob(r, s)
+}
+
+// decodeGob reads a gob value from r, gunzipping it first if it starts with
+// the gzip magic bytes.
+func decodeGob(r io.Reader, v interface{}) error {
+	br := bufio.NewReader(r)
+	r = br
+	magic, _ := br.Peek(2)
+	if bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	decoder := gob.NewDecoder(r)
+	err := decoder.Decode(v)
 	if err != nil {
 		return err
 	}
@@ -114,86 +1235,353 @@ func (s *EpsilonGreedyStrategy) LoadState(filename string) error {
 	return nil
 }
 
-func trainModel() {
-	contexts, bandits := getTrainingData()
+var gzipMagic = []byte{0x1f, 0x8b}
 
-	strategy := &EpsilonGreedyStrategy{
-		Epsilon: 0.1, // fraction of exploration 0.1 = 10% exploration
-		Bandits: bandits,
-		Rewards: make(map[Context][]float64),
-		Counts:  make(map[Context][]int),
+func trainModel(source DataSource, cfg TrainConfig) error {
+	rows, err := source.Fetch(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to fetch training data: %w", err)
 	}
+	slog.Info("Fetched training data", "rows", len(rows))
 
-	log.Print("Training...")
+	var testRows []TrainingData
+	if cfg.TestFraction > 0 {
+		rows, testRows = splitTrainTest(rows, cfg.TestFraction, newRand(cfg.Seed))
+		slog.Info("Holding out rows for testing", "rows", len(testRows))
+	}
 
-	// Train the model
-	for _, ctx := range contexts {
-		strategy.Rewards[ctx] = make([]float64, len(bandits))
-		strategy.Counts[ctx] = make([]int, len(bandits)) // initialize counts to zero
-		for i := 0; i < 10000; i++ {
-			bandit := strategy.SelectBandit(ctx)
-			reward := bandit.Pull(ctx)
-			strategy.UpdateReward(ctx, bandit, reward)
+	contexts, bandits := buildBandits(rows, cfg.Context, cfg.rewardFunc())
+	slog.Info("Built bandits to choose from", "bandits", len(bandits), "contexts", len(contexts))
+	err = normalizeRewards(bandits, cfg.NormalizeRewards)
+	if err != nil {
+		return err
+	}
+
+	s, err := newStrategy(cfg.strategy(), bandits)
+	if err != nil {
+		return err
+	}
+	meta := ModelMetadata{
+		TrainedAt: time.Now().UTC(),
+		Rows:      len(rows),
+		Bandits:   len(bandits),
+		Source:    describeSource(source),
+		Version:   versionString(),
+	}
+
+	// The epsilon-greedy strategy has options of its own and keeps track of
+	// the regret
+	strategy, _ := s.(*EpsilonGreedyStrategy)
+	if strategy != nil {
+		strategy.HashBuckets = cfg.HashBuckets
+		strategy.IgnoreUser = cfg.Context.IgnoreUser
+		strategy.MinSamples = cfg.MinSamples
+		strategy.Backoff = cfg.Backoff
+		strategy.Alpha = cfg.Alpha
+		strategy.InitialReward = cfg.InitialReward
+		strategy.ColdThreshold = cfg.ColdThreshold
+		strategy.Smoothing = cfg.Smoothing
+		strategy.AdaptiveEpsilon = cfg.AdaptiveEpsilon
+		strategy.Popularity = popularity(rows, bandits, cfg.Context, cfg.rewardFunc())
+		strategy.UsePopularity = cfg.UsePopularity
+		strategy.FatiguePenalty = cfg.FatiguePenalty
+		meta.Epsilon = strategy.Epsilon
+	}
+	if seeded, ok := s.(seeder); ok {
+		seeded.Seed(cfg.Seed)
+	}
+
+	err = TrainStrategy(s, contexts, cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(testRows) > 0 {
+		result, err := Evaluate(s, testRows, cfg.Context, cfg.rewardFunc())
+		if err != nil {
+			return fmt.Errorf("failed to evaluate the model: %w", err)
 		}
+		slog.Info("Evaluated on the test set", "rows", result.Rows, "matches", result.Matches,
+			"ctr", result.CTR, "avg_reward", result.AverageReward)
 	}
 
 	// Save the state
-	filename := "strategy.gob"
-	log.Printf("Saving modeld as %s", filename)
-	err := strategy.SaveState(filename)
+	slog.Info("Saving model", "file", cfg.modelFile())
+	return saveModel(cfg.modelFile(), s, meta)
+}
+
+// Train trains an epsilon-greedy strategy with the given epsilon by pulling
+// the bandits iterations times in every context, with TrainStrategy like
+// trainModel. It does no I/O, so the learning loop can be benchmarked on its
+// own.
+func Train(contexts []Context, bandits []*Bandit, iterations int, epsilon float64) (*EpsilonGreedyStrategy, error) {
+	s := strategies["epsilon"](bandits).(*EpsilonGreedyStrategy)
+	s.Epsilon = epsilon
+	err := TrainStrategy(s, contexts, TrainConfig{Iterations: iterations, Workers: 1})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return s, nil
 }
 
-func loadModelAndSelectAnItem(userId *string, timeOfDay *string, weekday *string, device *string) {
+// TrainStrategy trains the strategy on the contexts with the iterations,
+// convergence window, progress logging and workers of the config, see
+// trainStrategy, and then keeps at most MaxContexts contexts of an
+// epsilon-greedy strategy.
+func TrainStrategy(s Strategy, contexts []Context, cfg TrainConfig) error {
+	slog.Info("Training...", "strategy", cfg.strategy(), "contexts", len(contexts), "iterations", cfg.Iterations)
 
-	strategy := &EpsilonGreedyStrategy{
-		Epsilon: 0.1,
-		Bandits: nil,
-		Rewards: make(map[Context][]float64),
-		Counts:  make(map[Context][]int),
+	err := trainStrategy(s, contexts, cfg.Iterations, cfg.ConvergenceWindow, cfg.ProgressEvery, cfg.workers())
+	if err != nil {
+		return err
 	}
-	log.Print("Loading model")
-	filename := "strategy.gob"
-	strategy.LoadState(filename)
 
-	log.Print("Selecting an item to recommend")
-	// define your context
-	ctx := Context{UserID: *userId, TimeOfDay: *timeOfDay, Weekday: *weekday, Device: *device}
-	// strategy selects a bandit based on the context
-	bandit := strategy.SelectBandit(ctx)
+	strategy, _ := s.(*EpsilonGreedyStrategy)
+	if strategy != nil {
+		slog.Info("Training done", "regret", strategy.Regret())
+	} else {
+		slog.Info("Training done")
+	}
 
-	log.Printf("Recommend item: %s\n", bandit.ItemID)
+	// Evicting while training could take a context from under a worker still
+	// training it, so the cap only applies from here on
+	if strategy != nil && cfg.MaxContexts > 0 {
+		evicted := strategy.LimitContexts(cfg.MaxContexts)
+		slog.Info("Evicted the least recently trained contexts", "evicted", evicted, "max_contexts", cfg.MaxContexts)
+	}
+	return nil
 }
 
-func getTrainingData() ([]Context, []*Bandit) {
-	ctx := context.Background()
+// trainStrategy pulls the bandits the strategy selects iterations times in
+// every context, logging the progress every progressEvery contexts, or about
+// every 10% if it is 0. An epsilon-greedy strategy stops early in a context
+// once its best bandit hasn't changed for convergenceWindow iterations, 0
+// never stops early.
+//
+// An epsilon-greedy strategy is trained by this many workers at once, each
+// taking the contexts of its own keys. The other strategies aren't safe for
+// concurrent use and are always trained one context after another. With more
+// than one worker the order of the updates, and so the trained model, differs
+// from run to run even with the same seed.
+func trainStrategy(s Strategy, contexts []Context, iterations, convergenceWindow, progressEvery, workers int) error {
+	if progressEvery <= 0 {
+		// about every 10%, so a big training run logs at most ten lines
+		progressEvery = max(1, len(contexts)/10)
+	}
 
-	// Create a client.
-	client, err := bigquery.NewClient(ctx, "<bigquery project>")
+	strategy, _ := s.(*EpsilonGreedyStrategy)
+	if strategy == nil || workers < 1 {
+		workers = 1
+	}
+
+	// Contexts sharing a key, e.g. with IgnoreUser, go to the same worker so
+	// only it updates their rewards and checks them for convergence
+	parts := make([][]Context, workers)
+	worker := make(map[Context]int)
+	for _, ctx := range contexts {
+		var key Context
+		if strategy != nil {
+			key = strategy.key(ctx)
+		}
+		w, ok := worker[key]
+		if !ok {
+			w = len(worker) % workers
+			worker[key] = w
+		}
+		parts[w] = append(parts[w], ctx)
+	}
+
+	var trained atomic.Int64
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w, part := range parts {
+		wg.Add(1)
+		go func(w int, part []Context) {
+			defer wg.Done()
+			for _, ctx := range part {
+				err := trainContext(s, ctx, iterations, convergenceWindow)
+				if err != nil {
+					errs[w] = err
+					return
+				}
+				if n := int(trained.Add(1)); n%progressEvery == 0 && n < len(contexts) {
+					slog.Info("Training progress", "trained", n, "total", len(contexts), "percent", 100*n/len(contexts))
+				}
+			}
+		}(w, part)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// trainContext pulls the bandits the strategy selects iterations times in
+// the context, see trainStrategy.
+func trainContext(s Strategy, ctx Context, iterations, convergenceWindow int) error {
+	strategy, _ := s.(*EpsilonGreedyStrategy)
+	var key Context
+	if strategy != nil {
+		key = strategy.key(ctx)
+		strategy.mu.Lock()
+		if _, ok := strategy.Rewards[key]; !ok {
+			strategy.initContext(key)
+		}
+		strategy.mu.Unlock()
+	}
+
+	best, unchanged := -1, 0
+	for i := 0; i < iterations; i++ {
+		bandit, err := s.SelectBandit(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to select a bandit: %w", err)
+		}
+		reward := bandit.Pull(ctx)
+		s.UpdateReward(ctx, bandit, reward)
+
+		// Stop early once the best bandit for the context has settled
+		if strategy != nil && convergenceWindow > 0 {
+			strategy.mu.RLock()
+			b := argmax(strategy.Rewards[key])
+			strategy.mu.RUnlock()
+			if b != best {
+				best, unchanged = b, 0
+			} else if unchanged++; unchanged >= convergenceWindow {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// loadAnyModel reads the model saved by trainModel, of any strategy.
+func loadAnyModel(filename string, seed int64) (Strategy, error) {
+	s, _, err := loadStrategy(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not load model from %s: %w", filename, err)
+	}
+	if seeded, ok := s.(seeder); ok {
+		seeded.Seed(seed)
+	}
+
+	return s, nil
+}
+
+// loadModel reads an epsilon-greedy model saved by trainModel, for the modes
+// that only support that strategy.
+func loadModel(filename string, seed int64) (*EpsilonGreedyStrategy, error) {
+	s, err := loadAnyModel(filename, seed)
 	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+		return nil, err
+	}
+	strategy, ok := s.(*EpsilonGreedyStrategy)
+	if !ok {
+		name, _ := strategyName(s)
+		return nil, fmt.Errorf("the model in %s is a %s model, only epsilon models are supported", filename, name)
 	}
 
-	q := client.Query(`
+	return strategy, nil
+}
+
+func loadModelAndSelectAnItem(filename string, ctx Context, seed int64) error {
+	slog.Info("Loading model", "file", filename)
+	strategy, err := loadAnyModel(filename, seed)
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("Selecting an item to recommend")
+	// strategy selects a bandit based on the context
+	if s, ok := strategy.(*EpsilonGreedyStrategy); ok {
+		bandit, explored, err := s.SelectBanditWithInfo(ctx)
+		if err != nil {
+			return fmt.Errorf("could not select an item: %w", err)
+		}
+		slog.Info("Recommend item", "item_id", bandit.ItemID, "explored", explored)
+		return nil
+	}
+
+	bandit, err := strategy.SelectBandit(ctx)
+	if err != nil {
+		return fmt.Errorf("could not select an item: %w", err)
+	}
+	slog.Info("Recommend item", "item_id", bandit.ItemID)
+	return nil
+}
+
+// trainingDataQuery builds the query that fetches the training rows from the
+// given dataset table.
+func trainingDataQuery(dataset string) string {
+	return fmt.Sprintf(`
 		SELECT 
 		user_id,
 		item_id,
 		impression_time,
 		was_clicked,
 		device
-		FROM <dataset>
-	`)
+		FROM %s
+	`, dataset)
+}
+
+// rowIterator is the part of *bigquery.RowIterator we need to read rows.
+type rowIterator interface {
+	Next(dst interface{}) error
+}
+
+// DataSource provides the rows the model is trained on.
+type DataSource interface {
+	Fetch(ctx context.Context) ([]TrainingData, error)
+}
+
+// BigQueryDataSource runs Query in the BigQuery Project.
+type BigQueryDataSource struct {
+	Project string
+	Query   string
+}
+
+func (s *BigQueryDataSource) Fetch(ctx context.Context) ([]TrainingData, error) {
+	// Create a client.
+	client, err := bigquery.NewClient(ctx, s.Project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	defer client.Close()
+
+	q := client.Query(s.Query)
 	it, err := q.Read(ctx)
 	if err != nil {
-		log.Fatalf("Failed to initiate reading: %v", err)
+		return nil, fmt.Errorf("failed to initiate reading: %w", err)
 	}
 
-	// Create empty contexts and bandits.
-	contexts := []Context{}
-	bandits := []*Bandit{}
+	return readTrainingRows(it)
+}
 
+// authHint tells how to fix an error from BigQuery that is caused by missing
+// or rejected credentials. Other errors are returned as is.
+func authHint(err error) error {
+	if !isAuthError(err) {
+		return err
+	}
+	return fmt.Errorf("could not authenticate with BigQuery, set GOOGLE_APPLICATION_CREDENTIALS "+
+		"to a service account key file or run `gcloud auth application-default login`: %w", err)
+}
+
+// isAuthError reports whether BigQuery failed because of missing or rejected
+// credentials.
+func isAuthError(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden
+	}
+	if status.Code(err) == codes.Unauthenticated {
+		return true
+	}
+	// the client fails with these before making any request
+	msg := err.Error()
+	return strings.Contains(msg, "could not find default credentials") || strings.Contains(msg, "error getting credentials")
+}
+
+// readTrainingRows scans every row of the iterator into TrainingData.
+func readTrainingRows(it rowIterator) ([]TrainingData, error) {
+	rows := []TrainingData{}
 	for {
 		var row TrainingData
 		err := it.Next(&row)
@@ -201,84 +1589,115 @@ func getTrainingData() ([]Context, []*Bandit) {
 			break
 		}
 		if err != nil {
-			log.Fatalf("Failed to read data: %v", err)
-		}
-
-		// Determine time of day and day of week.
-		var timeOfDay, weekday string
-		if row.Timestamp.Valid {
-			hour := row.Timestamp.DateTime.Time.Hour
-			if hour < 4 {
-				timeOfDay = "night"
-			} else if hour < 12 {
-				timeOfDay = "morning"
-			} else if hour < 18 {
-				timeOfDay = "afternoon"
-			} else if hour < 22 {
-				timeOfDay = "evening"
-			} else {
-				timeOfDay = "night"
-			}
-
-			// Convert civil.DateTime to time.Time to get the weekday.
-			t := time.Date(row.Timestamp.DateTime.Date.Year, row.Timestamp.DateTime.Date.Month, row.Timestamp.DateTime.Date.Day, 0, 0, 0, 0, time.UTC)
-			weekday = strings.ToLower(t.Weekday().String())
+			return nil, fmt.Errorf("row %d does not match the expected columns "+
+				"(user_id, item_id, impression_time, was_clicked, device): %w", len(rows)+1, err)
 		}
+		rows = append(rows, row)
+	}
 
-		// Create a new context.
-		ctx := Context{row.UserID, timeOfDay, weekday, row.Device}
-		contexts = append(contexts, ctx)
+	return rows, nil
+}
 
-		// Check if the item already exists in bandits.
-		found := false
-		for _, bandit := range bandits {
-			if bandit.ItemID == row.ItemID {
-				// The item exists, update the context rewards.
-				if row.HasClick {
-					bandit.ContextRewards[ctx] += 1.0
-				} else {
-					bandit.ContextRewards[ctx] -= 0.1 // subtract a small penalty for not getting a click
-				}
-				found = true
-				break
-			}
+// buildBandits derives the distinct contexts, in the order they first
+// appear, and the bandits with their context rewards from the training rows.
+func buildBandits(rows []TrainingData, opts ContextOptions, reward RewardFunc) ([]Context, []*Bandit) {
+	// Create empty contexts and bandits.
+	contexts := []Context{}
+	seen := make(map[Context]struct{})
+	bandits := []*Bandit{}
+	byItem := make(map[string]*Bandit) // the bandits by ItemID, so rows find theirs without a scan
+	skipped := 0
+
+	for _, row := range rows {
+		// Create a new context, each context is only returned once.
+		ctx, ok := opts.contextFromRow(row)
+		if !ok {
+			skipped++
+			continue
+		}
+		if _, ok := seen[ctx]; !ok {
+			seen[ctx] = struct{}{}
+			contexts = append(contexts, ctx)
 		}
-		if !found {
+
+		bandit, ok := byItem[row.ItemID]
+		if !ok {
 			// The item does not exist, create a new bandit.
-			reward := 0.0
-			if row.HasClick {
-				reward = 1.0
-			}
-			bandit := &Bandit{
-				ItemID: row.ItemID,
-				ContextRewards: map[Context]float64{
-					ctx: reward,
-				},
+			bandit = &Bandit{
+				ItemID:         row.ItemID,
+				ContextRewards: map[Context]float64{},
 			}
 			bandits = append(bandits, bandit)
+			byItem[row.ItemID] = bandit
 		}
+
+		// Update the context rewards.
+		bandit.ContextRewards[ctx] += row.weightedReward(reward)
 	}
 
-	log.Printf("Fetched %d rows of training data", it.TotalRows)
-	log.Printf("There are %d bandits to choose from", len(bandits))
+	if skipped > 0 {
+		slog.Info("Skipped rows without a valid impression time", "rows", skipped)
+	}
 
 	return contexts, bandits
 }
 
+// dataSourceFromFlags reads the CSV file if there is one, and queries
+// BigQuery otherwise.
+func dataSourceFromFlags(csvPath string, project string, dataset string, query string) (DataSource, error) {
+	if csvPath != "" {
+		return &CSVDataSource{Path: csvPath}, nil
+	}
+
+	if project == "" || (dataset == "" && query == "") {
+		return nil, errors.New("-project and either -dataset or -query are required, or the " + projectEnv + " and " + datasetEnv + " environment variables")
+	}
+	if query == "" {
+		query = trainingDataQuery(dataset)
+	}
+	return &BigQueryDataSource{Project: project, Query: query}, nil
+}
+
+// describeSource names where a data source reads its rows from, for the
+// model metadata.
+func describeSource(source DataSource) string {
+	switch s := source.(type) {
+	case *CSVDataSource:
+		return "csv:" + s.Path
+	case *BigQueryDataSource:
+		return "bigquery:" + s.Project
+	}
+	return fmt.Sprintf("%T", source)
+}
+
 func main() {
+	cmd, err := parseArgs(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if errors.Is(err, errFlags) {
+		os.Exit(2) // the flag set has told what's wrong
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	// handle command line options
-	train := flag.Bool("train", false, "Train the model")
-	userId := flag.String("user", "", "User ID")
-	timeOfDay := flag.String("time", "", "Time of day [morning|afternoon|evening|night]")
-	weekday := flag.String("weekday", "", "Weekday")
-	device := flag.String("device", "", "Device")
-	flag.Parse()
-
-	// If the train flag is present, train the model; otherwise, load the model and make selection
-	if *train {
-		trainModel()
-	} else {
-		loadModelAndSelectAnItem(userId, timeOfDay, weekday, device)
+	run(cmd)
+}
+
+// setupLogging logs to stderr, dropping messages below the level.
+func setupLogging(level string) error {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return err
 	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: l})))
+	return nil
+}
+
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
 }
@@ -0,0 +1,1500 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testContext = Context{UserID: "u1", TimeOfDay: "morning", Weekday: "monday", Device: "mobile"}
+
+// newTestStrategy returns an untrained, seeded epsilon-greedy strategy with a
+// bandit for every item.
+func newTestStrategy(itemIDs ...string) *EpsilonGreedyStrategy {
+	bandits := make([]*Bandit, len(itemIDs))
+	for i, id := range itemIDs {
+		bandits[i] = &Bandit{ItemID: id, ContextRewards: make(map[Context]float64)}
+	}
+	s := strategies["epsilon"](bandits).(*EpsilonGreedyStrategy)
+	s.Seed(1)
+	return s
+}
+
+func TestEpsilonDecay(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.Epsilon = 0.5
+	s.EpsilonDecay = 0.9
+	s.MinEpsilon = 0.05
+
+	s.UpdateReward(testContext, s.Bandits[0], 1)
+	if s.Epsilon != 0.45 {
+		t.Errorf("Epsilon after an update = %v, want 0.45", s.Epsilon)
+	}
+	for i := 0; i < 100; i++ {
+		s.UpdateReward(testContext, s.Bandits[0], 1)
+	}
+	if s.Epsilon != s.MinEpsilon {
+		t.Errorf("Epsilon after 100 updates = %v, want MinEpsilon %v", s.Epsilon, s.MinEpsilon)
+	}
+
+	filename := filepath.Join(t.TempDir(), "model.gob")
+	err := s.SaveState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &EpsilonGreedyStrategy{}
+	err = loaded.LoadState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Epsilon != s.MinEpsilon || loaded.EpsilonDecay != 0.9 || loaded.MinEpsilon != 0.05 {
+		t.Errorf("loaded Epsilon, EpsilonDecay, MinEpsilon = %v, %v, %v, want %v, 0.9, 0.05",
+			loaded.Epsilon, loaded.EpsilonDecay, loaded.MinEpsilon, s.MinEpsilon)
+	}
+}
+
+func TestReset(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.UpdateReward(testContext, s.Bandits[0], 1)
+	s.UpdateReward(testContext, s.Bandits[1], 0)
+
+	s.Reset()
+	if len(s.Rewards) != 0 || len(s.Counts) != 0 {
+		t.Errorf("after Reset Rewards = %v, Counts = %v, want them empty", s.Rewards, s.Counts)
+	}
+	if len(s.Bandits) != 2 {
+		t.Errorf("after Reset %d bandits, want 2", len(s.Bandits))
+	}
+	if s.Epsilon != 0.1 {
+		t.Errorf("after Reset Epsilon = %v, want 0.1", s.Epsilon)
+	}
+
+	// still usable
+	s.UpdateReward(testContext, s.Bandits[1], 1)
+	if got := s.Counts[testContext]; len(got) != 2 || got[1] != 1 {
+		t.Errorf("Counts after an update = %v, want [0 1]", got)
+	}
+}
+
+func TestSelectBanditWithoutBandits(t *testing.T) {
+	for _, name := range strategyNames() {
+		s, err := newStrategy(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := s.SelectBandit(testContext)
+		if err != errNoBandits || b != nil {
+			t.Errorf("%s: SelectBandit() = %v, %v, want nil, %v", name, b, err, errNoBandits)
+		}
+	}
+}
+
+func TestSelectTopK(t *testing.T) {
+	s := newTestStrategy("a", "b", "c")
+	s.UpdateReward(testContext, s.Bandits[0], 0.2)
+	s.UpdateReward(testContext, s.Bandits[1], 0.9)
+	s.UpdateReward(testContext, s.Bandits[2], 0.5)
+
+	tests := []struct {
+		name string
+		ctx  Context
+		k    int
+		want []string
+	}{
+		{"top 2", testContext, 2, []string{"b", "c"}},
+		{"k above the bandits", testContext, 10, []string{"b", "c", "a"}},
+		{"negative k", testContext, -1, []string{}},
+		{"context without data", Context{UserID: "new"}, 2, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := itemIDs(s.SelectTopK(tt.ctx, tt.k))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("SelectTopK(%d) = %v, want %v", tt.k, got, tt.want)
+			}
+		})
+	}
+}
+
+func itemIDs(bandits []*Bandit) []string {
+	ids := make([]string, len(bandits))
+	for i, b := range bandits {
+		ids[i] = b.ItemID
+	}
+	return ids
+}
+
+func TestTrainingDataQuery(t *testing.T) {
+	query := trainingDataQuery("my-project.analytics.impressions")
+	if !strings.Contains(query, "FROM my-project.analytics.impressions") {
+		t.Errorf("query doesn't select from the dataset:\n%s", query)
+	}
+	for _, column := range []string{"user_id", "item_id", "impression_time", "was_clicked", "device"} {
+		if !strings.Contains(query, column) {
+			t.Errorf("query doesn't select %s:\n%s", column, query)
+		}
+	}
+}
+
+func TestDataSourceFromFlags(t *testing.T) {
+	source, err := dataSourceFromFlags("", "my-project", "analytics.impressions", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bq, ok := source.(*BigQueryDataSource)
+	if !ok {
+		t.Fatalf("source is %T, want *BigQueryDataSource", source)
+	}
+	if bq.Project != "my-project" || bq.Query != trainingDataQuery("analytics.impressions") {
+		t.Errorf("source = %+v, want the project and the default query", bq)
+	}
+
+	_, err = dataSourceFromFlags("", "", "analytics.impressions", "")
+	if err == nil {
+		t.Error("no error without a project")
+	}
+	_, err = dataSourceFromFlags("", "my-project", "", "")
+	if err == nil {
+		t.Error("no error without a dataset or query")
+	}
+}
+
+// fakeRowIterator returns the rows, then err, then iterator.Done.
+type fakeRowIterator struct {
+	rows []TrainingData
+	err  error
+}
+
+func (it *fakeRowIterator) Next(dst interface{}) error {
+	if len(it.rows) == 0 {
+		if it.err != nil {
+			return it.err
+		}
+		return iterator.Done
+	}
+	*dst.(*TrainingData) = it.rows[0]
+	it.rows = it.rows[1:]
+	return nil
+}
+
+func TestReadTrainingRows(t *testing.T) {
+	want := []TrainingData{
+		{UserID: "u1", ItemID: "a", HasClick: true, Device: bigquery.NullString{StringVal: "mobile", Valid: true}},
+		{UserID: "u2", ItemID: "b"},
+	}
+	rows, err := readTrainingRows(&fakeRowIterator{rows: slices.Clone(want)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("readTrainingRows() = %+v, want %+v", rows, want)
+	}
+
+	_, err = readTrainingRows(&fakeRowIterator{rows: want[:1], err: errors.New("no such field: clicked")})
+	if err == nil || !strings.Contains(err.Error(), "row 2 does not match the expected columns") {
+		t.Errorf("readTrainingRows() error = %v, want one naming row 2 and the expected columns", err)
+	}
+}
+
+// fakeDataSource returns its rows, or its error, without any I/O.
+type fakeDataSource struct {
+	rows []TrainingData
+	err  error
+}
+
+func (s *fakeDataSource) Fetch(ctx context.Context) ([]TrainingData, error) {
+	return s.rows, s.err
+}
+
+func TestTrainModel(t *testing.T) {
+	monday := bigquery.NullDateTime{DateTime: civil.DateTime{Date: civil.Date{Year: 2023, Month: 5, Day: 1}, Time: civil.Time{Hour: 8}}, Valid: true}
+	var rows []TrainingData
+	for i := 0; i < 10; i++ {
+		rows = append(rows,
+			TrainingData{UserID: "u1", ItemID: "a", Timestamp: monday, HasClick: false},
+			TrainingData{UserID: "u1", ItemID: "b", Timestamp: monday, HasClick: true},
+		)
+	}
+
+	filename := filepath.Join(t.TempDir(), "model.gob")
+	err := trainModel(&fakeDataSource{rows: rows}, TrainConfig{
+		Reward:     defaultRewardConfig,
+		Seed:       1,
+		ModelFile:  filename,
+		Iterations: 100,
+		Workers:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := loadModel(filename, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.NumBandits() != 2 {
+		t.Errorf("%d bandits, want 2", s.NumBandits())
+	}
+	if meta := s.Metadata(); meta.Rows != len(rows) || meta.Source != "*main.fakeDataSource" {
+		t.Errorf("metadata = %+v, want %d rows from the fake source", meta, len(rows))
+	}
+	ctx := Context{UserID: "u1", TimeOfDay: "morning", Weekday: "monday", Device: unknown}
+	if top := s.SelectTopK(ctx, 1); len(top) != 1 || top[0].ItemID != "b" {
+		t.Errorf("best item = %v, want the clicked b", itemIDs(top))
+	}
+}
+
+func TestWriteFileAtomicKeepsFileOnError(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "model.gob")
+	err := os.WriteFile(filename, []byte("old model"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errEncode := errors.New("encode failed")
+	err = writeFileAtomic(filename, func(w io.Writer) error {
+		w.Write([]byte("half a new"))
+		return errEncode
+	})
+	if err != errEncode {
+		t.Errorf("writeFileAtomic() error = %v, want %v", err, errEncode)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "old model" {
+		t.Errorf("file = %q after a failed write, want it untouched", data)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the directory, want the temporary file removed", len(entries))
+	}
+}
+
+func TestSaveStateCompressed(t *testing.T) {
+	s := newTestStrategy("a", "b", "c")
+	for i := 0; i < 500; i++ {
+		ctx := Context{UserID: fmt.Sprintf("u%d", i), TimeOfDay: "morning", Weekday: "monday", Device: "mobile"}
+		s.UpdateReward(ctx, s.Bandits[i%3], 1)
+	}
+
+	dir := t.TempDir()
+	plain, compressed := filepath.Join(dir, "model.gob"), filepath.Join(dir, "model.gob.gz")
+	err := s.SaveState(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SaveStateCompressed(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainInfo, err := os.Stat(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressedInfo, err := os.Stat(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressedInfo.Size() >= plainInfo.Size() {
+		t.Errorf("compressed model is %d bytes, want less than the %d of the plain one", compressedInfo.Size(), plainInfo.Size())
+	}
+
+	loaded := &EpsilonGreedyStrategy{}
+	err = loaded.LoadState(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Rewards, s.Rewards) || !reflect.DeepEqual(loaded.Counts, s.Counts) {
+		t.Error("the compressed model doesn't load back the same rewards and counts")
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.UpdateReward(testContext, s.Bandits[1], 1)
+
+	var buf bytes.Buffer
+	err := s.Encode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &EpsilonGreedyStrategy{}
+	err = decoded.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Epsilon != s.Epsilon || !reflect.DeepEqual(itemIDs(decoded.Bandits), itemIDs(s.Bandits)) {
+		t.Errorf("decoded Epsilon %v and bandits %v, want %v and %v",
+			decoded.Epsilon, itemIDs(decoded.Bandits), s.Epsilon, itemIDs(s.Bandits))
+	}
+	if !reflect.DeepEqual(decoded.Rewards, s.Rewards) || !reflect.DeepEqual(decoded.Counts, s.Counts) {
+		t.Errorf("decoded Rewards %v and Counts %v, want %v and %v", decoded.Rewards, decoded.Counts, s.Rewards, s.Counts)
+	}
+
+	err = decoded.Decode(strings.NewReader("not a model"))
+	if err == nil {
+		t.Error("Decode() of garbage succeeded, want an error")
+	}
+}
+
+func TestLoadModelAndSelectAnItemErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	missing := filepath.Join(dir, "missing.gob")
+	err := loadModelAndSelectAnItem(missing, testContext, 1)
+	if err == nil || !strings.Contains(err.Error(), "could not load model from "+missing) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("loading a missing model: error = %v, want one naming the file", err)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.gob")
+	err = os.WriteFile(corrupt, []byte("not a model"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadModelAndSelectAnItem(corrupt, testContext, 1)
+	if err == nil || !strings.Contains(err.Error(), "could not load model from "+corrupt) {
+		t.Errorf("loading a corrupt model: error = %v, want one naming the file", err)
+	}
+}
+
+func TestSameSeedSameSelections(t *testing.T) {
+	selections := func(seed int64) []string {
+		s := newTestStrategy("a", "b", "c", "d")
+		s.Epsilon = 0.5
+		s.Seed(seed)
+		s.UpdateReward(testContext, s.Bandits[2], 1)
+		var ids []string
+		for i := 0; i < 100; i++ {
+			b, err := s.SelectBandit(testContext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, b.ItemID)
+		}
+		return ids
+	}
+
+	if a, b := selections(7), selections(7); !slices.Equal(a, b) {
+		t.Errorf("selections with the same seed differ:\n%v\n%v", a, b)
+	}
+	if a, b := selections(7), selections(8); slices.Equal(a, b) {
+		t.Error("selections with different seeds are the same")
+	}
+}
+
+func TestConcurrentUpdateAndSelect(t *testing.T) {
+	s := newTestStrategy("a", "b", "c")
+	filename := filepath.Join(t.TempDir(), "model.gob")
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			ctx := Context{UserID: fmt.Sprintf("u%d", g%3)}
+			for i := 0; i < 200; i++ {
+				b, err := s.SelectBandit(ctx)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				s.UpdateReward(ctx, b, float64(i%2))
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := s.SaveState(filename)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+
+	total := 0
+	for _, counts := range s.Counts {
+		total += sum(counts)
+	}
+	if total != 8*200 {
+		t.Errorf("%d rewards counted, want %d", total, 8*200)
+	}
+}
+
+// clickRows returns a clicked and a not clicked row of the user for the item.
+func clickRows(userID, itemID string) []TrainingData {
+	return []TrainingData{
+		{UserID: userID, ItemID: itemID, HasClick: true},
+		{UserID: userID, ItemID: itemID, HasClick: false},
+	}
+}
+
+func TestRewardConfig(t *testing.T) {
+	rows := clickRows("u1", "a")
+	ctx := Context{UserID: "u1", TimeOfDay: unknown, Weekday: unknown, Device: unknown}
+
+	tests := []struct {
+		config RewardConfig
+		want   float64
+	}{
+		{defaultRewardConfig, 0.9},
+		{RewardConfig{ClickReward: 2, NoClickPenalty: 0.5}, 1.5},
+		{RewardConfig{ClickReward: 1, NoClickPenalty: 0}, 1},
+	}
+	for _, tt := range tests {
+		_, bandits := buildBandits(rows, ContextOptions{}, tt.config.Func())
+		if got := bandits[0].ContextRewards[ctx]; math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%+v: context reward = %v, want %v", tt.config, got, tt.want)
+		}
+	}
+}
+
+func TestCustomRewardFunc(t *testing.T) {
+	rows := append(clickRows("u1", "a"), clickRows("u1", "b")[1])
+	ctx := Context{UserID: "u1", TimeOfDay: unknown, Weekday: unknown, Device: unknown}
+	reward := func(row TrainingData) float64 {
+		if row.HasClick {
+			return 5
+		}
+		return 0
+	}
+
+	_, bandits := buildBandits(rows, ContextOptions{}, reward)
+	want := map[string]float64{"a": 5, "b": 0}
+	for _, b := range bandits {
+		if got := b.ContextRewards[ctx]; got != want[b.ItemID] {
+			t.Errorf("%s: context reward = %v, want %v", b.ItemID, got, want[b.ItemID])
+		}
+	}
+
+	cfg := TrainConfig{Reward: defaultRewardConfig, RewardFunc: reward}
+	if got := cfg.rewardFunc()(rows[0]); got != 5 {
+		t.Errorf("TrainConfig reward of a click = %v, want the RewardFunc's 5", got)
+	}
+}
+
+// checkAlignedContexts fails the test unless the rewards and counts of every
+// context line up with the bandits.
+func checkAlignedContexts(t *testing.T, s *EpsilonGreedyStrategy) {
+	t.Helper()
+
+	for ctx := range s.Rewards {
+		if err := s.checkAligned(ctx); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestAddAndRemoveBandit(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	other := Context{UserID: "u2"}
+	s.UpdateReward(testContext, s.Bandits[0], 1)
+	s.UpdateReward(other, s.Bandits[1], 0.5)
+
+	c := &Bandit{ItemID: "c", ContextRewards: map[Context]float64{}}
+	s.AddBandit(c)
+	checkAlignedContexts(t, s)
+	if got := s.Rewards[testContext]; !slices.Equal(got, []float64{1, 0, 0}) {
+		t.Errorf("rewards after adding c = %v, want [1 0 0]", got)
+	}
+
+	// training goes on with the new bandit
+	s.UpdateReward(testContext, c, 0.7)
+	if got := s.Rewards[testContext][2]; got != 0.7 {
+		t.Errorf("reward of c = %v, want 0.7", got)
+	}
+
+	s.RemoveBandit("a")
+	checkAlignedContexts(t, s)
+	if got := itemIDs(s.Bandits); !slices.Equal(got, []string{"b", "c"}) {
+		t.Errorf("bandits after removing a = %v, want [b c]", got)
+	}
+	if got := s.Rewards[testContext]; !slices.Equal(got, []float64{0, 0.7}) {
+		t.Errorf("rewards after removing a = %v, want [0 0.7]", got)
+	}
+	if got := s.Rewards[other]; !slices.Equal(got, []float64{0.5, 0}) {
+		t.Errorf("rewards in the other context = %v, want [0.5 0]", got)
+	}
+
+	s.Epsilon = 0
+	b, err := s.SelectBandit(testContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != c {
+		t.Errorf("SelectBandit() = %s, want c", b.ItemID)
+	}
+}
+
+func TestBuildBanditsUniqueContexts(t *testing.T) {
+	var rows []TrainingData
+	for i := 0; i < 5; i++ {
+		rows = append(rows, clickRows("u1", "a")...)
+		rows = append(rows, clickRows("u2", "b")...)
+	}
+
+	contexts, bandits := buildBandits(rows, ContextOptions{}, defaultRewardConfig.Func())
+	u1 := Context{UserID: "u1", TimeOfDay: unknown, Weekday: unknown, Device: unknown}
+	u2 := Context{UserID: "u2", TimeOfDay: unknown, Weekday: unknown, Device: unknown}
+	if !slices.Equal(contexts, []Context{u1, u2}) {
+		t.Errorf("contexts = %+v, want u1 and u2 once each", contexts)
+	}
+	if len(bandits) != 2 {
+		t.Fatalf("%d bandits, want 2", len(bandits))
+	}
+	// every duplicate still adds its reward
+	if got := bandits[0].ContextRewards[u1]; math.Abs(got-4.5) > 1e-9 {
+		t.Errorf("reward of a = %v, want 4.5", got)
+	}
+}
+
+func TestMisalignedContext(t *testing.T) {
+	s := newTestStrategy("a", "b", "c")
+	s.Epsilon = 0
+	s.UpdateReward(testContext, s.Bandits[2], 1)
+	checkAlignedContexts(t, s)
+
+	b, err := s.SelectBandit(testContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != s.Bandits[2] {
+		t.Errorf("SelectBandit() = %s, want the rewarded c", b.ItemID)
+	}
+
+	// e.g. a model saved by a version that broke the invariant
+	s.Rewards[testContext] = s.Rewards[testContext][:2]
+	_, err = s.SelectBandit(testContext)
+	if err == nil {
+		t.Error("SelectBandit() in a misaligned context succeeded, want an error")
+	}
+	s.UpdateReward(testContext, s.Bandits[0], 1)
+	if got := s.Counts[testContext]; !slices.Equal(got, []int{0, 0, 1}) {
+		t.Errorf("counts after updating a misaligned context = %v, want them untouched", got)
+	}
+}
+
+func TestRegretGrowsSlowerThanRandom(t *testing.T) {
+	s := newTestStrategy("good", "bad")
+	s.Bandits[0].ContextRewards[testContext] = 1
+	s.Bandits[1].ContextRewards[testContext] = 0
+
+	rng := rand.New(rand.NewSource(1))
+	randomRegret := 0.0
+	for i := 0; i < 1000; i++ {
+		b, err := s.SelectBandit(testContext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.UpdateReward(testContext, b, b.Pull(testContext))
+
+		randomRegret += 1 - s.Bandits[rng.Intn(2)].Pull(testContext)
+	}
+
+	if s.Regret() >= randomRegret/2 {
+		t.Errorf("regret = %v, want well below the %v of picking at random", s.Regret(), randomRegret)
+	}
+	if s.Regret() <= 0 {
+		t.Errorf("regret = %v, want above 0 from exploring the bad bandit", s.Regret())
+	}
+}
+
+func TestTrainStrategyIterations(t *testing.T) {
+	contexts := []Context{{UserID: "u1"}, {UserID: "u2"}, {UserID: "u3"}}
+	s := newTestStrategy("a", "b")
+
+	err := trainStrategy(s, contexts, 25, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ctx := range contexts {
+		if n := sum(s.Counts[ctx]); n != 25 {
+			t.Errorf("%s was pulled %d times, want 25", ctx.UserID, n)
+		}
+	}
+}
+
+func TestTrainStrategyConvergence(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.Epsilon = 0
+	s.Bandits[0].ContextRewards[testContext] = 1
+
+	err := trainStrategy(s, []Context{testContext}, 1000, 10, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := sum(s.Counts[testContext]); n >= 1000 {
+		t.Errorf("pulled %d times, want training to stop early once the best bandit settles", n)
+	}
+}
+
+// captureLogs makes slog write JSON lines at the level to the returned
+// buffer until the test ends.
+func captureLogs(t testing.TB, level slog.Level) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level})))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return &buf
+}
+
+// logRecords decodes the JSON log lines with the message.
+func logRecords(t *testing.T, logs *bytes.Buffer, msg string) []map[string]interface{} {
+	t.Helper()
+
+	var records []map[string]interface{}
+	for _, line := range strings.FieldsFunc(logs.String(), func(r rune) bool { return r == '\n' }) {
+		var record map[string]interface{}
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		if record["msg"] == msg {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestTrainModelLogsFields(t *testing.T) {
+	logs := captureLogs(t, slog.LevelInfo)
+	rows := append(clickRows("u1", "a"), clickRows("u2", "b")...)
+	err := trainModel(&fakeDataSource{rows: rows}, TrainConfig{
+		Reward:     defaultRewardConfig,
+		Seed:       1,
+		ModelFile:  filepath.Join(t.TempDir(), "model.gob"),
+		Iterations: 10,
+		Workers:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetched := logRecords(t, logs, "Fetched training data")
+	if len(fetched) != 1 || fetched[0]["rows"] != float64(4) {
+		t.Errorf("fetched log records = %v, want one with 4 rows", fetched)
+	}
+	built := logRecords(t, logs, "Built bandits to choose from")
+	if len(built) != 1 || built[0]["bandits"] != float64(2) || built[0]["contexts"] != float64(2) {
+		t.Errorf("built log records = %v, want one with 2 bandits and 2 contexts", built)
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	old := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	err := setupLogging("warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slog.Default().Enabled(context.Background(), slog.LevelInfo) || !slog.Default().Enabled(context.Background(), slog.LevelWarn) {
+		t.Error("-log-level warn doesn't log from warnings up")
+	}
+	if setupLogging("loud") == nil {
+		t.Error("setupLogging() of an unknown level succeeded, want an error")
+	}
+}
+
+func TestTrainStrategyProgress(t *testing.T) {
+	contexts := make([]Context, 10)
+	for i := range contexts {
+		contexts[i] = Context{UserID: fmt.Sprintf("u%d", i)}
+	}
+
+	tests := []struct {
+		progressEvery int
+		want          []float64 // trained contexts logged
+	}{
+		{3, []float64{3, 6, 9}},
+		{0, []float64{1, 2, 3, 4, 5, 6, 7, 8, 9}}, // about every 10%
+		{20, nil},
+	}
+	for _, tt := range tests {
+		logs := captureLogs(t, slog.LevelInfo)
+		err := trainStrategy(newTestStrategy("a"), contexts, 1, 0, tt.progressEvery, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var trained []float64
+		for _, record := range logRecords(t, logs, "Training progress") {
+			trained = append(trained, record["trained"].(float64))
+			if record["total"] != float64(len(contexts)) {
+				t.Errorf("progress total = %v, want %d", record["total"], len(contexts))
+			}
+		}
+		if !slices.Equal(trained, tt.want) {
+			t.Errorf("progress every %d: logged %v trained, want %v", tt.progressEvery, trained, tt.want)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.UpdateReward(testContext, s.Bandits[0], 1)
+	s.Bandits[0].ContextRewards[testContext] = 1
+
+	clone := s.Clone()
+	clone.UpdateReward(testContext, clone.Bandits[1], 1)
+	clone.Rewards[testContext][0] = 0.5
+	clone.Bandits[0].ContextRewards[testContext] = 2
+	clone.AddBandit(&Bandit{ItemID: "c"})
+	clone.Epsilon = 1
+
+	if got := s.Rewards[testContext]; !slices.Equal(got, []float64{1, 0}) {
+		t.Errorf("original rewards = %v, want [1 0]", got)
+	}
+	if got := s.Counts[testContext]; !slices.Equal(got, []int{1, 0}) {
+		t.Errorf("original counts = %v, want [1 0]", got)
+	}
+	if got := s.Bandits[0].ContextRewards[testContext]; got != 1 {
+		t.Errorf("original context reward = %v, want 1", got)
+	}
+	if len(s.Bandits) != 2 || s.Epsilon != 0.1 {
+		t.Errorf("original has %d bandits and epsilon %v, want 2 and 0.1", len(s.Bandits), s.Epsilon)
+	}
+}
+
+func TestSelectBanditWithInfo(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.UpdateReward(testContext, s.Bandits[1], 1)
+
+	for _, tt := range []struct {
+		epsilon  float64
+		explored bool
+	}{{1, true}, {0, false}} {
+		s.Epsilon = tt.epsilon
+		for i := 0; i < 100; i++ {
+			b, explored, err := s.SelectBanditWithInfo(testContext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if explored != tt.explored {
+				t.Fatalf("epsilon %v: explored = %v, want %v", tt.epsilon, explored, tt.explored)
+			}
+			if !explored && b != s.Bandits[1] {
+				t.Fatalf("exploited %s, want the best b", b.ItemID)
+			}
+		}
+	}
+}
+
+func TestUpdateFromRowMatchesBatch(t *testing.T) {
+	monday := bigquery.NullDateTime{DateTime: civil.DateTime{Date: civil.Date{Year: 2023, Month: 5, Day: 1}, Time: civil.Time{Hour: 8}}, Valid: true}
+	rows := []TrainingData{
+		{UserID: "u1", ItemID: "a", Timestamp: monday, HasClick: true},
+		{UserID: "u1", ItemID: "b", Timestamp: monday},
+		{UserID: "u2", ItemID: "a"},
+		{UserID: "u1", ItemID: "a", Timestamp: monday},
+		{UserID: "u2", ItemID: "c", HasClick: true},
+	}
+	reward := defaultRewardConfig.Func()
+
+	online := newTestStrategy()
+	for _, row := range rows {
+		if !online.UpdateFromRow(row, ContextOptions{}, reward) {
+			t.Fatalf("row %+v skipped", row)
+		}
+	}
+
+	// the batch model has the same bandits and gets the same rewards
+	contexts, bandits := buildBandits(rows, ContextOptions{}, reward)
+	batch := strategies["epsilon"](bandits).(*EpsilonGreedyStrategy)
+	for _, row := range rows {
+		ctx, _ := ContextOptions{}.contextFromRow(row)
+		batch.UpdateReward(ctx, batch.FindBandit(row.ItemID), reward(row))
+	}
+
+	if got, want := itemIDs(online.Bandits), itemIDs(batch.Bandits); !slices.Equal(got, want) {
+		t.Fatalf("online bandits %v, want %v", got, want)
+	}
+	for i := range batch.Bandits {
+		if !reflect.DeepEqual(online.Bandits[i].ContextRewards, batch.Bandits[i].ContextRewards) {
+			t.Errorf("online context rewards of %s = %v, want %v",
+				batch.Bandits[i].ItemID, online.Bandits[i].ContextRewards, batch.Bandits[i].ContextRewards)
+		}
+	}
+	if len(online.Rewards) != len(contexts) {
+		t.Errorf("%d online contexts, want %d", len(online.Rewards), len(contexts))
+	}
+	for _, ctx := range contexts {
+		if !slices.Equal(online.Rewards[ctx], batch.Rewards[ctx]) || !slices.Equal(online.Counts[ctx], batch.Counts[ctx]) {
+			t.Errorf("online rewards %v and counts %v in %+v, want %v and %v",
+				online.Rewards[ctx], online.Counts[ctx], ctx, batch.Rewards[ctx], batch.Counts[ctx])
+		}
+	}
+	checkAlignedContexts(t, online)
+}
+
+func TestMinSamples(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.Epsilon = 0
+	s.MinSamples = 3
+
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 20; i++ {
+			_, explored, err := s.SelectBanditWithInfo(testContext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !explored {
+				t.Fatalf("exploited with %d samples, want exploring below MinSamples", n)
+			}
+		}
+		s.UpdateReward(testContext, s.Bandits[1], 1)
+	}
+
+	b, explored, err := s.SelectBanditWithInfo(testContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if explored || b != s.Bandits[1] {
+		t.Errorf("with MinSamples samples selected %s, explored %v, want exploiting b", b.ItemID, explored)
+	}
+}
+
+func TestAlphaFollowsRecentRewards(t *testing.T) {
+	plain, ema := newTestStrategy("a"), newTestStrategy("a")
+	ema.Alpha = 0.3
+
+	// preferences drift from 0 to 1
+	for i := 0; i < 20; i++ {
+		plain.UpdateReward(testContext, plain.Bandits[0], 0)
+		ema.UpdateReward(testContext, ema.Bandits[0], 0)
+	}
+	for i := 0; i < 5; i++ {
+		plain.UpdateReward(testContext, plain.Bandits[0], 1)
+		ema.UpdateReward(testContext, ema.Bandits[0], 1)
+	}
+
+	plainReward, emaReward := plain.Rewards[testContext][0], ema.Rewards[testContext][0]
+	if math.Abs(plainReward-0.2) > 1e-9 {
+		t.Errorf("plain average = %v, want 0.2", plainReward)
+	}
+	if want := 1 - math.Pow(0.7, 5); math.Abs(emaReward-want) > 1e-9 {
+		t.Errorf("moving average = %v, want %v", emaReward, want)
+	}
+	if ema.Counts[testContext][0] != 25 {
+		t.Errorf("moving average count = %d, want 25", ema.Counts[testContext][0])
+	}
+}
+
+func TestSelectBatchMatchesSelectBandit(t *testing.T) {
+	seeded := func() *EpsilonGreedyStrategy {
+		s := newTestStrategy("a", "b", "c")
+		s.Epsilon = 0.3
+		s.UpdateReward(testContext, s.Bandits[1], 1)
+		s.UpdateReward(Context{UserID: "u2"}, s.Bandits[2], 1)
+		s.Seed(5)
+		return s
+	}
+	ctxs := []Context{testContext, {UserID: "u2"}, {UserID: "new"}}
+	for i := 0; i < 5; i++ {
+		ctxs = append(ctxs, ctxs...)
+	}
+
+	batch, batchExplored, err := seeded().SelectBatch(ctxs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := seeded()
+	for i, ctx := range ctxs {
+		b, explored, err := s.SelectBanditWithInfo(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch[i].ItemID != b.ItemID || batchExplored[i] != explored {
+			t.Errorf("batch selection %d = %s, explored %v, want %s, explored %v", i, batch[i].ItemID, batchExplored[i], b.ItemID, explored)
+		}
+	}
+}
+
+func TestScoreContext(t *testing.T) {
+	s := newTestStrategy("a", "b", "c")
+	s.Epsilon = 0
+	s.UpdateReward(testContext, s.Bandits[0], 0.2)
+	s.UpdateReward(testContext, s.Bandits[1], 0.9)
+	s.UpdateReward(testContext, s.Bandits[2], -0.1)
+
+	scores := s.ScoreContext(testContext)
+	total, best := 0.0, ""
+	for id, score := range scores {
+		total += score
+		if best == "" || score > scores[best] {
+			best = id
+		}
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("scores %v sum to %v, want 1", scores, total)
+	}
+	b, err := s.SelectBandit(testContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best != b.ItemID {
+		t.Errorf("highest score %s, want %s selected with epsilon 0", best, b.ItemID)
+	}
+
+	uniform := s.ScoreContext(Context{UserID: "new"})
+	if len(uniform) != 3 {
+		t.Fatalf("ScoreContext() without rewards = %v, want a score for each of the 3 items", uniform)
+	}
+	for id, score := range uniform {
+		if math.Abs(score-1.0/3) > 1e-9 {
+			t.Errorf("score of %s without rewards = %v, want 1/3", id, score)
+		}
+	}
+}
+
+func TestSelectBanditSpreadsTies(t *testing.T) {
+	s := newTestStrategy("a", "b", "c", "d")
+	s.Epsilon = 0
+	for _, b := range s.Bandits[:3] {
+		s.UpdateReward(testContext, b, 0)
+	}
+	s.UpdateReward(testContext, s.Bandits[3], -0.1)
+
+	picks := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		b, explored, err := s.SelectBanditWithInfo(testContext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if explored {
+			t.Fatal("explored with epsilon 0")
+		}
+		picks[b.ItemID]++
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if picks[id] < 900 || picks[id] > 1100 {
+			t.Errorf("tied %s picked %d of 3000 times, want about 1000", id, picks[id])
+		}
+	}
+	if picks["d"] != 0 {
+		t.Errorf("worse d picked %d times, want never", picks["d"])
+	}
+}
+
+// buildBanditsScan builds the bandits the way buildBandits did before it
+// looked them up by ItemID, scanning them for every row, to check and
+// benchmark buildBandits against.
+func buildBanditsScan(rows []TrainingData, opts ContextOptions, reward RewardFunc) []*Bandit {
+	bandits := []*Bandit{}
+	for _, row := range rows {
+		ctx, ok := opts.contextFromRow(row)
+		if !ok {
+			continue
+		}
+		var bandit *Bandit
+		for _, b := range bandits {
+			if b.ItemID == row.ItemID {
+				bandit = b
+				break
+			}
+		}
+		if bandit == nil {
+			bandit = &Bandit{ItemID: row.ItemID, ContextRewards: map[Context]float64{}}
+			bandits = append(bandits, bandit)
+		}
+		bandit.ContextRewards[ctx] += row.weightedReward(reward)
+	}
+	return bandits
+}
+
+func TestBuildBanditsMatchesScan(t *testing.T) {
+	rows := Simulate(SimulationConfig{Rows: 5000, Users: 50, Items: 40, Seed: 1})
+	_, bandits := buildBandits(rows, ContextOptions{}, defaultRewardConfig.Func())
+	want := buildBanditsScan(rows, ContextOptions{}, defaultRewardConfig.Func())
+	if !reflect.DeepEqual(bandits, want) {
+		t.Error("buildBandits() and the scan built different bandits")
+	}
+}
+
+func BenchmarkBuildBandits(b *testing.B) {
+	rows := Simulate(SimulationConfig{Rows: 100000, Users: 1000, Items: 1000, Seed: 1})
+	reward := defaultRewardConfig.Func()
+	b.Run("map", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			buildBandits(rows, ContextOptions{}, reward)
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			buildBanditsScan(rows, ContextOptions{}, reward)
+		}
+	})
+}
+
+func TestConfidence(t *testing.T) {
+	s := newTestStrategy("a", "b", "c")
+	s.Bandits[0].ContextRewards[testContext] = 0.8
+	s.Bandits[1].ContextRewards[testContext] = 0.2
+	s.Epsilon = 0.5
+	err := trainStrategy(s, []Context{testContext}, 200, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mean, n := s.Confidence(testContext, "a")
+	if math.Abs(mean-0.8) > 1e-9 || n != s.Counts[testContext][0] || n < lowConfidenceSamples {
+		t.Errorf("Confidence(a) = %v, %d, want 0.8 from the %d pulls", mean, n, s.Counts[testContext][0])
+	}
+	if LowConfidence(n) {
+		t.Errorf("LowConfidence(%d) = true, want false for a trained item", n)
+	}
+
+	s.UpdateReward(Context{UserID: "u2"}, s.Bandits[2], 1)
+	mean, n = s.Confidence(Context{UserID: "u2"}, "c")
+	if mean != 1 || n != 1 || !LowConfidence(n) {
+		t.Errorf("Confidence(c) = %v, %d, low %v, want 1 from 1 reward, low", mean, n, LowConfidence(n))
+	}
+	if mean, n := s.Confidence(testContext, "d"); mean != 0 || n != 0 {
+		t.Errorf("Confidence() of an unknown item = %v, %d, want 0, 0", mean, n)
+	}
+}
+
+func TestItemFilter(t *testing.T) {
+	s := newTestStrategy("adult", "news", "sports")
+	s.Epsilon = 0.5
+	s.UpdateReward(testContext, s.Bandits[0], 1)
+	s.UpdateReward(testContext, s.Bandits[1], 0.5)
+	s.UpdateReward(testContext, s.Bandits[2], 0.2)
+	s.SetItemFilter(func(ctx Context, b *Bandit) bool {
+		return ctx.TimeOfDay != "morning" || b.ItemID != "adult"
+	})
+
+	picks := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		b, err := s.SelectBandit(testContext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[b.ItemID]++
+	}
+	if picks["adult"] != 0 {
+		t.Errorf("filtered out item picked %d times, want never", picks["adult"])
+	}
+	if picks["news"] <= picks["sports"] || picks["sports"] == 0 {
+		t.Errorf("picks = %v, want mostly the best allowed news and sometimes sports", picks)
+	}
+
+	// other contexts still get the item
+	evening := testContext
+	evening.TimeOfDay = "evening"
+	s.UpdateReward(evening, s.Bandits[0], 1)
+	s.Epsilon = 0
+	if b, err := s.SelectBandit(evening); err != nil || b.ItemID != "adult" {
+		t.Errorf("SelectBandit(evening) = %v, %v, want the best adult", b, err)
+	}
+
+	s.SetItemFilter(func(Context, *Bandit) bool { return false })
+	if _, err := s.SelectBandit(testContext); !errors.Is(err, errNoBandits) {
+		t.Errorf("SelectBandit() with every item filtered out: error = %v, want %v", err, errNoBandits)
+	}
+}
+
+func TestOptimisticInitialRewardTriesEveryBandit(t *testing.T) {
+	tried := func(initialReward float64) int {
+		s := newTestStrategy("a", "b", "c", "d", "e")
+		s.Epsilon = 0
+		s.InitialReward = initialReward
+		for i, b := range s.Bandits {
+			b.ContextRewards[testContext] = 0.2 + 0.15*float64(i)
+		}
+
+		for i := 0; i < len(s.Bandits); i++ {
+			b, err := s.SelectBandit(testContext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.UpdateReward(testContext, b, b.Pull(testContext))
+		}
+		n := 0
+		for _, count := range s.Counts[testContext] {
+			if count > 0 {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := tried(2); n != 5 {
+		t.Errorf("tried %d of 5 bandits in the first 5 selections with an optimistic initial reward, want all", n)
+	}
+	if n := tried(0); n != 1 {
+		t.Errorf("tried %d of 5 bandits in the first 5 selections without an initial reward, want 1", n)
+	}
+}
+
+func TestFatiguePenaltyGrowsWithExposures(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.FatiguePenalty = LinearFatigue(0.05)
+
+	// the reward each update applied, from the change in the sum of rewards
+	applied := func(i int, reward float64) float64 {
+		before := s.Rewards[testContext]
+		sumBefore := 0.0
+		if len(before) > 0 {
+			sumBefore = before[i] * float64(s.Counts[testContext][i])
+		}
+		s.UpdateReward(testContext, s.Bandits[i], reward)
+		return s.Rewards[testContext][i]*float64(s.Counts[testContext][i]) - sumBefore
+	}
+
+	for n, want := range []float64{-0.1, -0.15, -0.2, -0.25} {
+		if got := applied(0, -0.1); math.Abs(got-want) > 1e-9 {
+			t.Errorf("non-click %d applied %v, want %v", n+1, got, want)
+		}
+	}
+	if got := applied(0, 1); math.Abs(got-1) > 1e-9 {
+		t.Errorf("click after 4 exposures applied %v, want the full 1", got)
+	}
+	if got := applied(1, -0.1); math.Abs(got+0.1) > 1e-9 {
+		t.Errorf("first non-click of another item applied %v, want -0.1", got)
+	}
+}
+
+func TestTrainMatchesInlineLoop(t *testing.T) {
+	rows := Simulate(SimulationConfig{Rows: 300, Users: 5, Items: 4, Seed: 1})
+	contexts, bandits := buildBandits(rows, ContextOptions{}, defaultRewardConfig.Func())
+
+	// the loop trainModel used to run inline
+	want := strategies["epsilon"](bandits).(*EpsilonGreedyStrategy)
+	want.Epsilon = 0.2
+	want.Seed(1)
+	for _, ctx := range contexts {
+		want.Rewards[ctx] = make([]float64, len(bandits))
+		want.Counts[ctx] = make([]int, len(bandits))
+		for i := 0; i < 500; i++ {
+			b, err := want.SelectBandit(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want.UpdateReward(ctx, b, b.Pull(ctx))
+		}
+	}
+
+	// The rewards pulled are the same every time, so whatever is selected,
+	// both learn them exactly
+	got, err := Train(contexts, bandits, 500, 0.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Epsilon != 0.2 {
+		t.Errorf("Epsilon = %v, want 0.2", got.Epsilon)
+	}
+	if len(got.Rewards) != len(want.Rewards) {
+		t.Fatalf("Train() learned %d contexts, want %d", len(got.Rewards), len(want.Rewards))
+	}
+	for _, ctx := range contexts {
+		for i := range bandits {
+			if math.Abs(got.Rewards[ctx][i]-want.Rewards[ctx][i]) > 1e-9 {
+				t.Errorf("reward of %s in %+v = %v, want %v", bandits[i].ItemID, ctx, got.Rewards[ctx][i], want.Rewards[ctx][i])
+			}
+		}
+		if n := sum(got.Counts[ctx]); n != 500 {
+			t.Errorf("%d pulls in %+v, want 500", n, ctx)
+		}
+	}
+
+	if s, err := Train(contexts, nil, 10, 0.1); !errors.Is(err, errNoBandits) {
+		t.Errorf("Train() without bandits = %v, %v, want %v", s, err, errNoBandits)
+	}
+}
+
+func BenchmarkTrain(b *testing.B) {
+	rows := Simulate(SimulationConfig{Rows: 2000, Users: 50, Items: 20, Seed: 1})
+	contexts, bandits := buildBandits(rows, ContextOptions{}, defaultRewardConfig.Func())
+	captureLogs(b, slog.LevelWarn)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Train(contexts, bandits, 100, 0.1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestNormalizeRewards(t *testing.T) {
+	u2 := Context{UserID: "u2"}
+	newBandits := func() []*Bandit {
+		return []*Bandit{
+			{ItemID: "a", ContextRewards: map[Context]float64{testContext: 2.5, u2: -0.5}},
+			{ItemID: "b", ContextRewards: map[Context]float64{testContext: 0.4, u2: 1.5}},
+		}
+	}
+
+	tests := []struct {
+		how        string
+		wantA      map[Context]float64
+		wantB      map[Context]float64
+		wantErrMsg string
+	}{
+		{"", map[Context]float64{testContext: 2.5, u2: -0.5}, map[Context]float64{testContext: 0.4, u2: 1.5}, ""},
+		{normalizeClamp, map[Context]float64{testContext: 1, u2: 0}, map[Context]float64{testContext: 0.4, u2: 1}, ""},
+		{normalizeMinMax, map[Context]float64{testContext: 1, u2: 0}, map[Context]float64{testContext: 0.3, u2: 2.0 / 3}, ""},
+		{"log", nil, nil, `unknown reward normalization "log"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.how, func(t *testing.T) {
+			bandits := newBandits()
+			err := normalizeRewards(bandits, tt.how)
+			if tt.wantErrMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Errorf("normalizeRewards() error = %v, want %q", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range []map[Context]float64{tt.wantA, tt.wantB} {
+				for ctx, w := range want {
+					if got := bandits[i].ContextRewards[ctx]; math.Abs(got-w) > 1e-9 {
+						t.Errorf("reward of %s in %s = %v, want %v", bandits[i].ItemID, ctx.UserID, got, w)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAuthHint(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantHint bool
+	}{
+		{"unauthorized", &googleapi.Error{Code: http.StatusUnauthorized, Message: "Request had invalid authentication credentials"}, true},
+		{"forbidden", &googleapi.Error{Code: http.StatusForbidden, Message: "Access Denied"}, true},
+		{"unauthenticated", status.Error(codes.Unauthenticated, "missing credentials"), true},
+		{"no credentials", errors.New("bigquery: constructing client: google: could not find default credentials"), true},
+		{"not found", &googleapi.Error{Code: http.StatusNotFound, Message: "Not found: Table"}, false},
+		{"other", errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := trainModel(&fakeDataSource{err: tt.err}, TrainConfig{ModelFile: filepath.Join(t.TempDir(), "model.gob")})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("trainModel() error = %v, want it to wrap %v", err, tt.err)
+			}
+
+			err = authHint(err)
+			hinted := strings.Contains(err.Error(), "set GOOGLE_APPLICATION_CREDENTIALS") && strings.Contains(err.Error(), "gcloud auth")
+			if hinted != tt.wantHint {
+				t.Errorf("authHint() = %q, want the credentials hint: %v", err, tt.wantHint)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("authHint() = %v, want it to wrap %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestColdThresholdExploresUnderSampledItems(t *testing.T) {
+	s := newTestStrategy("a", "b", "c", "d")
+	s.Epsilon = 1
+	s.ColdThreshold = 5
+	for i := 0; i < 20; i++ {
+		s.UpdateReward(testContext, s.Bandits[0], 1)
+		s.UpdateReward(testContext, s.Bandits[1], 0.5)
+	}
+	s.UpdateReward(testContext, s.Bandits[2], 0)
+	s.UpdateReward(testContext, s.Bandits[2], 0)
+
+	shares := selectionShares(t, s, s.Bandits, testContext, 4000)
+	if shares[0] != 0 || shares[1] != 0 {
+		t.Errorf("well sampled a and b explored %.3f and %.3f of the time, want never", shares[0], shares[1])
+	}
+	if math.Abs(shares[2]-0.5) > 0.03 || math.Abs(shares[3]-0.5) > 0.03 {
+		t.Errorf("under-sampled c and d explored %.3f and %.3f of the time, want half each", shares[2], shares[3])
+	}
+
+	// once every item is well sampled, exploration picks among all of them
+	for i := 0; i < 5; i++ {
+		s.UpdateReward(testContext, s.Bandits[2], 0)
+		s.UpdateReward(testContext, s.Bandits[3], 0)
+	}
+	for i, share := range selectionShares(t, s, s.Bandits, testContext, 4000) {
+		if math.Abs(share-0.25) > 0.03 {
+			t.Errorf("%s explored %.3f of the time with every item well sampled, want 0.25", s.Bandits[i].ItemID, share)
+		}
+	}
+}
+
+func TestVariance(t *testing.T) {
+	s := newTestStrategy("risky", "steady", "once")
+	s.InitialReward = 10 // isn't a reward, so doesn't count in the variance
+	for _, r := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		s.UpdateReward(testContext, s.Bandits[0], r)
+		s.UpdateReward(testContext, s.Bandits[1], 5)
+	}
+	s.UpdateReward(testContext, s.Bandits[2], 3)
+	s, _ = saveAndLoad(t, s)
+
+	tests := []struct {
+		itemID   string
+		variance float64
+		n        int
+	}{
+		{"risky", 32.0 / 7, 8},
+		{"steady", 0, 8},
+		{"once", 0, 1},
+		{"unknown", 0, 0},
+	}
+	for _, tt := range tests {
+		variance, n := s.Variance(testContext, tt.itemID)
+		if math.Abs(variance-tt.variance) > 1e-9 || n != tt.n {
+			t.Errorf("Variance(%s) = %v, %d, want %v, %d", tt.itemID, variance, n, tt.variance, tt.n)
+		}
+	}
+	if mean, _ := s.Confidence(testContext, "risky"); math.Abs(mean-5) > 1e-9 {
+		t.Errorf("mean of risky = %v, want 5", mean)
+	}
+}
+
+func TestTrainStrategyWorkers(t *testing.T) {
+	rows := Simulate(SimulationConfig{Rows: 500, Users: 20, Items: 5, Seed: 1})
+	contexts, bandits := buildBandits(rows, ContextOptions{}, defaultRewardConfig.Func())
+
+	train := func(workers int) *EpsilonGreedyStrategy {
+		s := strategies["epsilon"](bandits).(*EpsilonGreedyStrategy)
+		s.Seed(1)
+		err := trainStrategy(s, contexts, 200, 0, 0, workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	one, many := train(1), train(8)
+
+	if len(many.Rewards) != len(contexts) {
+		t.Fatalf("trained %d contexts, want %d", len(many.Rewards), len(contexts))
+	}
+	for _, ctx := range contexts {
+		if n := sum(many.Counts[ctx]); n != 200 {
+			t.Errorf("%d pulls in %+v, want 200", n, ctx)
+		}
+		// the pulls always give the same reward, so any order learns it
+		for i := range bandits {
+			if many.Counts[ctx][i] > 0 && one.Counts[ctx][i] > 0 && math.Abs(many.Rewards[ctx][i]-one.Rewards[ctx][i]) > 1e-9 {
+				t.Errorf("reward of %s in %+v = %v with 8 workers, %v with 1", bandits[i].ItemID, ctx, many.Rewards[ctx][i], one.Rewards[ctx][i])
+			}
+		}
+	}
+}
+
+func BenchmarkTrainStrategyWorkers(b *testing.B) {
+	rows := Simulate(SimulationConfig{Rows: 2000, Users: 50, Items: 20, Seed: 1})
+	contexts, bandits := buildBandits(rows, ContextOptions{}, defaultRewardConfig.Func())
+	captureLogs(b, slog.LevelWarn)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s := strategies["epsilon"](bandits).(*EpsilonGreedyStrategy)
+				err := trainStrategy(s, contexts, 100, 0, 0, workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestNonFiniteRewardsAreSkipped(t *testing.T) {
+	logs := captureLogs(t, slog.LevelWarn)
+	s := newTestStrategy("a", "b")
+	s.UpdateReward(testContext, s.Bandits[0], 0.5)
+
+	for _, reward := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		s.UpdateReward(testContext, s.Bandits[0], reward)
+	}
+
+	mean, n := s.Confidence(testContext, "a")
+	if mean != 0.5 || n != 1 {
+		t.Errorf("estimate of a = %v from %d rewards, want 0.5 from 1, unchanged", mean, n)
+	}
+	if got := len(logRecords(t, logs, "Skipping reward update with a reward that isn't a number")); got != 3 {
+		t.Errorf("%d warnings, want one for every reward that isn't a number", got)
+	}
+	if _, err := s.SelectBandit(testContext); err != nil {
+		t.Errorf("SelectBandit() error = %v", err)
+	}
+}
+
+func TestAdaptiveEpsilonExploresWellSampledContextsLess(t *testing.T) {
+	well, thin := Context{UserID: "well"}, Context{UserID: "thin"}
+
+	// exploreShare returns how often selections in ctx explore.
+	exploreShare := func(s *EpsilonGreedyStrategy, ctx Context) float64 {
+		explored := 0
+		for i := 0; i < 5000; i++ {
+			_, e, err := s.SelectBanditWithInfo(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e {
+				explored++
+			}
+		}
+		return float64(explored) / 5000
+	}
+	train := func(adaptive int) *EpsilonGreedyStrategy {
+		s := newTestStrategy("a", "b")
+		s.Epsilon = 0.5
+		s.AdaptiveEpsilon = adaptive
+		for i := 0; i < 500; i++ {
+			s.UpdateReward(well, s.Bandits[0], 1)
+			s.UpdateReward(well, s.Bandits[1], 0)
+		}
+		s.UpdateReward(thin, s.Bandits[0], 1)
+		s.UpdateReward(thin, s.Bandits[1], 0)
+		return s
+	}
+
+	s := train(10)
+	// 0.5*10/(10+1000) and 0.5*10/(10+2)
+	wellShare, thinShare := exploreShare(s, well), exploreShare(s, thin)
+	if wellShare > 0.02 || math.Abs(thinShare-0.5*10/12) > 0.03 {
+		t.Errorf("explored %.3f of the well sampled and %.3f of the thin context, want about 0.005 and 0.417", wellShare, thinShare)
+	}
+
+	s = train(0)
+	for _, ctx := range []Context{well, thin} {
+		if share := exploreShare(s, ctx); math.Abs(share-0.5) > 0.03 {
+			t.Errorf("explored %.3f of %s without -adaptive-epsilon, want Epsilon 0.5", share, ctx.UserID)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Merge adds what the other model learned to this one, e.g. to combine
+// models trained per region into a global one. Bandits are matched by their
+// ItemID and those only in the other model are added. In the contexts of
+// both, the rewards of a bandit are averaged weighted by their counts and the
+// counts summed. Contexts only in the other model are copied. Both models
+// must key their contexts the same way.
+func (s *EpsilonGreedyStrategy) Merge(other *EpsilonGreedyStrategy) error {
+	if s == other {
+		return errors.New("can't merge a model with itself")
+	}
+
+	// Copy the other model under its own lock before taking this one's, so
+	// two models merged into each other at once can't deadlock
+	other.mu.RLock()
+	theirs := other.clone()
+	otherBandits := slices.Clone(other.Bandits) // to tell the bandits both share
+	other.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.HashBuckets != theirs.HashBuckets || s.IgnoreUser != theirs.IgnoreUser {
+		return errors.New("the models key their contexts differently, with other -hash-buckets or -ignore-user")
+	}
+	// Check both before changing anything, so a failed merge leaves this
+	// model as it was
+	for ctx := range theirs.Rewards {
+		err := theirs.checkAligned(ctx)
+		if err != nil {
+			return err
+		}
+		err = s.checkAligned(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The popularity of the bandits in both is weighted by their counts too,
+	// taken before the counts are summed
+	ownPulls, otherPulls := s.pulls(), theirs.pulls()
+	hadPopularity := len(s.Popularity) == len(s.Bandits)
+
+	// positions[j] is the index in s.Bandits of theirs.Bandits[j]
+	positions := make([]int, len(theirs.Bandits))
+	for j, ob := range theirs.Bandits {
+		i := s.position(ob.ItemID)
+		if i < 0 {
+			s.addBandit(&Bandit{ItemID: ob.ItemID, ContextRewards: maps.Clone(ob.ContextRewards)})
+			positions[j] = len(s.Bandits) - 1
+			continue
+		}
+		positions[j] = i
+		if b := s.Bandits[i]; b != otherBandits[j] {
+			// the training data rewards add up, see buildBandits
+			if b.ContextRewards == nil {
+				b.ContextRewards = make(map[Context]float64)
+			}
+			for ctx, r := range ob.ContextRewards {
+				b.ContextRewards[ctx] += r
+			}
+		}
+	}
+
+	if len(theirs.Popularity) == len(theirs.Bandits) {
+		if len(s.Popularity) != len(s.Bandits) {
+			s.Popularity = make([]float64, len(s.Bandits))
+		}
+		for j, i := range positions {
+			n1, n2 := 0, otherPulls[j]
+			if hadPopularity && i < len(ownPulls) {
+				n1 = ownPulls[i]
+			}
+			switch {
+			case n1+n2 > 0:
+				s.Popularity[i] = (s.Popularity[i]*float64(n1) + theirs.Popularity[j]*float64(n2)) / float64(n1+n2)
+			case !hadPopularity || i >= len(ownPulls):
+				s.Popularity[i] = theirs.Popularity[j]
+			}
+		}
+	}
+
+	if s.SquaredDeviations == nil {
+		s.SquaredDeviations = make(map[Context][]float64)
+	}
+	for ctx, rewards := range theirs.Rewards {
+		if _, ok := s.Rewards[ctx]; !ok {
+			s.initContext(ctx)
+		}
+		if len(s.SquaredDeviations[ctx]) != len(s.Bandits) {
+			s.SquaredDeviations[ctx] = make([]float64, len(s.Bandits))
+		}
+
+		for j, i := range positions {
+			n1, n2 := s.Counts[ctx][i], theirs.Counts[ctx][j]
+			if n2 == 0 {
+				continue
+			}
+			m1, m2 := s.Rewards[ctx][i], rewards[j]
+			n := n1 + n2
+			// Chan et al.'s parallel update of the squared deviations
+			d := m2 - m1
+			deviations := s.SquaredDeviations[ctx][i] + theirs.squaredDeviation(ctx, j)
+			if n1 > 0 {
+				deviations += d * d * float64(n1) * float64(n2) / float64(n)
+			}
+			s.Rewards[ctx][i] = (m1*float64(n1) + m2*float64(n2)) / float64(n)
+			s.Counts[ctx][i] = n
+			s.SquaredDeviations[ctx][i] = deviations
+		}
+
+		if updated, ok := theirs.LastUpdated[ctx]; ok && updated.After(s.LastUpdated[ctx]) {
+			if s.LastUpdated == nil {
+				s.LastUpdated = make(map[Context]time.Time)
+			}
+			s.LastUpdated[ctx] = updated
+		}
+	}
+
+	s.CumulativeRegret += theirs.CumulativeRegret
+	s.lru = nil // the copied contexts aren't in it
+	s.evictContexts()
+	s.metadata.Rows += theirs.metadata.Rows
+	s.metadata.Bandits = len(s.Bandits)
+	return nil
+}
+
+// position returns the index of the bandit with the ItemID in Bandits, or -1
+// if there is none. Call with the lock held.
+func (s *EpsilonGreedyStrategy) position(itemID string) int {
+	for i, b := range s.Bandits {
+		if b.ItemID == itemID {
+			return i
+		}
+	}
+	return -1
+}
+
+// pulls returns the counts of every bandit summed over all contexts, index
+// aligned with Bandits. Call with the lock held.
+func (s *EpsilonGreedyStrategy) pulls() []int {
+	pulls := make([]int, len(s.Bandits))
+	for ctx, counts := range s.Counts {
+		if s.checkAligned(ctx) != nil {
+			continue
+		}
+		for i, n := range counts {
+			pulls[i] += n
+		}
+	}
+	return pulls
+}
+
+// mergeModels merges the models in the files into the model in filename, and
+// saves it back.
+func mergeModels(filename string, others []string, seed int64) error {
+	slog.Info("Loading model", "file", filename)
+	s, err := loadModel(filename, seed)
+	if err != nil {
+		return err
+	}
+
+	for _, other := range others {
+		slog.Info("Merging model", "file", other)
+		o, err := loadModel(other, seed)
+		if err != nil {
+			return err
+		}
+		err = s.Merge(o)
+		if err != nil {
+			return fmt.Errorf("could not merge %s: %w", other, err)
+		}
+	}
+	slog.Info("Merged models", "bandits", len(s.Bandits), "contexts", len(s.Rewards))
+
+	slog.Info("Saving model", "file", filename)
+	return s.SaveState(filename)
+}
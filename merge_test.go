@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	eu, us := newTestStrategy("a", "b"), newTestStrategy("b", "c")
+	euOnly, usOnly := Context{UserID: "eu"}, Context{UserID: "us"}
+	for _, r := range []float64{1, 1, 0} {
+		eu.UpdateReward(testContext, eu.Bandits[0], r)
+	}
+	eu.UpdateReward(testContext, eu.Bandits[1], 0.5)
+	eu.UpdateReward(euOnly, eu.Bandits[0], 0.4)
+	for i := 0; i < 3; i++ {
+		us.UpdateReward(testContext, us.Bandits[0], 1)
+	}
+	us.UpdateReward(testContext, us.Bandits[1], 0.2)
+	us.UpdateReward(usOnly, us.Bandits[1], 1)
+
+	dir := t.TempDir()
+	euFile, usFile := filepath.Join(dir, "eu.gob"), filepath.Join(dir, "us.gob")
+	if err := eu.SaveState(euFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.SaveState(usFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := mergeModels(euFile, []string{usFile}, 1); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := loadModel(euFile, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := itemIDs(merged.Bandits); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Fatalf("bandits = %v, want a, b and c", got)
+	}
+	tests := []struct {
+		ctx    Context
+		itemID string
+		mean   float64
+		n      int
+	}{
+		{testContext, "a", 2.0 / 3, 3},
+		{testContext, "b", (0.5*1 + 1*3) / 4.0, 4},
+		{testContext, "c", 0.2, 1},
+		{euOnly, "a", 0.4, 1},
+		{usOnly, "a", 0, 0},
+		{usOnly, "c", 1, 1},
+	}
+	for _, tt := range tests {
+		mean, n := merged.Confidence(tt.ctx, tt.itemID)
+		if math.Abs(mean-tt.mean) > 1e-9 || n != tt.n {
+			t.Errorf("%s in %s = %v from %d rewards, want %v from %d", tt.itemID, tt.ctx.UserID, mean, n, tt.mean, tt.n)
+		}
+	}
+	// the variance is that of the rewards of both, 0.5, 1, 1 and 1
+	if variance, _ := merged.Variance(testContext, "b"); math.Abs(variance-0.0625) > 1e-9 {
+		t.Errorf("variance of b = %v, want 0.0625", variance)
+	}
+	checkAlignedContexts(t, merged)
+
+	if err := merged.Merge(merged); err == nil {
+		t.Error("Merge() of a model with itself succeeded, want an error")
+	}
+	hashed := newTestStrategy("a")
+	hashed.HashBuckets = 4
+	if err := merged.Merge(hashed); err == nil {
+		t.Error("Merge() of a model with hashed contexts succeeded, want an error")
+	}
+}
+
+func TestMergeEachOtherAtOnce(t *testing.T) {
+	a, b := newTestStrategy("x", "y"), newTestStrategy("x", "y")
+	a.UpdateReward(testContext, a.Bandits[0], 1)
+	b.UpdateReward(testContext, b.Bandits[1], 1)
+
+	// with both locks taken in turn, this deadlocks
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- a.Merge(b) }()
+		go func() { done <- b.Merge(a) }()
+		for j := 0; j < 2; j++ {
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("merging two models into each other at once deadlocked")
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are the Prometheus metrics of the serving path. They live in their
+// own registry so every server starts from zero.
+type metrics struct {
+	registry        *prometheus.Registry
+	recommendations *prometheus.CounterVec
+	selections      *prometheus.CounterVec
+	rewardUpdates   *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		recommendations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smokey_recommendations_total",
+			Help: "Number of times each item was recommended.",
+		}, []string{"model", "item_id"}),
+		selections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smokey_selections_total",
+			Help: "Number of selections that explored, exploited or fell back to the default item.",
+		}, []string{"model", "mode"}),
+		rewardUpdates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smokey_reward_updates_total",
+			Help: "Number of rewards received.",
+		}, []string{"model"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "smokey_request_duration_seconds",
+			Help:    "Latency of the HTTP requests.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"path"}),
+	}
+	m.registry.MustRegister(
+		m.recommendations,
+		m.selections,
+		m.rewardUpdates,
+		m.requestDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// recommended records that the model recommended the item after exploring or
+// exploiting.
+func (m *metrics) recommended(model string, b *Bandit, explored bool) {
+	m.recommendations.WithLabelValues(model, b.ItemID).Inc()
+	mode := "exploit"
+	if explored {
+		mode = "explore"
+	}
+	m.selections.WithLabelValues(model, mode).Inc()
+}
+
+// recommendedDefault records a recommendation of the default item.
+func (m *metrics) recommendedDefault(model string, itemID string) {
+	m.recommendations.WithLabelValues(model, itemID).Inc()
+	m.selections.WithLabelValues(model, "default").Inc()
+}
+
+// instrument records the latency of the requests to a handler.
+func (m *metrics) instrument(path string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h(w, r)
+		m.requestDuration.WithLabelValues(path).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// withProfiles runs f, writing a CPU profile of it to cpuFile and a heap
+// profile after it to memFile, unless they are empty. The profiles are
+// written even if f fails, to find out what it was doing.
+func withProfiles(cpuFile, memFile string, f func() error) (err error) {
+	if cpuFile != "" {
+		var file *os.File
+		file, err = os.Create(cpuFile)
+		if err != nil {
+			return fmt.Errorf("could not create the CPU profile: %w", err)
+		}
+		err = pprof.StartCPUProfile(file)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("could not start the CPU profile: %w", err)
+		}
+		defer func() {
+			pprof.StopCPUProfile()
+			closeErr := file.Close()
+			if closeErr != nil {
+				err = errors.Join(err, fmt.Errorf("could not write the CPU profile: %w", closeErr))
+				return
+			}
+			slog.Info("Wrote CPU profile", "file", cpuFile)
+		}()
+	}
+
+	err = f()
+
+	if memFile != "" {
+		err = errors.Join(err, writeHeapProfile(memFile))
+	}
+	return err
+}
+
+func writeHeapProfile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("could not create the memory profile: %w", err)
+	}
+	defer file.Close()
+
+	runtime.GC() // so the profile shows the live heap after the run
+	err = pprof.WriteHeapProfile(file)
+	if err != nil {
+		return fmt.Errorf("could not write the memory profile: %w", err)
+	}
+	slog.Info("Wrote memory profile", "file", filename)
+	return file.Close()
+}
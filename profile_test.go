@@ -0,0 +1,48 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithProfiles(t *testing.T) {
+	captureLogs(t, slog.LevelWarn)
+	dir := t.TempDir()
+	cpuFile, memFile := filepath.Join(dir, "cpu.pprof"), filepath.Join(dir, "mem.pprof")
+
+	errTraining := errors.New("training failed")
+	err := withProfiles(cpuFile, memFile, func() error {
+		source := &CSVDataSource{Path: "testdata/training.csv"}
+		cfg := TrainConfig{ModelFile: filepath.Join(dir, "strategy.gob"), Iterations: 1000, Seed: 1}
+		if err := trainModel(source, cfg); err != nil {
+			return err
+		}
+		return errTraining
+	})
+	if !errors.Is(err, errTraining) {
+		t.Fatalf("withProfiles() error = %v, want the error of training", err)
+	}
+
+	// the profiles are written even though training failed
+	for _, filename := range []string{cpuFile, memFile} {
+		file, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		// pprof writes gzipped protocol buffers
+		r, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(filename), err)
+		}
+		n, err := io.Copy(io.Discard, r)
+		if err != nil || n == 0 {
+			t.Errorf("%s: read %d bytes, error = %v, want a profile", filepath.Base(filename), n, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// PruneOlderThan forgets the contexts that haven't had a reward for longer
+// than d, e.g. to not keep the data of users that have left, and returns how
+// many it forgot. Contexts from models saved before LastUpdated was kept
+// count as updated when the model was trained, and are kept if that isn't
+// known either.
+func (s *EpsilonGreedyStrategy) PruneOlderThan(d time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-d)
+	pruned := 0
+	for ctx := range s.Rewards {
+		updated, ok := s.LastUpdated[ctx]
+		if !ok {
+			updated = s.metadata.TrainedAt
+		}
+		if updated.IsZero() || !updated.Before(cutoff) {
+			continue
+		}
+		delete(s.Rewards, ctx)
+		delete(s.Counts, ctx)
+		delete(s.LastUpdated, ctx)
+		delete(s.SquaredDeviations, ctx)
+		pruned++
+	}
+	return pruned
+}
+
+// pruneModel forgets the contexts of the model in the file that haven't had
+// a reward for longer than d, and saves it back.
+func pruneModel(filename string, d time.Duration, seed int64) error {
+	slog.Info("Loading model", "file", filename)
+	s, err := loadModel(filename, seed)
+	if err != nil {
+		return err
+	}
+
+	pruned := s.PruneOlderThan(d)
+	slog.Info("Pruned contexts", "pruned", pruned, "kept", len(s.Rewards), "older_than", d)
+
+	slog.Info("Saving model", "file", filename)
+	return s.SaveState(filename)
+}
+
+// ForgetUser forgets everything learned from the user: the contexts of the
+// user and the rewards of the bandits in them from the training data. It
+// returns how many contexts it forgot. What the user added to contexts shared
+// by all users, like the Popularity, can't be told apart and is kept. A model
+// with HashBuckets or IgnoreUser can't tell the contexts of the user apart at
+// all, so it returns an error wrapping errUserBlended rather than report the
+// user forgotten.
+func (s *EpsilonGreedyStrategy) ForgetUser(userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.checkForgettable()
+	if err != nil {
+		return 0, err
+	}
+	if userID == "" {
+		return 0, errors.New("no user given")
+	}
+
+	forgotten := 0
+	for ctx := range s.Rewards {
+		if ctx.UserID != userID {
+			continue
+		}
+		delete(s.Rewards, ctx)
+		delete(s.Counts, ctx)
+		delete(s.SquaredDeviations, ctx)
+		forgotten++
+	}
+	for ctx := range s.LastUpdated {
+		if ctx.UserID == userID {
+			delete(s.LastUpdated, ctx)
+		}
+	}
+	for _, b := range s.Bandits {
+		for ctx := range b.ContextRewards {
+			if ctx.UserID == userID {
+				delete(b.ContextRewards, ctx)
+			}
+		}
+	}
+	return forgotten, nil
+}
+
+// errUserBlended is returned when a model blends the rewards of a user into
+// contexts shared with other users, so it can't forget them.
+var errUserBlended = errors.New("the rewards of a user are blended with those of others")
+
+// checkForgettable returns an error wrapping errUserBlended if the model
+// can't tell the contexts of a user apart. Call with the lock held.
+func (s *EpsilonGreedyStrategy) checkForgettable() error {
+	switch {
+	case s.HashBuckets > 0:
+		return fmt.Errorf("%w, as the contexts are hashed into buckets", errUserBlended)
+	case s.IgnoreUser:
+		return fmt.Errorf("%w, as the contexts are shared by all users", errUserBlended)
+	}
+	return nil
+}
+
+// forgetUser forgets the user in the model in the file and saves it back.
+func forgetUser(filename string, userID string, seed int64) error {
+	slog.Info("Loading model", "file", filename)
+	s, err := loadModel(filename, seed)
+	if err != nil {
+		return err
+	}
+
+	forgotten, err := s.ForgetUser(userID)
+	if err != nil {
+		return fmt.Errorf("could not forget user %s: %w", userID, err)
+	}
+	slog.Info("Forgot user", "user", userID, "contexts", forgotten)
+
+	slog.Info("Saving model", "file", filename)
+	return s.SaveState(filename)
+}
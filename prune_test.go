@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPruneOlderThan(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	stale, fresh, legacy := Context{UserID: "stale"}, Context{UserID: "fresh"}, Context{UserID: "legacy"}
+	s.UpdateReward(stale, s.Bandits[0], 1)
+	s.UpdateReward(fresh, s.Bandits[1], 1)
+	s.UpdateReward(legacy, s.Bandits[1], 1)
+	s.LastUpdated[stale] = time.Now().Add(-48 * time.Hour)
+	delete(s.LastUpdated, legacy) // from a model saved before LastUpdated was kept
+
+	filename := filepath.Join(t.TempDir(), "strategy.gob")
+	if err := s.SaveState(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := pruneModel(filename, 24*time.Hour, 1); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadModel(filename, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.Rewards[stale]; ok {
+		t.Error("the stale context is still in Rewards")
+	}
+	if _, ok := s.Counts[stale]; ok {
+		t.Error("the stale context is still in Counts")
+	}
+	if _, ok := s.LastUpdated[stale]; ok {
+		t.Error("the stale context is still in LastUpdated")
+	}
+	for _, ctx := range []Context{fresh, legacy} {
+		if _, ok := s.Rewards[ctx]; !ok {
+			t.Errorf("the %s context was pruned, want it kept", ctx.UserID)
+		}
+	}
+
+	// without LastUpdated a context counts as updated when it was trained
+	s.metadata.TrainedAt = time.Now().Add(-72 * time.Hour)
+	if n := s.PruneOlderThan(24 * time.Hour); n != 1 {
+		t.Errorf("pruned %d contexts, want the 1 trained too long ago", n)
+	}
+	if _, ok := s.Rewards[fresh]; !ok || len(s.Rewards) != 1 {
+		t.Errorf("contexts left = %d, want only the fresh one", len(s.Rewards))
+	}
+}
+
+func TestForgetUser(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	u1Evening := Context{UserID: "u1", TimeOfDay: "evening", Weekday: "friday", Device: "desktop"}
+	u2 := Context{UserID: "u2", TimeOfDay: "morning", Weekday: "monday", Device: "mobile"}
+	for _, ctx := range []Context{testContext, u1Evening, u2} {
+		s.Bandits[0].ContextRewards[ctx] = 1
+		s.UpdateReward(ctx, s.Bandits[0], 1)
+	}
+
+	filename := filepath.Join(t.TempDir(), "strategy.gob")
+	if err := s.SaveState(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := forgetUser(filename, "u1", 1); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadModel(filename, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ctx := range []Context{testContext, u1Evening} {
+		_, inRewards := s.Rewards[ctx]
+		_, inCounts := s.Counts[ctx]
+		_, inLastUpdated := s.LastUpdated[ctx]
+		_, inBandit := s.Bandits[0].ContextRewards[ctx]
+		if inRewards || inCounts || inLastUpdated || inBandit {
+			t.Errorf("a context of u1 is left: rewards %v, counts %v, last updated %v, bandit %v", inRewards, inCounts, inLastUpdated, inBandit)
+		}
+	}
+	if len(s.Rewards) != 1 || s.Counts[u2][0] != 1 || s.Bandits[0].ContextRewards[u2] != 1 {
+		t.Errorf("Rewards = %v, want only the context of u2 left as it was", s.Rewards)
+	}
+
+	if err := forgetUser(filename, "", 1); err == nil {
+		t.Error("forgetUser() without a user succeeded, want an error")
+	}
+	s.HashBuckets = 8
+	if _, err := s.ForgetUser("u2"); !errors.Is(err, errUserBlended) {
+		t.Errorf("ForgetUser() with hashed contexts error = %v, want %v", err, errUserBlended)
+	}
+	s.HashBuckets = 0
+	s.IgnoreUser = true
+	if _, err := s.ForgetUser("u2"); !errors.Is(err, errUserBlended) {
+		t.Errorf("ForgetUser() with contexts shared by all users error = %v, want %v", err, errUserBlended)
+	}
+	if err := s.SaveState(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := forgetUser(filename, "u2", 1); !errors.Is(err, errUserBlended) {
+		t.Errorf("forgetUser() of a model with contexts shared by all users error = %v, want %v", err, errUserBlended)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitIdle is how long a client can go without requests before its
+// token bucket is dropped, so clients that come and go don't pile up.
+const rateLimitIdle = 3 * time.Minute
+
+// ipRateLimiter limits the requests of every client IP with a token bucket.
+type ipRateLimiter struct {
+	limit   rate.Limit
+	burst   int
+	proxies []netip.Prefix // trusted to set X-Forwarded-For, see clientIP
+
+	mu        sync.Mutex
+	clients   map[string]*rateLimitedClient
+	lastSweep time.Time
+}
+
+type rateLimitedClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newIPRateLimiter allows every client IP perSecond requests per second, in
+// bursts of up to as many requests. Requests through the proxies are limited
+// by the client IP they forward.
+func newIPRateLimiter(perSecond float64, proxies []netip.Prefix) *ipRateLimiter {
+	return &ipRateLimiter{
+		limit:     rate.Limit(perSecond),
+		burst:     max(1, int(math.Ceil(perSecond))),
+		proxies:   proxies,
+		clients:   make(map[string]*rateLimitedClient),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow reports whether the client IP may make another request now.
+func (l *ipRateLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > rateLimitIdle {
+		for key, c := range l.clients {
+			if now.Sub(c.lastSeen) > rateLimitIdle {
+				delete(l.clients, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &rateLimitedClient{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = c
+	}
+	c.lastSeen = now
+	return c.limiter.AllowN(now, 1)
+}
+
+// wrap responds 429 Too Many Requests instead of calling h when the client
+// has made too many requests.
+func (l *ipRateLimiter) wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !l.allow(clientIP(r, l.proxies)) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, "too many requests")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// clientIP returns the IP the request came from. When that is one of the
+// trusted proxies, it is the IP the proxy forwarded in X-Forwarded-For
+// instead. Clients can set X-Forwarded-For themselves, so the entries are
+// read from the last one, which the nearest proxy appended, and the first one
+// not from a trusted proxy is the client.
+func clientIP(r *http.Request, proxies []netip.Prefix) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && trusted(ip, proxies); i-- {
+		next := strings.TrimSpace(forwarded[i])
+		if next == "" {
+			break
+		}
+		ip = next
+	}
+	return ip
+}
+
+// trusted reports whether the IP is in one of the prefixes.
+func trusted(ip string, proxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a list like "10.0.0.0/8,192.168.1.1" of IPs and
+// networks in CIDR notation.
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if strings.Contains(part, "/") {
+			p, err := netip.ParsePrefix(part)
+			if err != nil {
+				return nil, fmt.Errorf("proxy %q is not an IP or network", part)
+			}
+			proxies = append(proxies, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(part)
+		if err != nil {
+			return nil, fmt.Errorf("proxy %q is not an IP or network", part)
+		}
+		addr = addr.Unmap()
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestRateLimit(t *testing.T) {
+	srv := newTestServer(t, newTestStrategy("a", "b"))
+	srv.limiter = newIPRateLimiter(2, nil)
+	h := srv.routes()
+
+	send := func(target, body, remoteAddr string) *httptest.ResponseRecorder {
+		method := http.MethodGet
+		if body != "" {
+			method = http.MethodPost
+		}
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// a burst of 2 requests per second, shared by the limited endpoints
+	if w := send("/recommend?user=u1", "", "192.0.2.1:1234"); w.Code != http.StatusOK {
+		t.Fatalf("first request status = %d, want %d", w.Code, http.StatusOK)
+	}
+	reward := `{"user": "u1", "item_id": "a", "reward": 1}`
+	if w := send("/reward", reward, "192.0.2.1:1235"); w.Code != http.StatusNoContent {
+		t.Fatalf("second request status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	for _, target := range []string{"/recommend?user=u1", "/reward"} {
+		body := ""
+		if target == "/reward" {
+			body = reward
+		}
+		w := send(target, body, "192.0.2.1:1236")
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("%s over the limit status = %d, want %d", target, w.Code, http.StatusTooManyRequests)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s over the limit has no Retry-After", target)
+		}
+	}
+
+	if w := send("/recommend?user=u1", "", "192.0.2.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("another client's status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := send("/healthz", "", "192.0.2.1:1234"); w.Code != http.StatusOK {
+		t.Errorf("/healthz status = %d, want it not limited", w.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8,192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "203.0.113.9", "192.0.2.1"}, // not a trusted proxy
+		{"10.1.2.3:1234", "203.0.113.9", "203.0.113.9"},
+		{"192.168.1.1:1234", "203.0.113.9, 10.0.0.5", "203.0.113.9"},
+		{"10.1.2.3:1234", "198.51.100.7, 203.0.113.9", "203.0.113.9"}, // the client set the first one
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/recommend", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := clientIP(r, proxies); got != tt.want {
+			t.Errorf("clientIP() from %s forwarding %q = %s, want %s", tt.remoteAddr, tt.forwarded, got, tt.want)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("parseTrustedProxies() of an invalid network succeeded, want an error")
+	}
+	if got, _ := parseTrustedProxies("::ffff:192.168.1.1"); len(got) != 1 || got[0] != netip.MustParsePrefix("192.168.1.1/32") {
+		t.Errorf("parseTrustedProxies() of a mapped IPv4 = %v, want 192.168.1.1/32", got)
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore keeps an EpsilonGreedyStrategy in Redis so several serving
+// instances can share one model. Every context has a hash of rewards and a
+// hash of counts keyed by item, and rewards are applied with a Lua script so
+// concurrent updates from different instances don't overwrite each other.
+//
+// Keys, all starting with Prefix:
+//
+//	strategy             hash with epsilon, epsilon_decay, min_epsilon, hash_buckets, ignore_user, min_samples, backoff, alpha, initial_reward, cold_threshold, smoothing, max_contexts, adaptive_epsilon, use_popularity, cumulative_regret
+//	bandits              list of item IDs, in the order of Bandits
+//	popularity           hash of item to its Popularity, for models with one
+//	bandit:<item>        hash of context to the reward of the item in the training data
+//	contexts             set of contexts with rewards
+//	rewards:<context>    hash of item to average reward, initial_reward for items without one
+//	counts:<context>     hash of item to number of rewards
+//	deviations:<context> hash of item to the sum of squared deviations of its rewards
+//	updated              hash of context to when it last got a reward, in Unix nanoseconds
+//
+// Contexts are encoded as JSON.
+type RedisStore struct {
+	client *redis.Client
+	Prefix string
+}
+
+func NewRedisStore(client *redis.Client, prefix string) *RedisStore {
+	return &RedisStore{client: client, Prefix: prefix}
+}
+
+func (st *RedisStore) key(parts ...string) string {
+	k := st.Prefix
+	for _, part := range parts {
+		k += ":" + part
+	}
+	return k
+}
+
+func contextKey(ctx Context) string {
+	b, _ := json.Marshal(ctx) // a struct of strings always marshals
+	return string(b)
+}
+
+// updateRewardScript does what UpdateReward does to a single reward, count,
+// regret and epsilon, atomically.
+//
+// KEYS: rewards, counts, strategy, contexts, updated, deviations
+// ARGV: item ID, reward, regret, context, time of the update
+var updateRewardScript = redis.NewScript(`
+local n = redis.call('HINCRBY', KEYS[2], ARGV[1], 1)
+local reward = tonumber(ARGV[2])
+local mean = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or redis.call('HGET', KEYS[3], 'initial_reward') or '0')
+local alpha = tonumber(redis.call('HGET', KEYS[3], 'alpha') or '0')
+local avg
+if alpha > 0 then
+	avg = (1 - alpha) * mean + alpha * reward
+else
+	avg = (mean * (n - 1) + reward) / n
+end
+redis.call('HSET', KEYS[1], ARGV[1], string.format('%.17g', avg))
+
+if n > 1 then
+	local dev = tonumber(redis.call('HGET', KEYS[6], ARGV[1]) or '0')
+	local d = reward - mean
+	if alpha > 0 then
+		dev = (1 - alpha) * (dev + alpha * d * d)
+	else
+		dev = dev + d * (reward - avg)
+	end
+	redis.call('HSET', KEYS[6], ARGV[1], string.format('%.17g', dev))
+end
+redis.call('HINCRBYFLOAT', KEYS[3], 'cumulative_regret', ARGV[3])
+redis.call('SADD', KEYS[4], ARGV[4])
+redis.call('HSET', KEYS[5], ARGV[4], ARGV[5])
+
+local decay = tonumber(redis.call('HGET', KEYS[3], 'epsilon_decay') or '0')
+if decay > 0 then
+	local epsilon = tonumber(redis.call('HGET', KEYS[3], 'epsilon') or '0')
+	local min = tonumber(redis.call('HGET', KEYS[3], 'min_epsilon') or '0')
+	redis.call('HSET', KEYS[3], 'epsilon', string.format('%.17g', math.max(epsilon * decay, min)))
+end
+return n
+`)
+
+// SaveStrategy replaces the model in Redis with the strategy.
+func (st *RedisStore) SaveStrategy(ctx context.Context, s *EpsilonGreedyStrategy) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stale, err := st.keys(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = st.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if len(stale) > 0 {
+			pipe.Del(ctx, stale...)
+		}
+
+		pipe.HSet(ctx, st.key("strategy"),
+			"epsilon", s.Epsilon,
+			"epsilon_decay", s.EpsilonDecay,
+			"min_epsilon", s.MinEpsilon,
+			"hash_buckets", s.HashBuckets,
+			"ignore_user", s.IgnoreUser,
+			"min_samples", s.MinSamples,
+			"backoff", strings.Join(s.Backoff, ","),
+			"alpha", s.Alpha,
+			"initial_reward", s.InitialReward,
+			"cold_threshold", s.ColdThreshold,
+			"smoothing", s.Smoothing,
+			"max_contexts", s.MaxContexts,
+			"adaptive_epsilon", s.AdaptiveEpsilon,
+			"use_popularity", s.UsePopularity,
+			"cumulative_regret", s.CumulativeRegret)
+
+		for i, b := range s.Bandits {
+			pipe.RPush(ctx, st.key("bandits"), b.ItemID)
+			if len(s.Popularity) == len(s.Bandits) {
+				pipe.HSet(ctx, st.key("popularity"), b.ItemID, s.Popularity[i])
+			}
+			for c, reward := range b.ContextRewards {
+				pipe.HSet(ctx, st.key("bandit", b.ItemID), contextKey(c), reward)
+			}
+		}
+
+		for c, rewards := range s.Rewards {
+			err := s.checkAligned(c)
+			if err != nil {
+				return err
+			}
+			pipe.SAdd(ctx, st.key("contexts"), contextKey(c))
+			for i, b := range s.Bandits {
+				pipe.HSet(ctx, st.key("rewards", contextKey(c)), b.ItemID, rewards[i])
+				pipe.HSet(ctx, st.key("counts", contextKey(c)), b.ItemID, s.Counts[c][i])
+				pipe.HSet(ctx, st.key("deviations", contextKey(c)), b.ItemID, s.squaredDeviation(c, i))
+			}
+		}
+		for c, updated := range s.LastUpdated {
+			pipe.HSet(ctx, st.key("updated"), contextKey(c), updated.UnixNano())
+		}
+		return nil
+	})
+	return err
+}
+
+// keys returns the keys of the model currently in Redis.
+func (st *RedisStore) keys(ctx context.Context) ([]string, error) {
+	keys := []string{st.key("strategy"), st.key("bandits"), st.key("popularity"), st.key("contexts"), st.key("updated")}
+
+	items, err := st.client.LRange(ctx, st.key("bandits"), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		keys = append(keys, st.key("bandit", item))
+	}
+
+	contexts, err := st.client.SMembers(ctx, st.key("contexts")).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range contexts {
+		keys = append(keys, st.key("rewards", c), st.key("counts", c), st.key("deviations", c))
+	}
+
+	return keys, nil
+}
+
+// LoadStrategy reads the model from Redis.
+func (st *RedisStore) LoadStrategy(ctx context.Context) (*EpsilonGreedyStrategy, error) {
+	fields, err := st.client.HGetAll(ctx, st.key("strategy")).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errNoModelStored
+	}
+
+	s := &EpsilonGreedyStrategy{
+		Rewards: make(map[Context][]float64),
+		Counts:  make(map[Context][]int),
+	}
+	s.Epsilon, _ = strconv.ParseFloat(fields["epsilon"], 64)
+	s.EpsilonDecay, _ = strconv.ParseFloat(fields["epsilon_decay"], 64)
+	s.MinEpsilon, _ = strconv.ParseFloat(fields["min_epsilon"], 64)
+	s.HashBuckets, _ = strconv.Atoi(fields["hash_buckets"])
+	s.IgnoreUser = fields["ignore_user"] == "1"
+	s.MinSamples, _ = strconv.Atoi(fields["min_samples"])
+	s.Alpha, _ = strconv.ParseFloat(fields["alpha"], 64)
+	s.InitialReward, _ = strconv.ParseFloat(fields["initial_reward"], 64)
+	s.ColdThreshold, _ = strconv.Atoi(fields["cold_threshold"])
+	s.Smoothing, _ = strconv.ParseFloat(fields["smoothing"], 64)
+	s.MaxContexts, _ = strconv.Atoi(fields["max_contexts"])
+	s.AdaptiveEpsilon, _ = strconv.Atoi(fields["adaptive_epsilon"])
+	s.UsePopularity = fields["use_popularity"] == "1"
+	if fields["backoff"] != "" {
+		s.Backoff = strings.Split(fields["backoff"], ",")
+	}
+	s.CumulativeRegret, _ = strconv.ParseFloat(fields["cumulative_regret"], 64)
+
+	items, err := st.client.LRange(ctx, st.key("bandits"), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		rewards, err := st.client.HGetAll(ctx, st.key("bandit", item)).Result()
+		if err != nil {
+			return nil, err
+		}
+		b := &Bandit{ItemID: item, ContextRewards: make(map[Context]float64, len(rewards))}
+		for k, v := range rewards {
+			c, err := parseContextKey(k)
+			if err != nil {
+				return nil, err
+			}
+			b.ContextRewards[c], _ = strconv.ParseFloat(v, 64)
+		}
+		s.Bandits = append(s.Bandits, b)
+	}
+
+	popularity, err := st.client.HGetAll(ctx, st.key("popularity")).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(popularity) > 0 {
+		s.Popularity = make([]float64, len(s.Bandits))
+		for i, b := range s.Bandits {
+			s.Popularity[i], _ = strconv.ParseFloat(popularity[b.ItemID], 64)
+		}
+	}
+
+	contexts, err := st.client.SMembers(ctx, st.key("contexts")).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range contexts {
+		c, err := parseContextKey(k)
+		if err != nil {
+			return nil, err
+		}
+		rewards, err := st.client.HGetAll(ctx, st.key("rewards", k)).Result()
+		if err != nil {
+			return nil, err
+		}
+		counts, err := st.client.HGetAll(ctx, st.key("counts", k)).Result()
+		if err != nil {
+			return nil, err
+		}
+		deviations, err := st.client.HGetAll(ctx, st.key("deviations", k)).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		s.initContext(c)
+		for i, b := range s.Bandits {
+			if reward, ok := rewards[b.ItemID]; ok {
+				s.Rewards[c][i], _ = strconv.ParseFloat(reward, 64)
+			}
+			s.Counts[c][i], _ = strconv.Atoi(counts[b.ItemID])
+		}
+		if len(deviations) > 0 {
+			if s.SquaredDeviations == nil {
+				s.SquaredDeviations = make(map[Context][]float64)
+			}
+			s.SquaredDeviations[c] = make([]float64, len(s.Bandits))
+			for i, b := range s.Bandits {
+				s.SquaredDeviations[c][i], _ = strconv.ParseFloat(deviations[b.ItemID], 64)
+			}
+		}
+	}
+
+	updated, err := st.client.HGetAll(ctx, st.key("updated")).Result()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range updated {
+		c, err := parseContextKey(k)
+		if err != nil {
+			return nil, err
+		}
+		nanos, _ := strconv.ParseInt(v, 10, 64)
+		if s.LastUpdated == nil {
+			s.LastUpdated = make(map[Context]time.Time)
+		}
+		s.LastUpdated[c] = time.Unix(0, nanos).UTC()
+	}
+
+	return s, nil
+}
+
+func parseContextKey(k string) (Context, error) {
+	var c Context
+	err := json.Unmarshal([]byte(k), &c)
+	if err != nil {
+		return Context{}, fmt.Errorf("invalid context %q: %w", k, err)
+	}
+	return c, nil
+}
+
+// persistUpdate applies a reward the strategy got through UpdateReward to
+// the model in Redis. It is applied to the shared model rather than copied
+// from the strategy, so rewards from other instances are kept.
+func (st *RedisStore) persistUpdate(ctx context.Context, s *EpsilonGreedyStrategy, c Context, b *Bandit, reward float64) error {
+	s.mu.RLock()
+	key := s.key(c)
+	bestReward := math.Inf(-1)
+	for _, other := range s.Bandits {
+		bestReward = math.Max(bestReward, other.Pull(c))
+	}
+	s.mu.RUnlock()
+
+	k := contextKey(key)
+	keys := []string{st.key("rewards", k), st.key("counts", k), st.key("strategy"), st.key("contexts"), st.key("updated"), st.key("deviations", k)}
+	return updateRewardScript.Run(ctx, st.client, keys, b.ItemID, reward, bestReward-reward, k, time.Now().UnixNano()).Err()
+}
+
+// forgetUser deletes the contexts of the user and the rewards of the bandits
+// in them from the model in Redis, in one transaction.
+func (st *RedisStore) forgetUser(ctx context.Context, userID string) error {
+	contexts, err := st.client.SMembers(ctx, st.key("contexts")).Result()
+	if err != nil {
+		return err
+	}
+	items, err := st.client.LRange(ctx, st.key("bandits"), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	banditContexts := map[string][]string{}
+	for _, item := range items {
+		keys, err := st.client.HKeys(ctx, st.key("bandit", item)).Result()
+		if err != nil {
+			return err
+		}
+		banditContexts[item] = keys
+	}
+
+	isUser := func(k string) bool {
+		c, err := parseContextKey(k)
+		return err == nil && c.UserID == userID
+	}
+	_, err = st.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, k := range contexts {
+			if !isUser(k) {
+				continue
+			}
+			pipe.Del(ctx, st.key("rewards", k), st.key("counts", k), st.key("deviations", k))
+			pipe.SRem(ctx, st.key("contexts"), k)
+			pipe.HDel(ctx, st.key("updated"), k)
+		}
+		for item, keys := range banditContexts {
+			for _, k := range keys {
+				if isUser(k) {
+					pipe.HDel(ctx, st.key("bandit", item), k)
+				}
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// loadSharedModel loads the model from Redis. The first instance to start
+// finds none and stores the model from the file for the others.
+func loadSharedModel(ctx context.Context, st *RedisStore, filename string, seed int64) (*EpsilonGreedyStrategy, error) {
+	s, err := st.LoadStrategy(ctx)
+	if err == nil {
+		slog.Info("Loaded shared model", "prefix", st.Prefix)
+		s.Seed(seed)
+		return s, nil
+	}
+	if !errors.Is(err, errNoModelStored) {
+		return nil, fmt.Errorf("could not load the shared model: %w", err)
+	}
+
+	slog.Info("Loading model", "file", filename)
+	s, err = loadModel(filename, seed)
+	if err != nil {
+		return nil, err
+	}
+	err = st.SaveStrategy(ctx, s)
+	if err != nil {
+		return nil, fmt.Errorf("could not store the shared model: %w", err)
+	}
+	slog.Info("Stored shared model", "prefix", st.Prefix)
+	return s, nil
+}
+
+// refresh replaces the learned state of the strategy with the shared model,
+// picking up the rewards other instances received.
+func (st *RedisStore) refresh(ctx context.Context, s *EpsilonGreedyStrategy) error {
+	shared, err := st.LoadStrategy(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(shared.Bandits) != len(s.Bandits) {
+		return fmt.Errorf("shared model has %d bandits, expected %d", len(shared.Bandits), len(s.Bandits))
+	}
+	for i, b := range shared.Bandits {
+		if b.ItemID != s.Bandits[i].ItemID {
+			return fmt.Errorf("shared model has item %s where %s was expected", b.ItemID, s.Bandits[i].ItemID)
+		}
+	}
+	s.Epsilon = shared.Epsilon
+	s.Rewards = shared.Rewards
+	s.Counts = shared.Counts
+	s.LastUpdated = shared.LastUpdated
+	s.SquaredDeviations = shared.SquaredDeviations
+	s.CumulativeRegret = shared.CumulativeRegret
+	s.lru = nil // rebuilt from the shared LastUpdated
+
+	return nil
+}
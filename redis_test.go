@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisAddrEnv is the address of a Redis server to test against. The Redis
+// tests are skipped without one.
+const redisAddrEnv = "SMOKEY_TEST_REDIS_ADDR"
+
+// newTestRedisStore returns a store under a prefix of the test's own in the
+// Redis server at redisAddrEnv, deleting its keys when the test ends.
+func newTestRedisStore(t *testing.T) *RedisStore {
+	t.Helper()
+
+	addr := os.Getenv(redisAddrEnv)
+	if addr == "" {
+		t.Skip(redisAddrEnv + " is not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+
+	st := NewRedisStore(client, "smokey-test:"+t.Name())
+	t.Cleanup(func() {
+		keys, err := st.keys(context.Background())
+		if err == nil {
+			err = client.Del(context.Background(), keys...).Err()
+		}
+		if err != nil {
+			t.Errorf("could not delete the test keys: %v", err)
+		}
+	})
+	return st
+}
+
+func TestRedisStore(t *testing.T) {
+	st := newTestRedisStore(t)
+	ctx := context.Background()
+
+	_, err := st.LoadStrategy(ctx)
+	if err != errNoModelStored {
+		t.Errorf("LoadStrategy() of an empty store: error = %v, want %v", err, errNoModelStored)
+	}
+
+	s := newTestStrategy("a", "b")
+	other := Context{UserID: "u2", TimeOfDay: "night", Weekday: "sunday", Device: "desktop"}
+	s.UpdateReward(testContext, s.Bandits[0], 1)
+	s.UpdateReward(other, s.Bandits[1], 0.5)
+	s.Bandits[1].ContextRewards[other] = 2
+	err = st.SaveStrategy(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := st.LoadStrategy(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameModel(t, loaded, s)
+
+	// an update persisted by another instance reaches this one on refresh
+	err = st.persistUpdate(ctx, loaded, other, loaded.Bandits[1], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.refresh(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mean, n := s.Confidence(other, "b"); mean != 0.75 || n != 2 {
+		t.Errorf("reward of b after the shared update = %v from %d rewards, want 0.75 from 2", mean, n)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultModelName is the name of the model served when none is given.
+const defaultModelName = "default"
+
+// servedModel is a model served under a name. Each model has its own strategy,
+// and so its own lock, and is saved to its own file.
+type servedModel struct {
+	name     string
+	strategy *EpsilonGreedyStrategy
+	filename string       // where the model is saved
+	dirty    atomic.Bool  // rewards received since the last save
+	store    *RedisStore  // shared model, nil when not running with Redis
+	db       *SQLiteStore // saves every reward, nil when not running with SQLite
+}
+
+// ModelRegistry holds the models served by one process, e.g. one for every
+// surface recommendations are shown on.
+type ModelRegistry struct {
+	models map[string]*servedModel
+}
+
+func NewModelRegistry() *ModelRegistry {
+	return &ModelRegistry{models: make(map[string]*servedModel)}
+}
+
+// Register serves the strategy under the name, saving it to filename.
+func (r *ModelRegistry) Register(name string, filename string, strategy *EpsilonGreedyStrategy) {
+	r.models[name] = &servedModel{name: name, strategy: strategy, filename: filename}
+}
+
+// Load reads the model saved in filename and serves it under the name.
+func (r *ModelRegistry) Load(name string, filename string, seed int64) error {
+	slog.Info("Loading model", "model", name, "file", filename)
+	strategy, err := loadModel(filename, seed)
+	if err != nil {
+		return err
+	}
+	r.Register(name, filename, strategy)
+	return nil
+}
+
+// loadModels loads the models in files, keyed by name. With a Redis client the
+// models are shared with other instances. With a SQLite path they are kept in
+// SQLite databases, see sqliteModelPath.
+func loadModels(files map[string]string, client *redis.Client, sqlitePath string, seed int64) (*ModelRegistry, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	r := NewModelRegistry()
+	for _, name := range names {
+		filename := files[name]
+		if sqlitePath != "" {
+			db, err := OpenSQLiteStore(sqliteModelPath(sqlitePath, name))
+			if err != nil {
+				return nil, err
+			}
+			strategy, err := loadSQLiteModel(db, filename, seed)
+			if err != nil {
+				db.Close()
+				return nil, err
+			}
+			r.Register(name, filename, strategy)
+			r.models[name].db = db
+			continue
+		}
+		if client == nil {
+			err := r.Load(name, filename, seed)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		prefix := "smokey"
+		if name != defaultModelName {
+			prefix += ":models:" + name
+		}
+		store := NewRedisStore(client, prefix)
+		strategy, err := loadSharedModel(context.Background(), store, filename, seed)
+		if err != nil {
+			return nil, err
+		}
+		r.Register(name, filename, strategy)
+		r.models[name].store = store
+	}
+	return r, nil
+}
+
+// get returns the model with the name, or the default model if the name is
+// empty.
+func (r *ModelRegistry) get(name string) (*servedModel, error) {
+	if name == "" {
+		name = defaultModelName
+	}
+	m, ok := r.models[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown model %s", name)
+	}
+	return m, nil
+}
+
+// names returns the names of the models in order.
+func (r *ModelRegistry) names() []string {
+	names := make([]string, 0, len(r.models))
+	for name := range r.models {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// save writes every model that has received rewards since it was last saved.
+func (r *ModelRegistry) save() error {
+	var err error
+	for _, name := range r.names() {
+		err = errors.Join(err, r.models[name].save())
+	}
+	return err
+}
+
+// save writes the model if it has received rewards since it was last saved.
+// A model kept in SQLite saved every reward as it came, so it is up to date.
+func (m *servedModel) save() error {
+	if !m.dirty.Swap(false) || m.db != nil {
+		return nil
+	}
+	err := m.strategy.SaveState(m.filename)
+	if err != nil {
+		m.dirty.Store(true) // try again next time
+		return fmt.Errorf("could not save model %s: %w", m.name, err)
+	}
+	slog.Info("Saved model", "model", m.name, "file", m.filename)
+	return nil
+}
+
+// persist applies a reward to the shared model, if there is one, or saves it
+// to the SQLite database.
+func (m *servedModel) persist(ctx context.Context, c Context, b *Bandit, reward float64) error {
+	if m.db != nil {
+		return m.db.SaveUpdate(m.strategy, c, b)
+	}
+	if m.store == nil {
+		return nil
+	}
+	return m.store.persistUpdate(ctx, m.strategy, c, b, reward)
+}
+
+// checkForgettable returns an error wrapping errUserBlended if the model
+// can't forget a user.
+func (m *servedModel) checkForgettable() error {
+	m.strategy.mu.RLock()
+	defer m.strategy.mu.RUnlock()
+
+	err := m.strategy.checkForgettable()
+	if err != nil {
+		return fmt.Errorf("model %s can't forget a user: %w", m.name, err)
+	}
+	return nil
+}
+
+// forgetUser forgets the user in the model and saves it right away, rather
+// than when it is next saved, along with the shared model if there is one.
+// It returns how many contexts it forgot.
+func (m *servedModel) forgetUser(ctx context.Context, userID string) (int, error) {
+	forgotten, err := m.strategy.ForgetUser(userID)
+	if err != nil {
+		return 0, fmt.Errorf("could not forget the user in model %s: %w", m.name, err)
+	}
+	if m.store != nil {
+		err = m.store.forgetUser(ctx, userID)
+		if err != nil {
+			return 0, fmt.Errorf("could not forget the user in the shared model %s: %w", m.name, err)
+		}
+	}
+	if m.db != nil {
+		err = m.db.ForgetUser(userID)
+		if err != nil {
+			return 0, fmt.Errorf("could not forget the user in the SQLite database of model %s: %w", m.name, err)
+		}
+	}
+	m.dirty.Store(true)
+	return forgotten, m.save()
+}
+
+// parseModelFiles parses a list like "homepage=homepage.gob,email=email.gob".
+func parseModelFiles(s string) (map[string]string, error) {
+	files := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		name, filename, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || name == "" || filename == "" {
+			return nil, fmt.Errorf("model %q is not of the form name=file", part)
+		}
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("model %s is given more than once", name)
+		}
+		files[name] = filename
+	}
+	return files, nil
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// server serves recommendations from models loaded once at startup and
+// learns from the rewards posted to them. The strategies do their own locking
+// so they can be shared between requests.
+type server struct {
+	models      *ModelRegistry
+	metrics     *metrics
+	defaultItem string         // see ServeConfig
+	router      *ABRouter      // splits users between the models, nil without ABSplit
+	contexts    ContextOptions // see ServeConfig.Context
+	clamp       bool           // see ServeConfig.ClampRewards
+	limiter     *ipRateLimiter // nil without ServeConfig.RateLimit
+}
+
+// ServeConfig configures serving the models.
+type ServeConfig struct {
+	Addr         string        // to serve HTTP on
+	GRPCAddr     string        // to serve gRPC on, empty to not serve gRPC
+	SaveInterval time.Duration // how often rewards are saved, 0 to only save on shutdown
+
+	// DefaultItem, unless empty, is recommended instead of what the model
+	// selects when it has no bandits or only negative rewards in the context.
+	DefaultItem string
+
+	// ABSplit, unless empty, splits the users between the models with these
+	// names by weight, for requests that don't name a model.
+	ABSplit map[string]float64
+
+	// Context builds the context of every request like the contexts were
+	// built when training, with the same buckets, time zone and devices.
+	Context ContextOptions
+
+	// ClampRewards clamps the rewards posted to [0, 1], for models trained
+	// with normalized rewards.
+	ClampRewards bool
+
+	// RateLimit, when above 0, limits every client IP to this many requests
+	// per second to /recommend, /recommend/batch and /reward.
+	RateLimit float64
+
+	// TrustedProxies are the proxies the rate limit takes the client IP
+	// from X-Forwarded-For of. Other requests are limited by the IP they
+	// come from.
+	TrustedProxies []netip.Prefix
+}
+
+type recommendResponse struct {
+	ItemID string `json:"item_id"`
+	Model  string `json:"model,omitempty"` // the user is assigned to, with an A/B split
+
+	// Reward is the estimated reward of the item in the context, based on
+	// Samples rewards. LowConfidence is set when there are too few of them
+	// to rely on the estimate.
+	Reward        float64 `json:"reward"`
+	Samples       int     `json:"samples"`
+	LowConfidence bool    `json:"low_confidence"`
+}
+
+// newRecommendResponse reports the item with the model's confidence in it.
+func newRecommendResponse(s *EpsilonGreedyStrategy, ctx Context, b *Bandit) recommendResponse {
+	mean, n := s.Confidence(ctx, b.ItemID)
+	return recommendResponse{ItemID: b.ItemID, Reward: mean, Samples: n, LowConfidence: LowConfidence(n)}
+}
+
+// useDefault reports whether to recommend the default item instead of what
+// the model selected for the context, err being the error selecting it.
+func (srv *server) useDefault(model *servedModel, ctx Context, err error) bool {
+	if srv.defaultItem == "" {
+		return false
+	}
+	if errors.Is(err, errNoBandits) {
+		return true
+	}
+	best, ok := model.strategy.BestReward(ctx)
+	return err == nil && ok && best < 0
+}
+
+// defaultResponse recommends the default item, which the model knows nothing
+// about.
+func (srv *server) defaultResponse(model *servedModel) recommendResponse {
+	srv.metrics.recommendedDefault(model.name, srv.defaultItem)
+	return recommendResponse{ItemID: srv.defaultItem, LowConfidence: true}
+}
+
+// model returns the named model. Without a name it is the model the user is
+// assigned to with an A/B split, and the default model otherwise.
+func (srv *server) model(name string, userID string) (*servedModel, error) {
+	if name == "" && srv.router != nil {
+		name = srv.router.Assign(userID)
+	}
+	return srv.models.get(name)
+}
+
+// recommend selects an item for the context with the model.
+func (srv *server) recommend(model *servedModel, ctx Context) (recommendResponse, error) {
+	bandit, explored, err := model.strategy.SelectBanditWithInfo(ctx)
+	var resp recommendResponse
+	switch {
+	case srv.useDefault(model, ctx, err):
+		resp = srv.defaultResponse(model)
+		logRecommendation(model.name, ctx, resp.ItemID, "default")
+	case err != nil:
+		return recommendResponse{}, err
+	default:
+		srv.metrics.recommended(model.name, bandit, explored)
+		logRecommendation(model.name, ctx, bandit.ItemID, decision(explored))
+		resp = newRecommendResponse(model.strategy, ctx, bandit)
+	}
+	if srv.router != nil {
+		resp.Model = model.name
+	}
+	return resp, nil
+}
+
+// decision names whether a selection explored or exploited.
+func decision(explored bool) string {
+	if explored {
+		return "explore"
+	}
+	return "exploit"
+}
+
+// logRecommendation logs a recommendation at debug level, with the hash of
+// the context to correlate it with the rewards in the context.
+func logRecommendation(model string, ctx Context, itemID string, decision string) {
+	slog.Debug("Recommended", "model", model, "context", ctx.Hash(), "item", itemID, "decision", decision)
+}
+
+// logReward logs a reward at debug level, see logRecommendation.
+func logReward(model string, ctx Context, itemID string, reward float64) {
+	slog.Debug("Rewarded", "model", model, "context", ctx.Hash(), "item", itemID, "reward", reward)
+}
+
+// writeSelectError responds with the error selecting an item.
+func writeSelectError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errNoBandits) {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+type rankResponse struct {
+	// Exploring is set when the model has too few rewards in the context to
+	// go by the ranking, so every selection explores.
+	Exploring bool         `json:"exploring"`
+	Items     []rankedItem `json:"items"` // best first
+}
+
+type rankedItem struct {
+	ItemID  string  `json:"item_id"`
+	Reward  float64 `json:"reward"`  // estimated reward in the context
+	Score   float64 `json:"score"`   // softmax of the rewards, see ScoreContext
+	Samples int     `json:"samples"` // rewards the estimate is based on
+}
+
+// defaultRankSize is the number of items /rank returns without k.
+const defaultRankSize = 10
+
+// rankSize returns the k query parameter, defaultRankSize without one.
+func rankSize(q url.Values) (int, error) {
+	if !q.Has("k") {
+		return defaultRankSize, nil
+	}
+	k, err := strconv.Atoi(q.Get("k"))
+	if err != nil || k < 1 {
+		return 0, errors.New("k must be a positive number")
+	}
+	return k, nil
+}
+
+type explainResponse struct {
+	Context     Context      `json:"context"`      // the model keys the rewards on
+	ContextHash string       `json:"context_hash"` // of the context of the request, as logged
+	Decision    string       `json:"decision"`     // explore or exploit
+	Reason      string       `json:"reason"`
+	Item        rankedItem   `json:"item"`        // the selected item
+	Competitors []rankedItem `json:"competitors"` // the best other items, best first
+}
+
+type contextRequest struct {
+	UserID    string `json:"user"`
+	TimeOfDay string `json:"time"`
+	Weekday   string `json:"weekday"`
+	Device    string `json:"device"`
+}
+
+// reward returns the posted reward, clamped to [0, 1] with ClampRewards and
+// then scaled by its weight, like the rewards of weighted training rows.
+func (srv *server) reward(r float64, weight float64) float64 {
+	if srv.clamp {
+		r = clampReward(r)
+	}
+	return r * weight
+}
+
+// context builds the context of a request at the current time, see
+// ContextOptions.contextAt.
+func (srv *server) context(userID, timeOfDay, weekday, device string) (Context, error) {
+	return srv.contexts.contextAt(time.Now(), userID, timeOfDay, weekday, device)
+}
+
+// queryContext builds the context of the user, time, weekday and device
+// query parameters.
+func (srv *server) queryContext(q url.Values) (Context, error) {
+	return srv.context(q.Get("user"), q.Get("time"), q.Get("weekday"), q.Get("device"))
+}
+
+type rewardRequest struct {
+	contextRequest
+	ItemID string   `json:"item_id"`
+	Reward *float64 `json:"reward"`
+	Weight *float64 `json:"weight"` // scales the reward like in training, 1 without one
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type statusResponse struct {
+	Status string `json:"status"`
+}
+
+type forgetRequest struct {
+	UserID string `json:"user"`
+}
+
+type forgetResponse struct {
+	Contexts int `json:"contexts"` // forgotten over all the models
+}
+
+func newServer(models *ModelRegistry) *server {
+	return &server{models: models, metrics: newMetrics()}
+}
+
+func (srv *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/recommend", srv.metrics.instrument("/recommend", srv.rateLimit(srv.handleRecommend)))
+	mux.HandleFunc("/recommend/batch", srv.metrics.instrument("/recommend/batch", srv.rateLimit(srv.handleRecommendBatch)))
+	mux.HandleFunc("/rank", srv.metrics.instrument("/rank", srv.handleRank))
+	mux.HandleFunc("/explain", srv.metrics.instrument("/explain", srv.handleExplain))
+	mux.HandleFunc("/reward", srv.metrics.instrument("/reward", srv.rateLimit(srv.handleReward)))
+	mux.HandleFunc("/forget", srv.metrics.instrument("/forget", srv.handleForget))
+	mux.Handle("/metrics", srv.metrics.handler())
+	mux.HandleFunc("/healthz", srv.handleHealthz)
+	mux.HandleFunc("/readyz", srv.handleReadyz)
+	return mux
+}
+
+// rateLimit limits the requests of every client to h, see
+// ServeConfig.RateLimit.
+func (srv *server) rateLimit(h http.HandlerFunc) http.HandlerFunc {
+	if srv.limiter == nil {
+		return h
+	}
+	return srv.limiter.wrap(h)
+}
+
+// handleHealthz serves GET /healthz, which is ok as long as the server runs.
+func (srv *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, statusResponse{Status: "ok"})
+}
+
+// handleReadyz serves GET /readyz, which is ok once every model has items to
+// recommend.
+func (srv *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if len(srv.models.models) == 0 {
+		writeError(w, http.StatusServiceUnavailable, "no models loaded")
+		return
+	}
+	for _, name := range srv.models.names() {
+		if srv.models.models[name].strategy.NumBandits() == 0 {
+			writeError(w, http.StatusServiceUnavailable, "model "+name+" has no bandits")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, statusResponse{Status: "ok"})
+}
+
+// handleRecommend serves GET /recommend?user=&time=&weekday=&device=&model=
+func (srv *server) handleRecommend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	model, err := srv.model(q.Get("model"), q.Get("user"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	ctx, err := srv.queryContext(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp, err := srv.recommend(model, ctx)
+	if err != nil {
+		writeSelectError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleRecommendBatch serves POST /recommend/batch?model= with a JSON array
+// of contexts, responding with one recommendation per context in order.
+func (srv *server) handleRecommendBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req []contextRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+
+	ctxs := make([]Context, len(req))
+	for i, c := range req {
+		ctxs[i], err = srv.context(c.UserID, c.TimeOfDay, c.Weekday, c.Device)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid context %d: %v", i, err))
+			return
+		}
+	}
+
+	name := r.URL.Query().Get("model")
+	if name == "" && srv.router != nil {
+		// every user may be assigned to a model of their own
+		resp := make([]recommendResponse, len(ctxs))
+		for i, ctx := range ctxs {
+			model, err := srv.model("", ctx.UserID)
+			if err != nil {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			resp[i], err = srv.recommend(model, ctx)
+			if err != nil {
+				writeSelectError(w, err)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	model, err := srv.models.get(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	bandits, explored, err := model.strategy.SelectBatch(ctxs)
+	if errors.Is(err, errNoBandits) && srv.defaultItem != "" {
+		// all get the default item
+		bandits, explored, err = make([]*Bandit, len(ctxs)), make([]bool, len(ctxs)), nil
+	}
+	if err != nil {
+		writeSelectError(w, err)
+		return
+	}
+
+	resp := make([]recommendResponse, len(bandits))
+	for i, b := range bandits {
+		if b == nil || srv.useDefault(model, ctxs[i], nil) {
+			resp[i] = srv.defaultResponse(model)
+			logRecommendation(model.name, ctxs[i], resp[i].ItemID, "default")
+			continue
+		}
+		srv.metrics.recommended(model.name, b, explored[i])
+		logRecommendation(model.name, ctxs[i], b.ItemID, decision(explored[i]))
+		resp[i] = newRecommendResponse(model.strategy, ctxs[i], b)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleRank serves GET /rank?user=&time=&weekday=&device=&model=&k=, the k
+// best items in the context with their scores. It never explores, so it
+// shows what the model has learned, e.g. for debugging.
+func (srv *server) handleRank(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	model, err := srv.model(q.Get("model"), q.Get("user"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	k, err := rankSize(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, err := srv.queryContext(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	scores := model.strategy.ScoreContext(ctx)
+	resp := rankResponse{Exploring: model.strategy.AlwaysExplores(ctx), Items: []rankedItem{}}
+	for _, b := range model.strategy.SelectTopK(ctx, k) {
+		mean, n := model.strategy.Confidence(ctx, b.ItemID)
+		resp.Items = append(resp.Items, rankedItem{ItemID: b.ItemID, Reward: mean, Score: scores[b.ItemID], Samples: n})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleExplain serves GET /explain?user=&time=&weekday=&device=&model=&k=,
+// selecting an item like /recommend does and explaining why, with the k best
+// other items to compare it with. The selection isn't counted in the metrics.
+func (srv *server) handleExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	model, err := srv.model(q.Get("model"), q.Get("user"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	k, err := rankSize(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, err := srv.queryContext(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s := model.strategy
+	bandit, explored, err := s.SelectBanditWithInfo(ctx)
+	if err != nil {
+		writeSelectError(w, err)
+		return
+	}
+
+	scores := s.ScoreContext(ctx)
+	item := func(b *Bandit) rankedItem {
+		mean, n := s.Confidence(ctx, b.ItemID)
+		return rankedItem{ItemID: b.ItemID, Reward: mean, Score: scores[b.ItemID], Samples: n}
+	}
+	resp := explainResponse{Context: s.key(ctx), ContextHash: ctx.Hash(), Decision: decision(explored), Item: item(bandit), Competitors: []rankedItem{}}
+	switch {
+	case explored && s.AlwaysExplores(ctx):
+		resp.Reason = fmt.Sprintf("%s was picked at random, as the context has too few rewards to go by", bandit.ItemID)
+	case explored:
+		resp.Reason = fmt.Sprintf("%s was picked at random, as the model does for a share epsilon of the selections to keep learning", bandit.ItemID)
+	default:
+		resp.Reason = fmt.Sprintf("%s has the highest estimated reward in the context", bandit.ItemID)
+	}
+	for _, b := range s.SelectTopK(ctx, k+1) {
+		if b != bandit && len(resp.Competitors) < k {
+			resp.Competitors = append(resp.Competitors, item(b))
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleReward serves POST /reward?model=, updating the live model with the
+// reward an item got in a context.
+func (srv *server) handleReward(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req rewardRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	if req.Reward == nil || math.IsNaN(*req.Reward) || math.IsInf(*req.Reward, 0) {
+		writeError(w, http.StatusBadRequest, "reward must be a number")
+		return
+	}
+	weight := 1.0
+	if req.Weight != nil {
+		weight = *req.Weight
+		if !validWeight(weight) {
+			writeError(w, http.StatusBadRequest, "weight must be a number not below 0")
+			return
+		}
+	}
+
+	model, err := srv.model(r.URL.Query().Get("model"), req.UserID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	ctx, err := srv.context(req.UserID, req.TimeOfDay, req.Weekday, req.Device)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	bandit := model.strategy.FindBandit(req.ItemID)
+	if bandit == nil {
+		writeError(w, http.StatusNotFound, "unknown item_id "+req.ItemID)
+		return
+	}
+
+	reward := srv.reward(*req.Reward, weight)
+	model.strategy.UpdateReward(ctx, bandit, reward)
+	srv.metrics.rewardUpdates.WithLabelValues(model.name).Inc()
+	logReward(model.name, ctx, bandit.ItemID, reward)
+	model.dirty.Store(true)
+	err = model.persist(r.Context(), ctx, bandit, reward)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "could not save reward: "+err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleForget serves POST /forget with a JSON body of the user to forget
+// everything learned from in every model, e.g. when they ask to be forgotten.
+func (srv *server) handleForget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req forgetRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	if req.UserID == "" {
+		writeError(w, http.StatusBadRequest, "user must be given")
+		return
+	}
+
+	// Refuse before forgetting the user in any model, rather than report them
+	// forgotten while a model keeps what it learned from them
+	for _, name := range srv.models.names() {
+		err := srv.models.models[name].checkForgettable()
+		if err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+	}
+
+	resp := forgetResponse{}
+	for _, name := range srv.models.names() {
+		forgotten, err := srv.models.models[name].forgetUser(r.Context(), req.UserID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp.Contexts += forgotten
+	}
+	slog.Info("Forgot user", "contexts", resp.Contexts)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// refreshEvery periodically picks up the rewards other instances saved to the
+// shared models.
+func (srv *server) refreshEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, name := range srv.models.names() {
+			m := srv.models.models[name]
+			if m.store == nil {
+				continue
+			}
+			err := m.store.refresh(context.Background(), m.strategy)
+			if err != nil {
+				slog.Error("Failed to refresh the shared model", "model", name, "err", err)
+			}
+		}
+	}
+}
+
+// saveEvery saves the models periodically so online learning survives a
+// restart.
+func (srv *server) saveEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := srv.models.save()
+		if err != nil {
+			slog.Error("Failed to save model", "err", err)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Warn("Failed to write response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
+
+// serve serves the models over HTTP, and the default model over gRPC if
+// there is a GRPCAddr, until one of them fails.
+func serve(models *ModelRegistry, cfg ServeConfig) error {
+	srv := newServer(models)
+	srv.defaultItem = cfg.DefaultItem
+	srv.contexts = cfg.Context
+	srv.clamp = cfg.ClampRewards
+	if cfg.RateLimit > 0 {
+		srv.limiter = newIPRateLimiter(cfg.RateLimit, cfg.TrustedProxies)
+	}
+	if len(cfg.ABSplit) > 0 {
+		srv.router = NewABRouter()
+		names := make([]string, 0, len(cfg.ABSplit))
+		for name := range cfg.ABSplit {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			_, err := models.get(name)
+			if err != nil {
+				return fmt.Errorf("invalid A/B split: %w", err)
+			}
+			err = srv.router.Add(name, cfg.ABSplit[name])
+			if err != nil {
+				return fmt.Errorf("invalid A/B split: %w", err)
+			}
+		}
+	}
+	if cfg.SaveInterval > 0 {
+		go srv.saveEvery(cfg.SaveInterval)
+		go srv.refreshEvery(cfg.SaveInterval)
+	}
+
+	// Stop on SIGINT or SIGTERM, or when one of the servers fails
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 2)
+	running := 1
+	if cfg.GRPCAddr != "" {
+		running++
+		go func() {
+			errc <- serveGRPC(ctx, cfg.GRPCAddr, srv)
+		}()
+	}
+	go func() {
+		errc <- serveHTTP(ctx, cfg.Addr, srv)
+	}()
+
+	var err error
+	for ; running > 0; running-- {
+		err = errors.Join(err, <-errc)
+		stop()
+	}
+
+	// Requests have finished, so this saves every reward received
+	slog.Info("Shutting down, saving models")
+	return errors.Join(err, models.save())
+}
+
+// serveHTTP serves until ctx is done, then lets the requests in flight
+// finish.
+func serveHTTP(ctx context.Context, addr string, srv *server) error {
+	httpServer := &http.Server{Addr: addr, Handler: srv.routes()}
+	shutdownErr := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdownErr <- httpServer.Shutdown(timeout)
+	}()
+
+	slog.Info("Serving recommendations", "addr", addr)
+	err := httpServer.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-shutdownErr
+}
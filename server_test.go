@@ -0,0 +1,578 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestServer serves the strategy as the default model, saved to a
+// temporary file.
+func newTestServer(t *testing.T, s *EpsilonGreedyStrategy) *server {
+	t.Helper()
+
+	models := NewModelRegistry()
+	models.Register(defaultModelName, filepath.Join(t.TempDir(), "strategy.gob"), s)
+	return newServer(models)
+}
+
+// do sends the request to the handler and decodes a JSON response into v,
+// unless v is nil. It returns the response status.
+func do(t *testing.T, h http.Handler, method, target, body string, v interface{}) int {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	if v != nil && w.Code < 300 {
+		err := json.NewDecoder(w.Body).Decode(v)
+		if err != nil {
+			t.Fatalf("%s %s: invalid response: %v", method, target, err)
+		}
+	}
+	return w.Code
+}
+
+func TestHandleRecommend(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.UpdateReward(testContext, s.Bandits[1], 1)
+	filename := filepath.Join(t.TempDir(), "strategy.gob")
+	err := s.SaveState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	models := NewModelRegistry()
+	err = models.Load(defaultModelName, filename, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newServer(models).routes()
+
+	var resp recommendResponse
+	status := do(t, h, http.MethodGet, "/recommend?user=u1&time=morning&weekday=monday&device=mobile", "", &resp)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	if resp.ItemID != "a" && resp.ItemID != "b" {
+		t.Errorf("item_id = %q, want a or b", resp.ItemID)
+	}
+
+	status = do(t, h, http.MethodPost, "/recommend", "", nil)
+	if status != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", status, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHandleReward(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	srv := newTestServer(t, s)
+	h := srv.routes()
+
+	status := do(t, h, http.MethodPost, "/reward",
+		`{"user": "u1", "time": "morning", "weekday": "monday", "device": "mobile", "item_id": "b", "reward": 1}`, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", status, http.StatusNoContent)
+	}
+	if got := s.Rewards[testContext]; len(got) != 2 || got[1] != 1 || s.Counts[testContext][1] != 1 {
+		t.Errorf("Rewards = %v, Counts = %v after the reward, want b rewarded once", got, s.Counts[testContext])
+	}
+	if !srv.models.models[defaultModelName].dirty.Load() {
+		t.Error("the model isn't marked to be saved")
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"unknown item", `{"user": "u1", "item_id": "c", "reward": 1}`, http.StatusNotFound},
+		{"no reward", `{"user": "u1", "item_id": "b"}`, http.StatusBadRequest},
+		{"reward not a number", `{"user": "u1", "item_id": "b", "reward": "high"}`, http.StatusBadRequest},
+		{"invalid json", `{`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := do(t, h, http.MethodPost, "/reward", tt.body, nil)
+			if status != tt.want {
+				t.Errorf("status = %d, want %d", status, tt.want)
+			}
+		})
+	}
+}
+
+// scrape returns the metrics the handler serves.
+func scrape(t *testing.T, h http.Handler) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics status = %d, want %d", w.Code, http.StatusOK)
+	}
+	return w.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.Epsilon = 0
+	s.UpdateReward(testContext, s.Bandits[1], 1)
+	h := newTestServer(t, s).routes()
+
+	for i := 0; i < 2; i++ {
+		status := do(t, h, http.MethodGet, "/recommend?user=u1&time=morning&weekday=monday&device=mobile", "", nil)
+		if status != http.StatusOK {
+			t.Fatalf("status = %d, want %d", status, http.StatusOK)
+		}
+	}
+	status := do(t, h, http.MethodPost, "/reward", `{"user": "u1", "item_id": "b", "reward": 1}`, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("reward status = %d, want %d", status, http.StatusNoContent)
+	}
+
+	metrics := scrape(t, h)
+	for _, want := range []string{
+		`smokey_recommendations_total{item_id="b",model="default"} 2`,
+		`smokey_selections_total{mode="exploit",model="default"} 2`,
+		`smokey_reward_updates_total{model="default"} 1`,
+		`smokey_request_duration_seconds_count{path="/recommend"} 2`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics don't contain %s", want)
+		}
+	}
+}
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+func TestServeSavesOnShutdown(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	filename := filepath.Join(t.TempDir(), "strategy.gob")
+	models := NewModelRegistry()
+	models.Register(defaultModelName, filename, s)
+	addr := freeAddr(t)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(models, ServeConfig{Addr: addr})
+	}()
+
+	// wait for the server to come up
+	url := "http://" + addr
+	for i := 0; ; i++ {
+		resp, err := http.Get(url + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("server didn't come up: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Post(url+"/reward", "application/json",
+		strings.NewReader(`{"user": "u1", "time": "morning", "weekday": "monday", "device": "mobile", "item_id": "b", "reward": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("reward status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	err = syscall.Kill(os.Getpid(), syscall.SIGINT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("serve() = %v, want a clean shutdown", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("serve() didn't shut down on SIGINT")
+	}
+
+	saved, err := loadModel(filename, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mean, n := saved.Confidence(testContext, "b"); mean != 1 || n != 1 {
+		t.Errorf("saved reward of b = %v from %d rewards, want the 1 received before shutting down", mean, n)
+	}
+}
+
+func TestNamedModels(t *testing.T) {
+	homepage, email := newTestStrategy("a", "b"), newTestStrategy("a", "b")
+	homepage.Epsilon, email.Epsilon = 0, 0
+	homepage.UpdateReward(testContext, homepage.Bandits[0], 1)
+	email.UpdateReward(testContext, email.Bandits[1], 1)
+
+	dir := t.TempDir()
+	models := NewModelRegistry()
+	models.Register(defaultModelName, filepath.Join(dir, "homepage.gob"), homepage)
+	models.Register("email", filepath.Join(dir, "email.gob"), email)
+	h := newServer(models).routes()
+
+	tests := []struct {
+		model      string
+		wantStatus int
+		wantItem   string
+	}{
+		{"", http.StatusOK, "a"},
+		{"default", http.StatusOK, "a"},
+		{"email", http.StatusOK, "b"},
+		{"push", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		var resp recommendResponse
+		status := do(t, h, http.MethodGet, "/recommend?user=u1&time=morning&weekday=monday&device=mobile&model="+tt.model, "", &resp)
+		if status != tt.wantStatus || resp.ItemID != tt.wantItem {
+			t.Errorf("model %q: status %d and item %q, want %d and %q", tt.model, status, resp.ItemID, tt.wantStatus, tt.wantItem)
+		}
+	}
+
+	// rewards only go to the named model
+	status := do(t, h, http.MethodPost, "/reward?model=email", `{"user": "u2", "time": "morning", "weekday": "monday", "item_id": "a", "reward": 1}`, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("reward status = %d, want %d", status, http.StatusNoContent)
+	}
+	ctx := Context{UserID: "u2", TimeOfDay: "morning", Weekday: "monday", Device: unknown}
+	if _, n := email.Confidence(ctx, "a"); n != 1 {
+		t.Errorf("email model got %d rewards, want 1", n)
+	}
+	if len(homepage.Rewards) != 1 {
+		t.Errorf("homepage model has %d contexts, want only its own", len(homepage.Rewards))
+	}
+}
+
+func TestHandleRecommendBatch(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	s.Epsilon = 0
+	s.UpdateReward(testContext, s.Bandits[1], 1)
+	s.UpdateReward(Context{UserID: "u2", TimeOfDay: "night", Weekday: "sunday", Device: unknown}, s.Bandits[0], 1)
+	srv := newTestServer(t, s)
+	h := srv.routes()
+
+	var resp []recommendResponse
+	status := do(t, h, http.MethodPost, "/recommend/batch", `[
+		{"user": "u1", "time": "morning", "weekday": "monday", "device": "mobile"},
+		{"user": "u2", "time": "night", "weekday": "sunday"}
+	]`, &resp)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	if len(resp) != 2 || resp[0].ItemID != "b" || resp[1].ItemID != "a" {
+		t.Errorf("recommendations = %+v, want b and a", resp)
+	}
+	if metrics := scrape(t, h); !strings.Contains(metrics, `smokey_selections_total{mode="exploit",model="default"} 2`) {
+		t.Error("the batch selections aren't counted as exploiting")
+	}
+
+	status = do(t, h, http.MethodPost, "/recommend/batch", `[{"user": "u1", "time": "brunch"}]`, nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("status with an invalid context = %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestServedContextsAreNormalized(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	h := newTestServer(t, s).routes()
+
+	status := do(t, h, http.MethodPost, "/reward",
+		`{"user": " u1", "time": "Morning", "weekday": "Monday ", "device": "MOBILE", "item_id": "b", "reward": 1}`, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", status, http.StatusNoContent)
+	}
+	if s.Counts[testContext][1] != 1 {
+		t.Errorf("Counts = %v, want the reward in the normalized context %+v", s.Counts, testContext)
+	}
+
+	for _, target := range []string{"/recommend?user=u1&time=brunch", "/recommend?user=u1&weekday=mon"} {
+		if status := do(t, h, http.MethodGet, target, "", nil); status != http.StatusBadRequest {
+			t.Errorf("GET %s status = %d, want %d", target, status, http.StatusBadRequest)
+		}
+	}
+	status = do(t, h, http.MethodPost, "/reward", `{"user": "u1", "time": "brunch", "item_id": "b", "reward": 1}`, nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("reward with an invalid time status = %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestDefaultItem(t *testing.T) {
+	const target = "/recommend?user=u1&time=morning&weekday=monday&device=mobile"
+
+	negative := newTestStrategy("a", "b")
+	negative.UpdateReward(testContext, negative.Bandits[0], -0.1)
+	negative.UpdateReward(testContext, negative.Bandits[1], -0.5)
+	positive := newTestStrategy("a", "b")
+	positive.Epsilon = 0
+	positive.UpdateReward(testContext, positive.Bandits[1], 1)
+
+	tests := []struct {
+		name string
+		s    *EpsilonGreedyStrategy
+		want string
+	}{
+		{"no bandits", newTestStrategy(), "fallback"},
+		{"negative rewards", negative, "fallback"},
+		{"positive reward", positive, "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.s)
+			srv.defaultItem = "fallback"
+
+			var resp recommendResponse
+			status := do(t, srv.routes(), http.MethodGet, target, "", &resp)
+			if status != http.StatusOK {
+				t.Fatalf("status = %d, want %d", status, http.StatusOK)
+			}
+			if resp.ItemID != tt.want {
+				t.Errorf("item_id = %q, want %q", resp.ItemID, tt.want)
+			}
+			if resp.ItemID == "fallback" && !resp.LowConfidence {
+				t.Error("the default item isn't low confidence")
+			}
+		})
+	}
+
+	// without a default item a model without bandits can't recommend
+	status := do(t, newTestServer(t, newTestStrategy()).routes(), http.MethodGet, target, "", nil)
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("status without a default item = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	models := NewModelRegistry()
+	srv := newServer(models)
+	h := srv.routes()
+
+	if status := do(t, h, http.MethodGet, "/healthz", "", nil); status != http.StatusOK {
+		t.Errorf("/healthz status = %d, want %d", status, http.StatusOK)
+	}
+	if status := do(t, h, http.MethodGet, "/readyz", "", nil); status != http.StatusServiceUnavailable {
+		t.Errorf("/readyz status without a model = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	models.Register(defaultModelName, filepath.Join(t.TempDir(), "strategy.gob"), newTestStrategy())
+	if status := do(t, h, http.MethodGet, "/readyz", "", nil); status != http.StatusServiceUnavailable {
+		t.Errorf("/readyz status with a model without bandits = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	models.Register(defaultModelName, filepath.Join(t.TempDir(), "strategy.gob"), newTestStrategy("a"))
+	var resp statusResponse
+	if status := do(t, h, http.MethodGet, "/readyz", "", &resp); status != http.StatusOK || resp.Status != "ok" {
+		t.Errorf("/readyz = %d %+v, want %d ok", status, resp, http.StatusOK)
+	}
+	if status := do(t, h, http.MethodGet, "/healthz", "", nil); status != http.StatusOK {
+		t.Errorf("/healthz status = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestHandleRank(t *testing.T) {
+	s := newTestStrategy("a", "b", "c")
+	s.UpdateReward(testContext, s.Bandits[0], 0.25)
+	s.UpdateReward(testContext, s.Bandits[0], 0.75)
+	s.UpdateReward(testContext, s.Bandits[1], 1)
+	s.UpdateReward(testContext, s.Bandits[2], 0.25)
+	h := newTestServer(t, s).routes()
+	scores := s.ScoreContext(testContext)
+
+	const target = "/rank?user=u1&time=morning&weekday=monday&device=mobile&k=2"
+	var resp rankResponse
+	status := do(t, h, http.MethodGet, target, "", &resp)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	want := rankResponse{Items: []rankedItem{
+		{ItemID: "b", Reward: 1, Score: scores["b"], Samples: 1},
+		{ItemID: "a", Reward: 0.5, Score: scores["a"], Samples: 2},
+	}}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("GET /rank = %+v, want %+v", resp, want)
+	}
+
+	// ranking doesn't explore, so it's the same every time
+	for i := 0; i < 20; i++ {
+		var again rankResponse
+		do(t, h, http.MethodGet, target, "", &again)
+		if !reflect.DeepEqual(again, want) {
+			t.Fatalf("GET /rank = %+v, want the same ranking every time", again)
+		}
+	}
+
+	s.MinSamples = 10
+	resp = rankResponse{}
+	do(t, h, http.MethodGet, target, "", &resp)
+	if !resp.Exploring {
+		t.Error("exploring = false in a context with fewer than MinSamples rewards")
+	}
+
+	if status := do(t, h, http.MethodGet, "/rank?user=u1&k=0", "", nil); status != http.StatusBadRequest {
+		t.Errorf("k=0 status = %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestABSplitResponse(t *testing.T) {
+	models := NewModelRegistry()
+	srv := newServer(models)
+	srv.router = NewABRouter()
+	for _, name := range []string{"current", "adaptive"} {
+		s := newTestStrategy(name + "-item")
+		models.Register(name, filepath.Join(t.TempDir(), name+".gob"), s)
+		if err := srv.router.Add(name, 0.5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := srv.routes()
+
+	for _, user := range []string{"u1", "u2", "u3", "u4", "u5", "u6"} {
+		var resp recommendResponse
+		status := do(t, h, http.MethodGet, "/recommend?user="+user, "", &resp)
+		if status != http.StatusOK {
+			t.Fatalf("status = %d, want %d", status, http.StatusOK)
+		}
+		want := srv.router.Assign(user)
+		if resp.Model != want || resp.ItemID != want+"-item" {
+			t.Errorf("%s got %s from model %q, want %s from the assigned %s", user, resp.ItemID, resp.Model, want+"-item", want)
+		}
+
+		// the reward goes back to the assigned model, the only one with the item
+		body := `{"user": "` + user + `", "time": "morning", "weekday": "monday", "device": "mobile", "item_id": "` + resp.ItemID + `", "reward": 1}`
+		if status := do(t, h, http.MethodPost, "/reward", body, nil); status != http.StatusNoContent {
+			t.Errorf("reward of %s status = %d, want %d", user, status, http.StatusNoContent)
+		}
+		s := models.models[want].strategy
+		if mean, n := s.Confidence(Context{UserID: user, TimeOfDay: "morning", Weekday: "monday", Device: "mobile"}, resp.ItemID); mean != 1 || n != 1 {
+			t.Errorf("%s in the assigned model = %v from %d rewards, want 1 from 1", user, mean, n)
+		}
+	}
+}
+
+func TestClampRewards(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	srv := newTestServer(t, s)
+	srv.clamp = true
+	h := srv.routes()
+
+	for _, body := range []string{
+		`{"user": "u1", "time": "morning", "weekday": "monday", "device": "mobile", "item_id": "a", "reward": 5}`,
+		`{"user": "u1", "time": "morning", "weekday": "monday", "device": "mobile", "item_id": "b", "reward": -2}`,
+	} {
+		if status := do(t, h, http.MethodPost, "/reward", body, nil); status != http.StatusNoContent {
+			t.Fatalf("status = %d, want %d", status, http.StatusNoContent)
+		}
+	}
+	if got := s.Rewards[testContext]; got[0] != 1 || got[1] != 0 {
+		t.Errorf("Rewards = %v, want [1 0] clamped", got)
+	}
+}
+
+func TestHandleExplain(t *testing.T) {
+	s := newTestStrategy("a", "b", "c")
+	s.Epsilon = 0
+	s.UpdateReward(testContext, s.Bandits[0], 0.5)
+	s.UpdateReward(testContext, s.Bandits[0], 0.5)
+	s.UpdateReward(testContext, s.Bandits[1], 1)
+	s.UpdateReward(testContext, s.Bandits[2], 0.25)
+	h := newTestServer(t, s).routes()
+	scores := s.ScoreContext(testContext)
+
+	var resp explainResponse
+	status := do(t, h, http.MethodGet, "/explain?user=u1&time=morning&weekday=monday&device=mobile&k=1", "", &resp)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	if resp.Context != testContext || resp.ContextHash != testContext.Hash() {
+		t.Errorf("context = %+v (%s), want %+v (%s)", resp.Context, resp.ContextHash, testContext, testContext.Hash())
+	}
+	if resp.Decision != "exploit" || !strings.Contains(resp.Reason, "highest estimated reward") {
+		t.Errorf("decision = %q, reason = %q, want exploiting the highest reward", resp.Decision, resp.Reason)
+	}
+	if want := (rankedItem{ItemID: "b", Reward: 1, Score: scores["b"], Samples: 1}); resp.Item != want {
+		t.Errorf("item = %+v, want %+v", resp.Item, want)
+	}
+	wantCompetitors := []rankedItem{{ItemID: "a", Reward: 0.5, Score: scores["a"], Samples: 2}}
+	if !reflect.DeepEqual(resp.Competitors, wantCompetitors) {
+		t.Errorf("competitors = %+v, want %+v", resp.Competitors, wantCompetitors)
+	}
+
+	// a context without rewards always explores
+	resp = explainResponse{}
+	do(t, h, http.MethodGet, "/explain?user=new&time=morning&weekday=monday", "", &resp)
+	if resp.Decision != "explore" || !strings.Contains(resp.Reason, "too few rewards") || len(resp.Competitors) != 2 {
+		t.Errorf("explanation for a new context = %+v, want exploring with 2 competitors", resp)
+	}
+}
+
+func TestWeightedReward(t *testing.T) {
+	s := newTestStrategy("a", "b")
+	h := newTestServer(t, s).routes()
+
+	for _, body := range []string{
+		`{"user": "u1", "time": "morning", "weekday": "monday", "device": "mobile", "item_id": "a", "reward": 0.5, "weight": 2}`,
+		`{"user": "u1", "time": "morning", "weekday": "monday", "device": "mobile", "item_id": "b", "reward": 0.5}`,
+	} {
+		if status := do(t, h, http.MethodPost, "/reward", body, nil); status != http.StatusNoContent {
+			t.Fatalf("status = %d, want %d", status, http.StatusNoContent)
+		}
+	}
+	if got := s.Rewards[testContext]; got[0] != 1 || got[1] != 0.5 {
+		t.Errorf("Rewards = %v, want [1 0.5], the reward weighted 2 counting twice", got)
+	}
+
+	body := `{"user": "u1", "item_id": "a", "reward": 1, "weight": -1}`
+	if status := do(t, h, http.MethodPost, "/reward", body, nil); status != http.StatusBadRequest {
+		t.Errorf("status with a negative weight = %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestHandleForget(t *testing.T) {
+	models := NewModelRegistry()
+	current, shared := newTestStrategy("a"), newTestStrategy("a")
+	shared.IgnoreUser = true
+	current.UpdateReward(testContext, current.Bandits[0], 1)
+	current.UpdateReward(Context{UserID: "u2"}, current.Bandits[0], 1)
+	models.Register("current", filepath.Join(t.TempDir(), "current.gob"), current)
+	models.Register("shared", filepath.Join(t.TempDir(), "shared.gob"), shared)
+	h := newServer(models).routes()
+
+	// a model sharing contexts between users can't forget one, so none does
+	if status := do(t, h, http.MethodPost, "/forget", `{"user": "u1"}`, nil); status != http.StatusConflict {
+		t.Errorf("status = %d, want %d", status, http.StatusConflict)
+	}
+	if _, ok := current.Rewards[testContext]; !ok {
+		t.Error("the user was forgotten in one model while another refused")
+	}
+
+	delete(models.models, "shared")
+	var resp forgetResponse
+	if status := do(t, h, http.MethodPost, "/forget", `{"user": "u1"}`, &resp); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	if resp.Contexts != 1 || len(current.Rewards) != 1 {
+		t.Errorf("forgot %d contexts, %d left, want 1 forgotten and the one of u2 left", resp.Contexts, len(current.Rewards))
+	}
+	if status := do(t, h, http.MethodPost, "/forget", `{}`, nil); status != http.StatusBadRequest {
+		t.Errorf("status without a user = %d, want %d", status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+// SimulationConfig sets the training data Simulate makes up.
+type SimulationConfig struct {
+	Rows  int
+	Users int
+	Items int
+	Seed  int64 // 0 seeds from the clock
+}
+
+var simulatedDevices = []string{"mobile", "desktop", "tablet"}
+
+// simulationStart is the start of the four weeks simulated impressions are
+// spread over.
+var simulationStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Simulate makes up training data for demos and tests: impressions of random
+// items to random users at random times on random devices. Whether an
+// impression got a click is drawn from a click probability every item has in
+// every time of day and device, which is hidden but the same for the same
+// seed, so a model trained on the data has something to learn.
+func Simulate(cfg SimulationConfig) []TrainingData {
+	rng := newRand(cfg.Seed)
+
+	items := make([]string, cfg.Items)
+	for i := range items {
+		items[i] = fmt.Sprintf("item%d", i+1)
+	}
+
+	// The click probability of an item is its base rate times its affinity
+	// to the time of day and the device.
+	base := make([]float64, cfg.Items)
+	timeAffinity := make([]map[string]float64, cfg.Items)
+	deviceAffinity := make([]map[string]float64, cfg.Items)
+	for i := range items {
+		base[i] = 0.01 + 0.14*rng.Float64()
+		timeAffinity[i] = map[string]float64{}
+		for _, bucket := range defaultTimeOfDayBuckets {
+			timeAffinity[i][bucket.Label] = 0.5 + rng.Float64()
+		}
+		deviceAffinity[i] = map[string]float64{}
+		for _, device := range simulatedDevices {
+			deviceAffinity[i][device] = 0.5 + rng.Float64()
+		}
+	}
+
+	rows := make([]TrainingData, cfg.Rows)
+	for n := range rows {
+		i := rng.Intn(cfg.Items)
+		device := simulatedDevices[rng.Intn(len(simulatedDevices))]
+		t := simulationStart.Add(time.Duration(rng.Int63n(int64(28 * 24 * time.Hour)))).Truncate(time.Second)
+		timeOfDay := bucketTimeOfDay(t.Hour(), defaultTimeOfDayBuckets)
+
+		rows[n] = TrainingData{
+			UserID:    fmt.Sprintf("user%d", rng.Intn(cfg.Users)+1),
+			ItemID:    items[i],
+			Timestamp: bigquery.NullDateTime{DateTime: civil.DateTimeOf(t), Valid: true},
+			HasClick:  rng.Float64() < base[i]*timeAffinity[i][timeOfDay]*deviceAffinity[i][device],
+			Device:    bigquery.NullString{StringVal: device, Valid: true},
+		}
+	}
+	return rows
+}
+
+// simulate writes simulated training data to the CSV file, or to stdout if
+// filename is empty.
+func simulate(filename string, cfg SimulationConfig) error {
+	rows := Simulate(cfg)
+	if filename == "" {
+		return writeTrainingCSV(os.Stdout, rows)
+	}
+
+	err := writeFileAtomic(filename, func(w io.Writer) error {
+		return writeTrainingCSV(w, rows)
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("Wrote simulated training data", "file", filename, "rows", len(rows))
+	return nil
+}
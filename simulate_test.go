@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSimulate(t *testing.T) {
+	cfg := SimulationConfig{Rows: 50, Users: 5, Items: 3, Seed: 7}
+	filename := filepath.Join(t.TempDir(), "simulated.csv")
+	if err := simulate(filename, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != cfg.Rows+1 {
+		t.Fatalf("%d records, want a header and %d rows", len(records), cfg.Rows)
+	}
+	if !slices.Equal(records[0], csvColumns) {
+		t.Errorf("header = %v, want %v", records[0], csvColumns)
+	}
+
+	rows, err := (&CSVDataSource{Path: filename}).Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != cfg.Rows {
+		t.Fatalf("read back %d rows, want %d", len(rows), cfg.Rows)
+	}
+	for _, row := range rows {
+		if !strings.HasPrefix(row.UserID, "user") || !strings.HasPrefix(row.ItemID, "item") ||
+			!row.Timestamp.Valid || !slices.Contains(simulatedDevices, row.Device.StringVal) {
+			t.Errorf("simulated row %+v, want a user, item, impression time and device", row)
+		}
+	}
+
+	// the same seed simulates the same data
+	if again := Simulate(cfg); !slices.EqualFunc(again, rows, func(a, b TrainingData) bool {
+		return a.UserID == b.UserID && a.ItemID == b.ItemID && a.Timestamp == b.Timestamp && a.HasClick == b.HasClick && a.Device == b.Device
+	}) {
+		t.Error("Simulate() with the same seed made other rows")
+	}
+}
+
+func TestSimulateCommand(t *testing.T) {
+	out, err := runMain(t, "simulate", "-rows", "3", "-seed", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := readTrainingCSV(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("simulate wrote invalid CSV: %v\n%s", err, out)
+	}
+	if len(rows) != 3 {
+		t.Errorf("simulate wrote %d rows, want 3", len(rows))
+	}
+}
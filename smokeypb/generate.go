@@ -0,0 +1,4 @@
+// Package smokeypb has the gRPC service for serving recommendations.
+package smokeypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative smokey.proto
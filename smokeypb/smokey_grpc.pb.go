@@ -0,0 +1,146 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: smokey.proto
+
+package smokeypb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Recommender_Recommend_FullMethodName    = "/smokey.Recommender/Recommend"
+	Recommender_UpdateReward_FullMethodName = "/smokey.Recommender/UpdateReward"
+)
+
+// RecommenderClient is the client API for Recommender service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RecommenderClient interface {
+	Recommend(ctx context.Context, in *RecommendRequest, opts ...grpc.CallOption) (*RecommendResponse, error)
+	UpdateReward(ctx context.Context, in *UpdateRewardRequest, opts ...grpc.CallOption) (*UpdateRewardResponse, error)
+}
+
+type recommenderClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRecommenderClient(cc grpc.ClientConnInterface) RecommenderClient {
+	return &recommenderClient{cc}
+}
+
+func (c *recommenderClient) Recommend(ctx context.Context, in *RecommendRequest, opts ...grpc.CallOption) (*RecommendResponse, error) {
+	out := new(RecommendResponse)
+	err := c.cc.Invoke(ctx, Recommender_Recommend_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *recommenderClient) UpdateReward(ctx context.Context, in *UpdateRewardRequest, opts ...grpc.CallOption) (*UpdateRewardResponse, error) {
+	out := new(UpdateRewardResponse)
+	err := c.cc.Invoke(ctx, Recommender_UpdateReward_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RecommenderServer is the server API for Recommender service.
+// All implementations must embed UnimplementedRecommenderServer
+// for forward compatibility
+type RecommenderServer interface {
+	Recommend(context.Context, *RecommendRequest) (*RecommendResponse, error)
+	UpdateReward(context.Context, *UpdateRewardRequest) (*UpdateRewardResponse, error)
+	mustEmbedUnimplementedRecommenderServer()
+}
+
+// UnimplementedRecommenderServer must be embedded to have forward compatible implementations.
+type UnimplementedRecommenderServer struct {
+}
+
+func (UnimplementedRecommenderServer) Recommend(context.Context, *RecommendRequest) (*RecommendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Recommend not implemented")
+}
+func (UnimplementedRecommenderServer) UpdateReward(context.Context, *UpdateRewardRequest) (*UpdateRewardResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateReward not implemented")
+}
+func (UnimplementedRecommenderServer) mustEmbedUnimplementedRecommenderServer() {}
+
+// UnsafeRecommenderServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RecommenderServer will
+// result in compilation errors.
+type UnsafeRecommenderServer interface {
+	mustEmbedUnimplementedRecommenderServer()
+}
+
+func RegisterRecommenderServer(s grpc.ServiceRegistrar, srv RecommenderServer) {
+	s.RegisterService(&Recommender_ServiceDesc, srv)
+}
+
+func _Recommender_Recommend_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RecommendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RecommenderServer).Recommend(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Recommender_Recommend_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RecommenderServer).Recommend(ctx, req.(*RecommendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Recommender_UpdateReward_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateRewardRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RecommenderServer).UpdateReward(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Recommender_UpdateReward_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RecommenderServer).UpdateReward(ctx, req.(*UpdateRewardRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Recommender_ServiceDesc is the grpc.ServiceDesc for Recommender service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Recommender_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "smokey.Recommender",
+	HandlerType: (*RecommenderServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Recommend",
+			Handler:    _Recommender_Recommend_Handler,
+		},
+		{
+			MethodName: "UpdateReward",
+			Handler:    _Recommender_UpdateReward_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "smokey.proto",
+}
@@ -0,0 +1,102 @@
+package main
+
+import "math"
+
+// SoftmaxStrategy (Boltzmann exploration) draws a bandit with probability
+// proportional to exp(reward/temperature). A low temperature is close to
+// greedy, a high temperature is close to uniform.
+type SoftmaxStrategy struct {
+	Temperature float64
+	Bandits     []*Bandit
+	Rewards     map[Context][]float64
+	Counts      map[Context][]int
+
+	seededRand
+}
+
+func (s *SoftmaxStrategy) SelectBandit(ctx Context) (*Bandit, error) {
+	if len(s.Bandits) == 0 {
+		return nil, errNoBandits
+	}
+
+	rng := s.random()
+	rewards := s.Rewards[ctx]
+	if len(rewards) == 0 {
+		// No data for this context yet
+		return s.Bandits[rng.Intn(len(s.Bandits))], nil
+	}
+
+	probs := softmax(rewards, s.Temperature)
+	r := rng.Float64()
+	for i, p := range probs {
+		r -= p
+		if r < 0 {
+			return s.Bandits[i], nil
+		}
+	}
+
+	// guard against rounding errors
+	return s.Bandits[len(probs)-1], nil
+}
+
+func (s *SoftmaxStrategy) UpdateReward(ctx Context, b *Bandit, reward float64) {
+	if s.Rewards == nil {
+		s.Rewards = make(map[Context][]float64)
+		s.Counts = make(map[Context][]int)
+	}
+	if _, ok := s.Rewards[ctx]; !ok {
+		// first reward in a context we haven't seen
+		s.Rewards[ctx] = make([]float64, len(s.Bandits))
+		s.Counts[ctx] = make([]int, len(s.Bandits))
+	}
+	for i := range s.Bandits {
+		if s.Bandits[i] == b {
+			updateAverage(s.Rewards[ctx], s.Counts[ctx], i, reward)
+		}
+	}
+}
+
+func (s *SoftmaxStrategy) Reset() {
+	s.Rewards = make(map[Context][]float64)
+	s.Counts = make(map[Context][]int)
+}
+
+func (s *SoftmaxStrategy) SaveState(filename string) error {
+	return saveModel(filename, s, ModelMetadata{})
+}
+
+func (s *SoftmaxStrategy) LoadState(filename string) error {
+	return loadGob(filename, s)
+}
+
+// softmax turns rewards into selection probabilities. A temperature of zero
+// or less puts all the probability on the best reward.
+func softmax(rewards []float64, temperature float64) []float64 {
+	probs := make([]float64, len(rewards))
+
+	maxReward := rewards[0]
+	maxIndex := 0
+	for i, reward := range rewards {
+		if reward > maxReward {
+			maxReward = reward
+			maxIndex = i
+		}
+	}
+
+	if temperature <= 0 {
+		probs[maxIndex] = 1
+		return probs
+	}
+
+	// subtract the max reward to keep exp from overflowing
+	sum := 0.0
+	for i, reward := range rewards {
+		probs[i] = math.Exp((reward - maxReward) / temperature)
+		sum += probs[i]
+	}
+	for i := range probs {
+		probs[i] /= sum
+	}
+
+	return probs
+}
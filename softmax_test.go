@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSoftmaxSelectionMatchesProbabilities(t *testing.T) {
+	ctx := Context{UserID: "u1", TimeOfDay: "morning"}
+	bandits := []*Bandit{{ItemID: "a"}, {ItemID: "b"}, {ItemID: "c"}}
+	s := &SoftmaxStrategy{Temperature: 0.5, Bandits: bandits}
+	s.Seed(1)
+	s.UpdateReward(ctx, bandits[0], 0.2)
+	s.UpdateReward(ctx, bandits[1], 0.5)
+	s.UpdateReward(ctx, bandits[2], 1)
+
+	want := softmax(s.Rewards[ctx], s.Temperature)
+	got := selectionShares(t, s, bandits, ctx, 20000)
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 0.02 {
+			t.Errorf("%s selected %.3f of the time, want %.3f", bandits[i].ItemID, got[i], want[i])
+		}
+	}
+}
+
+func TestSoftmaxUnknownContextIsUniform(t *testing.T) {
+	bandits := []*Bandit{{ItemID: "a"}, {ItemID: "b"}, {ItemID: "c"}, {ItemID: "d"}}
+	s := &SoftmaxStrategy{Temperature: 0.1, Bandits: bandits}
+	s.Seed(1)
+	s.UpdateReward(Context{UserID: "other"}, bandits[0], 1)
+
+	got := selectionShares(t, s, bandits, Context{UserID: "new"}, 20000)
+	for i := range got {
+		if math.Abs(got[i]-0.25) > 0.02 {
+			t.Errorf("%s selected %.3f of the time, want 0.25", bandits[i].ItemID, got[i])
+		}
+	}
+}
+
+func TestSoftmaxZeroTemperatureIsGreedy(t *testing.T) {
+	probs := softmax([]float64{0.1, 0.9, 0.3}, 0)
+	want := []float64{0, 1, 0}
+	for i := range want {
+		if probs[i] != want[i] {
+			t.Errorf("softmax() = %v, want %v", probs, want)
+			break
+		}
+	}
+}
+
+// selectionShares selects n bandits for ctx and returns how often each of
+// the bandits was selected.
+func selectionShares(t *testing.T, s Strategy, bandits []*Bandit, ctx Context, n int) []float64 {
+	t.Helper()
+
+	shares := make([]float64, len(bandits))
+	for i := 0; i < n; i++ {
+		b, err := s.SelectBandit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares[indexOf(bandits, b)] += 1 / float64(n)
+	}
+	return shares
+}
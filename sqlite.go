@@ -0,0 +1,409 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+var errNoModelStored = errors.New("no model stored")
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS strategy (
+	id                INTEGER PRIMARY KEY CHECK (id = 1),
+	epsilon           REAL NOT NULL,
+	epsilon_decay     REAL NOT NULL,
+	min_epsilon       REAL NOT NULL,
+	hash_buckets      INTEGER NOT NULL,
+	ignore_user       INTEGER NOT NULL,
+	min_samples       INTEGER NOT NULL,
+	backoff           TEXT NOT NULL,
+	alpha             REAL NOT NULL,
+	initial_reward    REAL NOT NULL,
+	cold_threshold    INTEGER NOT NULL,
+	smoothing         REAL NOT NULL,
+	max_contexts      INTEGER NOT NULL,
+	adaptive_epsilon  INTEGER NOT NULL,
+	use_popularity    INTEGER NOT NULL,
+	cumulative_regret REAL NOT NULL
+);
+CREATE TABLE IF NOT EXISTS bandits (
+	position   INTEGER PRIMARY KEY,
+	item_id    TEXT NOT NULL UNIQUE,
+	popularity REAL -- NULL for models without Popularity
+);
+CREATE TABLE IF NOT EXISTS bandit_rewards (
+	item_id     TEXT NOT NULL,
+	user_id     TEXT NOT NULL,
+	time_of_day TEXT NOT NULL,
+	weekday     TEXT NOT NULL,
+	device      TEXT NOT NULL,
+	reward      REAL NOT NULL,
+	PRIMARY KEY (item_id, user_id, time_of_day, weekday, device)
+);
+CREATE TABLE IF NOT EXISTS rewards (
+	user_id           TEXT NOT NULL,
+	time_of_day       TEXT NOT NULL,
+	weekday           TEXT NOT NULL,
+	device            TEXT NOT NULL,
+	item_id           TEXT NOT NULL,
+	reward            REAL NOT NULL,
+	count             INTEGER NOT NULL,
+	squared_deviation REAL NOT NULL,
+	PRIMARY KEY (user_id, time_of_day, weekday, device, item_id)
+);
+CREATE TABLE IF NOT EXISTS context_updates (
+	user_id     TEXT NOT NULL,
+	time_of_day TEXT NOT NULL,
+	weekday     TEXT NOT NULL,
+	device      TEXT NOT NULL,
+	updated_at  INTEGER NOT NULL, -- Unix nanoseconds
+	PRIMARY KEY (user_id, time_of_day, weekday, device)
+);
+`
+
+// SQLiteStore persists an EpsilonGreedyStrategy in a SQLite database with one
+// row per context and item, so a single reward can be saved without
+// rewriting the whole model.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLiteStore opens the database at path, creating the tables if needed.
+// Use ":memory:" for a database that only lives as long as the store.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // every connection to :memory: is a database of its own
+
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create tables: %w", err)
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+func (st *SQLiteStore) Close() error {
+	return st.db.Close()
+}
+
+// Save replaces the stored model with the strategy.
+func (st *SQLiteStore) Save(s *EpsilonGreedyStrategy) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"strategy", "bandits", "bandit_rewards", "rewards", "context_updates"} {
+		_, err = tx.Exec("DELETE FROM " + table)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = saveStrategyRow(tx, s)
+	if err != nil {
+		return err
+	}
+
+	for i, b := range s.Bandits {
+		var popularity sql.NullFloat64
+		if len(s.Popularity) == len(s.Bandits) {
+			popularity = sql.NullFloat64{Float64: s.Popularity[i], Valid: true}
+		}
+		_, err = tx.Exec("INSERT INTO bandits (position, item_id, popularity) VALUES (?, ?, ?)", i, b.ItemID, popularity)
+		if err != nil {
+			return err
+		}
+		for ctx, reward := range b.ContextRewards {
+			_, err = tx.Exec(`INSERT INTO bandit_rewards (item_id, user_id, time_of_day, weekday, device, reward)
+				VALUES (?, ?, ?, ?, ?, ?)`, b.ItemID, ctx.UserID, ctx.TimeOfDay, ctx.Weekday, ctx.Device, reward)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for ctx, rewards := range s.Rewards {
+		err = s.checkAligned(ctx)
+		if err != nil {
+			return err
+		}
+		for i, b := range s.Bandits {
+			err = saveRewardRow(tx, ctx, b.ItemID, rewards[i], s.Counts[ctx][i], s.squaredDeviation(ctx, i))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for ctx, updated := range s.LastUpdated {
+		err = saveUpdatedRow(tx, ctx, updated)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SaveUpdate saves the reward and count of the bandit in the context, along
+// with the exploration rate and regret, after an UpdateReward. The bandit
+// must already be in the store.
+func (st *SQLiteStore) SaveUpdate(s *EpsilonGreedyStrategy, ctx Context, b *Bandit) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := s.key(ctx)
+	i := slices.Index(s.Bandits, b)
+	if i < 0 || len(s.Rewards[key]) <= i || len(s.Counts[key]) <= i {
+		return fmt.Errorf("no reward for item %s in context %+v", b.ItemID, ctx)
+	}
+
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM strategy")
+	if err != nil {
+		return err
+	}
+	err = saveStrategyRow(tx, s)
+	if err != nil {
+		return err
+	}
+	err = saveRewardRow(tx, key, b.ItemID, s.Rewards[key][i], s.Counts[key][i], s.squaredDeviation(key, i))
+	if err != nil {
+		return err
+	}
+	if updated, ok := s.LastUpdated[key]; ok {
+		err = saveUpdatedRow(tx, key, updated)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func saveStrategyRow(tx *sql.Tx, s *EpsilonGreedyStrategy) error {
+	_, err := tx.Exec(`INSERT INTO strategy (id, epsilon, epsilon_decay, min_epsilon, hash_buckets, ignore_user, min_samples, backoff, alpha, initial_reward, cold_threshold, smoothing, max_contexts, adaptive_epsilon, use_popularity, cumulative_regret)
+		VALUES (1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, s.Epsilon, s.EpsilonDecay, s.MinEpsilon, s.HashBuckets, s.IgnoreUser, s.MinSamples,
+		strings.Join(s.Backoff, ","), s.Alpha, s.InitialReward, s.ColdThreshold, s.Smoothing, s.MaxContexts, s.AdaptiveEpsilon, s.UsePopularity, s.CumulativeRegret)
+	return err
+}
+
+func saveRewardRow(tx *sql.Tx, ctx Context, itemID string, reward float64, count int, squaredDeviation float64) error {
+	_, err := tx.Exec(`INSERT INTO rewards (user_id, time_of_day, weekday, device, item_id, reward, count, squared_deviation)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, time_of_day, weekday, device, item_id) DO UPDATE SET reward = excluded.reward, count = excluded.count, squared_deviation = excluded.squared_deviation`,
+		ctx.UserID, ctx.TimeOfDay, ctx.Weekday, ctx.Device, itemID, reward, count, squaredDeviation)
+	return err
+}
+
+func saveUpdatedRow(tx *sql.Tx, ctx Context, updated time.Time) error {
+	_, err := tx.Exec(`INSERT INTO context_updates (user_id, time_of_day, weekday, device, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, time_of_day, weekday, device) DO UPDATE SET updated_at = excluded.updated_at`,
+		ctx.UserID, ctx.TimeOfDay, ctx.Weekday, ctx.Device, updated.UnixNano())
+	return err
+}
+
+// ForgetUser deletes the contexts of the user and the rewards of the bandits
+// in them, in one transaction, after the strategy forgot them with
+// EpsilonGreedyStrategy.ForgetUser.
+func (st *SQLiteStore) ForgetUser(userID string) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"bandit_rewards", "rewards", "context_updates"} {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Load reads the stored model.
+func (st *SQLiteStore) Load() (*EpsilonGreedyStrategy, error) {
+	s := &EpsilonGreedyStrategy{
+		Rewards: make(map[Context][]float64),
+		Counts:  make(map[Context][]int),
+	}
+
+	var backoff string
+	err := st.db.QueryRow(`SELECT epsilon, epsilon_decay, min_epsilon, hash_buckets, ignore_user, min_samples, backoff, alpha, initial_reward, cold_threshold, smoothing, max_contexts, adaptive_epsilon, use_popularity, cumulative_regret FROM strategy`).
+		Scan(&s.Epsilon, &s.EpsilonDecay, &s.MinEpsilon, &s.HashBuckets, &s.IgnoreUser, &s.MinSamples, &backoff, &s.Alpha, &s.InitialReward, &s.ColdThreshold, &s.Smoothing, &s.MaxContexts, &s.AdaptiveEpsilon, &s.UsePopularity, &s.CumulativeRegret)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNoModelStored
+	}
+	if err != nil {
+		return nil, err
+	}
+	if backoff != "" {
+		s.Backoff = strings.Split(backoff, ",")
+	}
+
+	positions := map[string]int{}
+	rows, err := st.db.Query("SELECT item_id, popularity FROM bandits ORDER BY position")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hasPopularity := true
+	for rows.Next() {
+		b := &Bandit{ContextRewards: make(map[Context]float64)}
+		var popularity sql.NullFloat64
+		err = rows.Scan(&b.ItemID, &popularity)
+		if err != nil {
+			return nil, err
+		}
+		positions[b.ItemID] = len(s.Bandits)
+		s.Bandits = append(s.Bandits, b)
+		s.Popularity = append(s.Popularity, popularity.Float64)
+		hasPopularity = hasPopularity && popularity.Valid
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if !hasPopularity {
+		s.Popularity = nil
+	}
+
+	rows, err = st.db.Query("SELECT item_id, user_id, time_of_day, weekday, device, reward FROM bandit_rewards")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var itemID string
+		var ctx Context
+		var reward float64
+		err = rows.Scan(&itemID, &ctx.UserID, &ctx.TimeOfDay, &ctx.Weekday, &ctx.Device, &reward)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := positions[itemID]
+		if !ok {
+			return nil, fmt.Errorf("reward for unknown item %s", itemID)
+		}
+		s.Bandits[i].ContextRewards[ctx] = reward
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = st.db.Query("SELECT user_id, time_of_day, weekday, device, item_id, reward, count, squared_deviation FROM rewards")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ctx Context
+		var itemID string
+		var reward, squaredDeviation float64
+		var count int
+		err = rows.Scan(&ctx.UserID, &ctx.TimeOfDay, &ctx.Weekday, &ctx.Device, &itemID, &reward, &count, &squaredDeviation)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := positions[itemID]
+		if !ok {
+			return nil, fmt.Errorf("reward for unknown item %s", itemID)
+		}
+		if _, ok := s.Rewards[ctx]; !ok {
+			s.initContext(ctx)
+		}
+		s.Rewards[ctx][i] = reward
+		s.Counts[ctx][i] = count
+		if s.SquaredDeviations == nil {
+			s.SquaredDeviations = make(map[Context][]float64)
+		}
+		if _, ok := s.SquaredDeviations[ctx]; !ok {
+			s.SquaredDeviations[ctx] = make([]float64, len(s.Bandits))
+		}
+		s.SquaredDeviations[ctx][i] = squaredDeviation
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = st.db.Query("SELECT user_id, time_of_day, weekday, device, updated_at FROM context_updates")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ctx Context
+		var updated int64
+		err = rows.Scan(&ctx.UserID, &ctx.TimeOfDay, &ctx.Weekday, &ctx.Device, &updated)
+		if err != nil {
+			return nil, err
+		}
+		if s.LastUpdated == nil {
+			s.LastUpdated = make(map[Context]time.Time)
+		}
+		s.LastUpdated[ctx] = time.Unix(0, updated).UTC()
+	}
+
+	return s, rows.Err()
+}
+
+// sqliteModelPath returns the path of the database of the named model, path
+// for the default model and path with the name before its extension for the
+// others, e.g. models-email.db.
+func sqliteModelPath(path string, name string) string {
+	if name == defaultModelName {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + name + ext
+}
+
+// loadSQLiteModel loads the model stored in the database, or the model in
+// filename if there is none yet, storing it in the database.
+func loadSQLiteModel(st *SQLiteStore, filename string, seed int64) (*EpsilonGreedyStrategy, error) {
+	s, err := st.Load()
+	if err == nil {
+		slog.Info("Loaded model from SQLite")
+		s.Seed(seed)
+		return s, nil
+	}
+	if !errors.Is(err, errNoModelStored) {
+		return nil, fmt.Errorf("could not load the model from SQLite: %w", err)
+	}
+
+	slog.Info("Loading model", "file", filename)
+	s, err = loadModel(filename, seed)
+	if err != nil {
+		return nil, err
+	}
+	err = st.Save(s)
+	if err != nil {
+		return nil, fmt.Errorf("could not store the model in SQLite: %w", err)
+	}
+	slog.Info("Stored model in SQLite")
+	return s, nil
+}
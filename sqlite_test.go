@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// checkSameModel fails the test unless got has the bandits and learned
+// rewards of want.
+func checkSameModel(t *testing.T, got, want *EpsilonGreedyStrategy) {
+	t.Helper()
+
+	if got.Epsilon != want.Epsilon || got.CumulativeRegret != want.CumulativeRegret {
+		t.Errorf("epsilon %v and regret %v, want %v and %v", got.Epsilon, got.CumulativeRegret, want.Epsilon, want.CumulativeRegret)
+	}
+	if len(got.Bandits) != len(want.Bandits) {
+		t.Fatalf("bandits %v, want %v", itemIDs(got.Bandits), itemIDs(want.Bandits))
+	}
+	for i := range want.Bandits {
+		if got.Bandits[i].ItemID != want.Bandits[i].ItemID || !reflect.DeepEqual(got.Bandits[i].ContextRewards, want.Bandits[i].ContextRewards) {
+			t.Errorf("bandit %d = %+v, want %+v", i, got.Bandits[i], want.Bandits[i])
+		}
+	}
+	if !reflect.DeepEqual(got.Rewards, want.Rewards) {
+		t.Errorf("rewards = %v, want %v", got.Rewards, want.Rewards)
+	}
+	if !reflect.DeepEqual(got.Counts, want.Counts) {
+		t.Errorf("counts = %v, want %v", got.Counts, want.Counts)
+	}
+	if !reflect.DeepEqual(got.SquaredDeviations, want.SquaredDeviations) {
+		t.Errorf("squared deviations = %v, want %v", got.SquaredDeviations, want.SquaredDeviations)
+	}
+	if len(got.LastUpdated) != len(want.LastUpdated) {
+		t.Errorf("last updated = %v, want %v", got.LastUpdated, want.LastUpdated)
+	}
+	for ctx, updated := range want.LastUpdated {
+		if !got.LastUpdated[ctx].Equal(updated) {
+			t.Errorf("last updated %+v = %v, want %v", ctx, got.LastUpdated[ctx], updated)
+		}
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	store, err := OpenSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	_, err = store.Load()
+	if err != errNoModelStored {
+		t.Errorf("Load() of an empty store: error = %v, want %v", err, errNoModelStored)
+	}
+
+	s := newTestStrategy("a", "b")
+	other := Context{UserID: "u2", TimeOfDay: "night", Weekday: "sunday", Device: "desktop"}
+	s.UpdateReward(testContext, s.Bandits[0], 1)
+	s.UpdateReward(testContext, s.Bandits[0], 0)
+	s.UpdateReward(other, s.Bandits[1], 0.5)
+	s.Bandits[1].ContextRewards[other] = 2
+	err = store.Save(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameModel(t, loaded, s)
+
+	// an online update only saves its own context and item
+	s.UpdateReward(other, s.Bandits[1], 1)
+	err = store.SaveUpdate(s, other, s.Bandits[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameModel(t, loaded, s)
+}
+
+func TestServeWithSQLite(t *testing.T) {
+	captureLogs(t, slog.LevelWarn)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "strategy.gob")
+	if err := newTestStrategy("a", "b").SaveState(filename); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "models.db")
+	files := map[string]string{defaultModelName: filename}
+
+	// the first start stores the model of the file in the database
+	models, err := loadModels(files, nil, dbPath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newServer(models).routes()
+	body := `{"user": "u1", "time": "morning", "weekday": "monday", "device": "mobile", "item_id": "b", "reward": 1}`
+	if status := do(t, h, http.MethodPost, "/reward", body, nil); status != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", status, http.StatusNoContent)
+	}
+	if err := models.save(); err != nil {
+		t.Fatal(err)
+	}
+	models.models[defaultModelName].db.Close()
+
+	// the reward is in the database, without rewriting the model file
+	after, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("the model file was rewritten")
+	}
+	models, err = loadModels(files, nil, dbPath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer models.models[defaultModelName].db.Close()
+	if mean, n := models.models[defaultModelName].strategy.Confidence(testContext, "b"); mean != 1 || n != 1 {
+		t.Errorf("b after a restart = %v from %d rewards, want 1 from 1 from the database", mean, n)
+	}
+
+	// forgetting the user deletes them from the database too
+	h = newServer(models).routes()
+	if status := do(t, h, http.MethodPost, "/forget", `{"user": "u1"}`, nil); status != http.StatusOK {
+		t.Fatalf("forget status = %d, want %d", status, http.StatusOK)
+	}
+	db, err := OpenSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	loaded, err := db.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Rewards) != 0 {
+		t.Errorf("rewards in the database after forgetting the user = %v, want none", loaded.Rewards)
+	}
+}
+
+func TestSQLiteModelPath(t *testing.T) {
+	if got := sqliteModelPath("data/models.db", defaultModelName); got != "data/models.db" {
+		t.Errorf("path of the default model = %s, want data/models.db", got)
+	}
+	if got := sqliteModelPath("data/models.db", "email"); got != "data/models-email.db" {
+		t.Errorf("path of model email = %s, want data/models-email.db", got)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ModelStats summarizes a trained model.
+type ModelStats struct {
+	Metadata ModelMetadata // zero for models saved without metadata
+	Bandits  int
+	Contexts int
+	TopItems []ContextTopItem  // sorted by context
+	Pulls    []ItemPulls       // most pulled first
+	Coverage []ContextCoverage // least pulled first
+}
+
+// ContextTopItem is the item with the highest reward in a context.
+type ContextTopItem struct {
+	Context Context
+	ItemID  string
+	Reward  float64
+	Tied    []string // other items with the same reward, selection picks between them at random
+}
+
+// ItemPulls is how many times an item was pulled over all contexts.
+type ItemPulls struct {
+	ItemID string
+	Pulls  int
+}
+
+// ItemEstimate is the estimated reward of an item in a context.
+type ItemEstimate struct {
+	ItemID string
+	Reward float64
+	Count  int  // of the rewards the estimate is based on
+	Best   bool // exploiting the context picks it, or another one tied with it
+}
+
+// InspectContext returns the estimate of every item in the context, highest
+// reward first, or nil if the model has no rewards for the context.
+func (s *EpsilonGreedyStrategy) InspectContext(ctx Context) []ItemEstimate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := s.key(ctx)
+	rewards, counts := s.Rewards[key], s.Counts[key]
+	if len(rewards) == 0 || s.checkAligned(key) != nil {
+		return nil
+	}
+
+	best := argmax(rewards)
+	estimates := make([]ItemEstimate, len(s.Bandits))
+	for i, b := range s.Bandits {
+		estimates[i] = ItemEstimate{ItemID: b.ItemID, Reward: rewards[i], Count: counts[i], Best: i == best}
+	}
+	sort.SliceStable(estimates, func(i, j int) bool {
+		if estimates[i].Reward != estimates[j].Reward {
+			return estimates[i].Reward > estimates[j].Reward
+		}
+		return estimates[i].Best // the best first among ties
+	})
+	return estimates
+}
+
+// ItemWins is in how many contexts an item has the highest reward.
+type ItemWins struct {
+	ItemID string
+	Wins   int // contexts it alone has the highest reward in
+	Ties   int // contexts it shares the highest reward in with other items
+}
+
+// TopItemsReport returns in how many contexts every item has the highest
+// reward, most wins first, to tell which items win overall. Contexts where
+// items tie are counted apart, as selection picks between them at random.
+func (s *EpsilonGreedyStrategy) TopItemsReport() []ItemWins {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	report := make([]ItemWins, len(s.Bandits))
+	for i, b := range s.Bandits {
+		report[i].ItemID = b.ItemID
+	}
+	for ctx, rewards := range s.Rewards {
+		if len(rewards) == 0 || s.checkAligned(ctx) != nil {
+			continue
+		}
+		ties := argmaxTies(rewards)
+		if len(ties) == 1 {
+			report[ties[0]].Wins++
+			continue
+		}
+		for _, i := range ties {
+			report[i].Ties++
+		}
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Wins != report[j].Wins {
+			return report[i].Wins > report[j].Wins
+		}
+		if report[i].Ties != report[j].Ties {
+			return report[i].Ties > report[j].Ties
+		}
+		return report[i].ItemID < report[j].ItemID
+	})
+	return report
+}
+
+// ContextCoverage is how many times the items were pulled in a context, to
+// find the contexts that need more data.
+type ContextCoverage struct {
+	Context  Context
+	Pulls    int // over all the items
+	MinPulls int // of the least pulled item
+	MaxPulls int // of the most pulled item
+}
+
+// CoverageReport returns the coverage of every context, least pulled first.
+func (s *EpsilonGreedyStrategy) CoverageReport() []ContextCoverage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.coverageReport()
+}
+
+func (s *EpsilonGreedyStrategy) coverageReport() []ContextCoverage {
+	report := []ContextCoverage{}
+	for _, ctx := range s.sortedContexts() {
+		counts := s.Counts[ctx]
+		if len(counts) == 0 {
+			continue
+		}
+		c := ContextCoverage{Context: ctx, MinPulls: counts[0], MaxPulls: counts[0]}
+		for _, n := range counts {
+			c.Pulls += n
+			c.MinPulls = min(c.MinPulls, n)
+			c.MaxPulls = max(c.MaxPulls, n)
+		}
+		report = append(report, c)
+	}
+	sort.SliceStable(report, func(i, j int) bool {
+		return report[i].Pulls < report[j].Pulls
+	})
+	return report
+}
+
+func (s *EpsilonGreedyStrategy) Stats() ModelStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := ModelStats{
+		Metadata: s.metadata,
+		Bandits:  len(s.Bandits),
+		Contexts: len(s.Rewards),
+	}
+
+	pulls := make([]int, len(s.Bandits))
+	for _, ctx := range s.sortedContexts() {
+		rewards := s.Rewards[ctx]
+		if len(rewards) == 0 || s.checkAligned(ctx) != nil {
+			continue
+		}
+		ties := argmaxTies(rewards)
+		top := ContextTopItem{Context: ctx, ItemID: s.Bandits[ties[0]].ItemID, Reward: rewards[ties[0]]}
+		for _, i := range ties[1:] {
+			top.Tied = append(top.Tied, s.Bandits[i].ItemID)
+		}
+		stats.TopItems = append(stats.TopItems, top)
+		for i, n := range s.Counts[ctx] {
+			pulls[i] += n
+		}
+	}
+
+	for i, b := range s.Bandits {
+		stats.Pulls = append(stats.Pulls, ItemPulls{b.ItemID, pulls[i]})
+	}
+	sort.SliceStable(stats.Pulls, func(i, j int) bool {
+		return stats.Pulls[i].Pulls > stats.Pulls[j].Pulls
+	})
+	stats.Coverage = s.coverageReport()
+
+	return stats
+}
+
+func printStats(w io.Writer, stats ModelStats) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if meta := stats.Metadata; !meta.TrainedAt.IsZero() {
+		fmt.Fprintf(tw, "Trained at:\t%s\n", meta.TrainedAt.Format(time.RFC3339))
+		fmt.Fprintf(tw, "Strategy:\t%s\n", meta.Strategy)
+		fmt.Fprintf(tw, "Source:\t%s\n", meta.Source)
+		fmt.Fprintf(tw, "Rows:\t%d\n", meta.Rows)
+		fmt.Fprintf(tw, "Epsilon:\t%g\n", meta.Epsilon)
+		fmt.Fprintf(tw, "Trained by:\t%s\n", meta.Version)
+	}
+	fmt.Fprintf(tw, "Bandits:\t%d\n", stats.Bandits)
+	fmt.Fprintf(tw, "Contexts:\t%d\n", stats.Contexts)
+
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "USER\tTIME\tWEEKDAY\tDEVICE\tTOP ITEM\tREWARD")
+	for _, top := range stats.TopItems {
+		c := top.Context
+		item := top.ItemID
+		if len(top.Tied) > 0 {
+			item += " (tied with " + strings.Join(top.Tied, ", ") + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%.4f\n", c.UserID, c.TimeOfDay, c.Weekday, c.Device, item, top.Reward)
+	}
+
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "ITEM\tPULLS")
+	for _, p := range stats.Pulls {
+		fmt.Fprintf(tw, "%s\t%d\n", p.ItemID, p.Pulls)
+	}
+
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "USER\tTIME\tWEEKDAY\tDEVICE\tPULLS\tMIN ITEM PULLS\tMAX ITEM PULLS")
+	for _, c := range stats.Coverage {
+		ctx := c.Context
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\n", ctx.UserID, ctx.TimeOfDay, ctx.Weekday, ctx.Device, c.Pulls, c.MinPulls, c.MaxPulls)
+	}
+
+	return tw.Flush()
+}
+
+func printTopItems(w io.Writer, report []ItemWins) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ITEM\tCONTEXTS WON\tCONTEXTS TIED")
+	for _, item := range report {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", item.ItemID, item.Wins, item.Ties)
+	}
+	return tw.Flush()
+}
+
+// inspectContext prints the estimate of every item in the context of the
+// model in the file.
+func inspectContext(w io.Writer, filename string, ctx Context, seed int64) error {
+	s, err := loadModel(filename, seed)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Context:\t%s\n", formatContext(s.key(ctx)))
+	estimates := s.InspectContext(ctx)
+	if estimates == nil {
+		fmt.Fprintln(tw, "The model has no rewards for the context.")
+		return tw.Flush()
+	}
+
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "BEST\tITEM\tREWARD\tCOUNT")
+	for _, e := range estimates {
+		best := ""
+		if e.Best {
+			best = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.4f\t%d\n", best, e.ItemID, e.Reward, e.Count)
+	}
+	return tw.Flush()
+}
+
+func formatContext(ctx Context) string {
+	return fmt.Sprintf("user=%s time=%s weekday=%s device=%s", ctx.UserID, ctx.TimeOfDay, ctx.Weekday, ctx.Device)
+}
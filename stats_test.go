@@ -0,0 +1,188 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// saveAndLoad saves the strategy to a temporary file and loads it back like
+// the commands reading a model do.
+func saveAndLoad(t *testing.T, s *EpsilonGreedyStrategy) (*EpsilonGreedyStrategy, string) {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "strategy.gob")
+	err := s.SaveState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadModel(filename, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loaded, filename
+}
+
+func TestStats(t *testing.T) {
+	s := newTestStrategy("a", "b", "c")
+	other := Context{UserID: "u2", TimeOfDay: "night", Weekday: "sunday", Device: "desktop"}
+	s.UpdateReward(testContext, s.Bandits[0], 0.2)
+	s.UpdateReward(testContext, s.Bandits[1], 1)
+	s.UpdateReward(testContext, s.Bandits[1], 0.8)
+	s.UpdateReward(other, s.Bandits[2], 0.5)
+	s, _ = saveAndLoad(t, s)
+
+	stats := s.Stats()
+	if stats.Bandits != 3 || stats.Contexts != 2 {
+		t.Errorf("%d bandits and %d contexts, want 3 and 2", stats.Bandits, stats.Contexts)
+	}
+	wantTop := []ContextTopItem{
+		{Context: testContext, ItemID: "b", Reward: 0.9},
+		{Context: other, ItemID: "c", Reward: 0.5},
+	}
+	if !reflect.DeepEqual(stats.TopItems, wantTop) {
+		t.Errorf("top items = %+v, want %+v", stats.TopItems, wantTop)
+	}
+	wantPulls := []ItemPulls{{"b", 2}, {"a", 1}, {"c", 1}}
+	if !reflect.DeepEqual(stats.Pulls, wantPulls) {
+		t.Errorf("pulls = %+v, want %+v", stats.Pulls, wantPulls)
+	}
+
+	var out strings.Builder
+	err := printStats(&out, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Bandits: 3", "Contexts: 2", "u1 morning monday mobile b 0.9000"} {
+		if !containsLine(out.String(), want) {
+			t.Errorf("stats don't contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+// containsLine reports whether the table has a line with the fields of want,
+// however they are aligned.
+func containsLine(table string, want string) bool {
+	for _, line := range strings.Split(table, "\n") {
+		if strings.Join(strings.Fields(line), " ") == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCoverageReport(t *testing.T) {
+	s := newTestStrategy("a", "b", "c")
+	contexts := []Context{testContext, {UserID: "u2"}, {UserID: "u3"}}
+	err := trainStrategy(s, contexts[:1], 50, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateReward(contexts[1], s.Bandits[0], 1)
+	s.UpdateReward(contexts[1], s.Bandits[0], 1)
+	s.UpdateReward(contexts[1], s.Bandits[2], 0)
+	err = trainStrategy(s, contexts[2:], 20, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := s.CoverageReport()
+	if len(report) != len(s.Counts) {
+		t.Fatalf("%d contexts in the report, want the %d counted", len(report), len(s.Counts))
+	}
+	for i, c := range report {
+		counts := s.Counts[c.Context]
+		if c.Pulls != sum(counts) || c.MinPulls != slices.Min(counts) || c.MaxPulls != slices.Max(counts) {
+			t.Errorf("coverage of %+v = %d pulls, %d to %d per item, want those of Counts %v", c.Context, c.Pulls, c.MinPulls, c.MaxPulls, counts)
+		}
+		if i > 0 && report[i-1].Pulls > c.Pulls {
+			t.Errorf("%+v with %d pulls comes after one with %d, want the least pulled first", c.Context, c.Pulls, report[i-1].Pulls)
+		}
+	}
+	if report[0].Context != contexts[1] || report[0].Pulls != 3 || report[0].MinPulls != 0 || report[0].MaxPulls != 2 {
+		t.Errorf("least covered = %+v, want u2 with 3 pulls, 0 to 2 per item", report[0])
+	}
+
+	var out strings.Builder
+	if err := printStats(&out, s.Stats()); err != nil {
+		t.Fatal(err)
+	}
+	if !containsLine(out.String(), "u2 3 0 2") {
+		t.Errorf("stats missing the coverage of u2:\n%s", out.String())
+	}
+}
+
+func TestTopItemsReport(t *testing.T) {
+	s := newTestStrategy("a", "b", "c", "d")
+	wins := map[string]int{"u1": 1, "u2": 1, "u3": 0, "u4": 1}
+	for user, best := range wins {
+		ctx := Context{UserID: user}
+		s.UpdateReward(ctx, s.Bandits[best], 1)
+		s.UpdateReward(ctx, s.Bandits[2], 0.5)
+	}
+	tied := Context{UserID: "u5"}
+	s.UpdateReward(tied, s.Bandits[0], 0.8)
+	s.UpdateReward(tied, s.Bandits[2], 0.8)
+
+	want := []ItemWins{
+		{ItemID: "b", Wins: 3},
+		{ItemID: "a", Wins: 1, Ties: 1},
+		{ItemID: "c", Ties: 1},
+		{ItemID: "d"},
+	}
+	if got := s.TopItemsReport(); !reflect.DeepEqual(got, want) {
+		t.Errorf("TopItemsReport() = %+v, want %+v", got, want)
+	}
+
+	var out strings.Builder
+	if err := printTopItems(&out, s.TopItemsReport()); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"ITEM CONTEXTS WON CONTEXTS TIED", "b 3 0", "a 1 1", "c 0 1", "d 0 0"} {
+		if !containsLine(out.String(), line) {
+			t.Errorf("report missing %q:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestInspectCommand(t *testing.T) {
+	s := newTestStrategy("a", "b", "c")
+	s.UpdateReward(testContext, s.Bandits[0], 0)
+	s.UpdateReward(testContext, s.Bandits[0], 0.4)
+	s.UpdateReward(testContext, s.Bandits[1], 1)
+	s.UpdateReward(testContext, s.Bandits[2], 0.5)
+	_, filename := saveAndLoad(t, s)
+
+	// the context is normalized like when serving
+	out, err := runMain(t, "inspect", "-model", filename, "-user", "u1", "-time", "Morning", "-weekday", "MONDAY", "-device", "Mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"Context:", "user=u1", "time=morning", "weekday=monday", "device=mobile"},
+		{},
+		{"BEST", "ITEM", "REWARD", "COUNT"},
+		{"*", "b", "1.0000", "1"},
+		{"c", "0.5000", "1"},
+		{"a", "0.2000", "2"},
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("inspect printed %q, want %d lines", out, len(want))
+	}
+	for i, line := range lines {
+		if got := strings.Fields(line); !slices.Equal(got, want[i]) {
+			t.Errorf("line %d = %q, want %q", i+1, line, strings.Join(want[i], " "))
+		}
+	}
+
+	out, err = runMain(t, "inspect", "-model", filename, "-user", "u2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "The model has no rewards for the context.") {
+		t.Errorf("inspect of an unknown context printed %q, want it to say so", out)
+	}
+}
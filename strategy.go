@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// strategies makes an untrained strategy of every kind that can be given
+// with -strategy.
+var strategies = map[string]func(bandits []*Bandit) Strategy{
+	"epsilon": func(bandits []*Bandit) Strategy {
+		return &EpsilonGreedyStrategy{
+			Epsilon: 0.1, // fraction of exploration 0.1 = 10% exploration
+			Bandits: bandits,
+			Rewards: make(map[Context][]float64),
+			Counts:  make(map[Context][]int),
+		}
+	},
+	"ucb1": func(bandits []*Bandit) Strategy {
+		return &UCB1Strategy{Bandits: bandits, Rewards: make(map[Context][]float64), Counts: make(map[Context][]int)}
+	},
+	"thompson": func(bandits []*Bandit) Strategy {
+		return &ThompsonSamplingStrategy{Bandits: bandits}
+	},
+	"softmax": func(bandits []*Bandit) Strategy {
+		return &SoftmaxStrategy{Temperature: 0.1, Bandits: bandits, Rewards: make(map[Context][]float64), Counts: make(map[Context][]int)}
+	},
+	"exp3": func(bandits []*Bandit) Strategy {
+		return &EXP3Strategy{Gamma: 0.1, Alpha: 1e-3, Bandits: bandits}
+	},
+	"linucb": func(bandits []*Bandit) Strategy {
+		return &LinUCBStrategy{Alpha: 1.0, Bandits: bandits}
+	},
+	"greedy": func(bandits []*Bandit) Strategy {
+		return &GreedyStrategy{Bandits: bandits, Rewards: make(map[Context][]float64), Counts: make(map[Context][]int)}
+	},
+	"random": func(bandits []*Bandit) Strategy {
+		return &RandomStrategy{Bandits: bandits}
+	},
+}
+
+const defaultStrategy = "epsilon"
+
+// Register every kind of strategy with gob under its name, so a Strategy
+// interface value can be encoded, see SaveStrategy.
+func init() {
+	for name, newFunc := range strategies {
+		gob.RegisterName(name, newFunc(nil))
+	}
+}
+
+// strategyNames returns the names of the strategies in order.
+func strategyNames() []string {
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newStrategy returns an untrained strategy of the named kind.
+func newStrategy(name string, bandits []*Bandit) (Strategy, error) {
+	newFunc, ok := strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %q, must be one of %s", name, strings.Join(strategyNames(), ", "))
+	}
+	return newFunc(bandits), nil
+}
+
+// strategyName returns the name newStrategy knows the kind of s by.
+func strategyName(s Strategy) (string, error) {
+	switch s.(type) {
+	case *EpsilonGreedyStrategy:
+		return "epsilon", nil
+	case *UCB1Strategy:
+		return "ucb1", nil
+	case *ThompsonSamplingStrategy:
+		return "thompson", nil
+	case *SoftmaxStrategy:
+		return "softmax", nil
+	case *EXP3Strategy:
+		return "exp3", nil
+	case *LinUCBStrategy:
+		return "linucb", nil
+	case *GreedyStrategy:
+		return "greedy", nil
+	case *RandomStrategy:
+		return "random", nil
+	}
+	return "", fmt.Errorf("unknown strategy type %T", s)
+}
+
+// ModelMetadata describes how a model was trained.
+type ModelMetadata struct {
+	TrainedAt time.Time `json:"trained_at"`
+	Rows      int       `json:"rows"`     // training rows, after holding out the test rows
+	Bandits   int       `json:"bandits"`  // at training time
+	Epsilon   float64   `json:"epsilon"`  // at the start of training
+	Strategy  string    `json:"strategy"` // name of the strategy, as given to newStrategy
+	Source    string    `json:"source"`   // where the training data came from
+	Version   string    `json:"version"`  // of smokey, see versionString
+}
+
+// modelMagic starts a model file, followed by its ModelMetadata as JSON on a
+// line of its own and then the strategy as gob, gzipped or not. Files without
+// it are epsilon-greedy models saved before the metadata was recorded.
+var modelMagic = []byte("smokey-model\n")
+
+// writeModelHeader writes the header with the metadata, recording the kind
+// of s as its strategy.
+func writeModelHeader(w io.Writer, s Strategy, meta ModelMetadata) error {
+	name, err := strategyName(s)
+	if err != nil {
+		return err
+	}
+	meta.Strategy = name
+
+	_, err = w.Write(modelMagic)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(meta) // ends with a newline
+}
+
+// readModelHeader returns the metadata in the header of a model file. Files
+// without a header are epsilon-greedy models without metadata, and headers
+// with just the name of the strategy are from before the metadata was added.
+func readModelHeader(r *bufio.Reader) (ModelMetadata, error) {
+	magic, _ := r.Peek(len(modelMagic))
+	if !bytes.Equal(magic, modelMagic) {
+		return ModelMetadata{Strategy: defaultStrategy}, nil
+	}
+	r.Discard(len(modelMagic))
+
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return ModelMetadata{}, fmt.Errorf("invalid model header: %w", err)
+	}
+	if !bytes.HasPrefix(line, []byte("{")) {
+		return ModelMetadata{Strategy: strings.TrimSpace(string(line))}, nil
+	}
+	var meta ModelMetadata
+	err = json.Unmarshal(line, &meta)
+	if err != nil {
+		return ModelMetadata{}, fmt.Errorf("invalid model header: %w", err)
+	}
+	return meta, nil
+}
+
+// checkModelHeader reads the header of a model file and checks that it holds
+// a strategy of the same kind as s.
+func checkModelHeader(r *bufio.Reader, s Strategy) (ModelMetadata, error) {
+	meta, err := readModelHeader(r)
+	if err != nil {
+		return ModelMetadata{}, err
+	}
+	want, err := strategyName(s)
+	if err != nil {
+		return ModelMetadata{}, err
+	}
+	if meta.Strategy != want {
+		return ModelMetadata{}, fmt.Errorf("the model is a %s model, not %s", meta.Strategy, want)
+	}
+	return meta, nil
+}
+
+// saveModel writes the strategy and its metadata to filename, recording its
+// kind so loadStrategy can read it back.
+func saveModel(filename string, s Strategy, meta ModelMetadata) error {
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		err := writeModelHeader(w, s, meta)
+		if err != nil {
+			return err
+		}
+		if e, ok := s.(interface{ Encode(io.Writer) error }); ok {
+			return e.Encode(w)
+		}
+		return gob.NewEncoder(w).Encode(s)
+	})
+}
+
+// SaveStrategy writes the strategy as a gob of a Strategy interface value,
+// which records its kind, so LoadStrategy reads back a strategy of the same
+// kind. Unlike saveModel it writes neither a header nor metadata, e.g. to
+// keep strategies in other gob encoded values.
+func SaveStrategy(s Strategy, w io.Writer) error {
+	if e, ok := s.(*EpsilonGreedyStrategy); ok {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+	}
+	return gob.NewEncoder(w).Encode(&s)
+}
+
+// LoadStrategy reads a strategy written by SaveStrategy.
+func LoadStrategy(r io.Reader) (Strategy, error) {
+	var s Strategy
+	err := gob.NewDecoder(r).Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadStrategy reads a model saved by any of the strategies.
+func loadStrategy(filename string) (Strategy, ModelMetadata, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, ModelMetadata{}, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	meta, err := readModelHeader(r)
+	if err != nil {
+		return nil, ModelMetadata{}, err
+	}
+
+	s, err := newStrategy(meta.Strategy, nil)
+	if err != nil {
+		return nil, ModelMetadata{}, err
+	}
+	if e, ok := s.(*EpsilonGreedyStrategy); ok {
+		e.metadata = meta
+	}
+	if d, ok := s.(interface{ Decode(io.Reader) error }); ok {
+		err = d.Decode(r)
+	} else {
+		err = decodeGob(r, s)
+	}
+	if err != nil {
+		return nil, ModelMetadata{}, err
+	}
+
+	return s, meta, nil
+}
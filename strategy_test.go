@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewStrategy(t *testing.T) {
+	for _, name := range []string{"epsilon", "ucb1", "thompson", "softmax", "exp3", "linucb", "greedy", "random"} {
+		t.Run(name, func(t *testing.T) {
+			bandits := []*Bandit{{ItemID: "a"}, {ItemID: "b"}}
+			s, err := newStrategy(name, bandits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := strategyName(s); err != nil || got != name {
+				t.Errorf("strategyName() = %q, %v, want %q", got, err, name)
+			}
+			s.UpdateReward(testContext, bandits[1], 1)
+			if _, err := s.SelectBandit(testContext); err != nil {
+				t.Errorf("SelectBandit() error = %v", err)
+			}
+
+			// loading picks the kind of strategy the model was saved as
+			filename := filepath.Join(t.TempDir(), "model.gob")
+			if err := saveModel(filename, s, ModelMetadata{}); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := loadAnyModel(filename, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reflect.TypeOf(loaded) != reflect.TypeOf(s) {
+				t.Errorf("loaded a %T, want a %T", loaded, s)
+			}
+		})
+	}
+
+	_, err := newStrategy("bogus", nil)
+	if err == nil || !strings.Contains(err.Error(), `unknown strategy "bogus"`) {
+		t.Errorf("newStrategy(bogus) error = %v, want an unknown strategy error", err)
+	}
+}
+
+func TestModelMetadataRoundTrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "model.gob")
+	before := time.Now().UTC()
+	err := trainModel(&CSVDataSource{Path: "testdata/training.csv"}, TrainConfig{
+		Reward:     defaultRewardConfig,
+		Seed:       1,
+		ModelFile:  filename,
+		Iterations: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, meta, err := loadStrategy(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.TrainedAt.Before(before.Truncate(time.Second)) || meta.TrainedAt.After(time.Now()) {
+		t.Errorf("trained at %v, want the time of training", meta.TrainedAt)
+	}
+	want := ModelMetadata{
+		TrainedAt: meta.TrainedAt,
+		Rows:      5,
+		Bandits:   2,
+		Epsilon:   0.1,
+		Strategy:  "epsilon",
+		Source:    "csv:testdata/training.csv",
+		Version:   versionString(),
+	}
+	if meta != want {
+		t.Errorf("metadata = %+v, want %+v", meta, want)
+	}
+
+	// saving the model again keeps the metadata
+	s, err := loadModel(filename, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ = saveAndLoad(t, s)
+	if got := s.Metadata(); got != meta {
+		t.Errorf("metadata after saving again = %+v, want %+v", got, meta)
+	}
+
+	var out strings.Builder
+	if err := printStats(&out, s.Stats()); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"Strategy: epsilon", "Source: csv:testdata/training.csv", "Rows: 5", "Epsilon: 0.1"} {
+		if !containsLine(out.String(), line) {
+			t.Errorf("stats missing %q:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestSaveStrategyRoundTrip(t *testing.T) {
+	for _, name := range strategyNames() {
+		t.Run(name, func(t *testing.T) {
+			bandits := []*Bandit{{ItemID: "a"}, {ItemID: "b"}}
+			s, err := newStrategy(name, bandits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.UpdateReward(testContext, bandits[1], 1)
+
+			var buf bytes.Buffer
+			if err := SaveStrategy(s, &buf); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := LoadStrategy(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reflect.TypeOf(loaded) != reflect.TypeOf(s) {
+				t.Fatalf("LoadStrategy() = %T, want a %T", loaded, s)
+			}
+			if got, err := strategyName(loaded); err != nil || got != name {
+				t.Errorf("strategyName() of the loaded strategy = %q, %v, want %q", got, err, name)
+			}
+			if _, err := loaded.SelectBandit(testContext); err != nil {
+				t.Errorf("SelectBandit() of the loaded strategy error = %v", err)
+			}
+		})
+	}
+
+	s := newTestStrategy("a", "b")
+	s.UpdateReward(testContext, s.Bandits[1], 0.5)
+	var buf bytes.Buffer
+	if err := SaveStrategy(s, &buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadStrategy(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.(*EpsilonGreedyStrategy).Rewards[testContext]; !reflect.DeepEqual(got, []float64{0, 0.5}) {
+		t.Errorf("loaded rewards = %v, want [0 0.5]", got)
+	}
+
+	if _, err := LoadStrategy(strings.NewReader("not a strategy")); err == nil {
+		t.Error("LoadStrategy() of garbage succeeded, want an error")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// ThompsonSamplingStrategy models the click rate of every bandit in a context
+// as a Beta(alpha, beta) distribution and picks the bandit with the highest
+// sampled click rate. All arms start from a uniform Beta(1, 1) prior.
+type ThompsonSamplingStrategy struct {
+	Bandits []*Bandit
+	Alpha   map[Context][]float64
+	Beta    map[Context][]float64
+
+	seededRand
+}
+
+func (s *ThompsonSamplingStrategy) SelectBandit(ctx Context) (*Bandit, error) {
+	if len(s.Bandits) == 0 {
+		return nil, errNoBandits
+	}
+
+	s.initContext(ctx)
+
+	rng := s.random()
+	maxSample := -1.0
+	maxIndex := 0
+	for i := range s.Bandits {
+		sample := sampleBeta(rng, s.Alpha[ctx][i], s.Beta[ctx][i])
+		if sample > maxSample {
+			maxSample = sample
+			maxIndex = i
+		}
+	}
+
+	return s.Bandits[maxIndex], nil
+}
+
+func (s *ThompsonSamplingStrategy) UpdateReward(ctx Context, b *Bandit, reward float64) {
+	s.initContext(ctx)
+	for i := range s.Bandits {
+		if s.Bandits[i] == b {
+			if reward >= 1 {
+				s.Alpha[ctx][i]++
+			} else {
+				s.Beta[ctx][i]++
+			}
+		}
+	}
+}
+
+func (s *ThompsonSamplingStrategy) Reset() {
+	s.Alpha = make(map[Context][]float64)
+	s.Beta = make(map[Context][]float64)
+}
+
+func (s *ThompsonSamplingStrategy) SaveState(filename string) error {
+	return saveModel(filename, s, ModelMetadata{})
+}
+
+func (s *ThompsonSamplingStrategy) LoadState(filename string) error {
+	return loadGob(filename, s)
+}
+
+// initContext sets up the Beta(1, 1) prior for a context we haven't seen yet.
+func (s *ThompsonSamplingStrategy) initContext(ctx Context) {
+	if s.Alpha == nil {
+		s.Alpha = make(map[Context][]float64)
+	}
+	if s.Beta == nil {
+		s.Beta = make(map[Context][]float64)
+	}
+	if _, ok := s.Alpha[ctx]; ok {
+		return
+	}
+	s.Alpha[ctx] = make([]float64, len(s.Bandits))
+	s.Beta[ctx] = make([]float64, len(s.Bandits))
+	for i := range s.Bandits {
+		s.Alpha[ctx][i] = 1
+		s.Beta[ctx][i] = 1
+	}
+}
+
+// sampleBeta draws from Beta(a, b) using two gamma samples.
+func sampleBeta(rng *rand.Rand, a, b float64) float64 {
+	x := sampleGamma(rng, a)
+	y := sampleGamma(rng, b)
+	return x / (x + y)
+}
+
+// sampleGamma draws from Gamma(shape, 1) using the Marsaglia-Tsang method.
+func sampleGamma(rng *rand.Rand, shape float64) float64 {
+	if shape < 1 {
+		// boost the shape and scale the sample back down
+		return sampleGamma(rng, shape+1) * math.Pow(rng.Float64(), 1/shape)
+	}
+
+	d := shape - 1.0/3.0
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rng.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestThompsonSamplingConvergesToBestClickRate(t *testing.T) {
+	ctx := Context{UserID: "u1", TimeOfDay: "evening", Weekday: "friday", Device: "desktop"}
+	bandits := []*Bandit{{ItemID: "low"}, {ItemID: "mid"}, {ItemID: "high"}}
+	clickRates := []float64{0.1, 0.3, 0.7}
+
+	s := &ThompsonSamplingStrategy{Bandits: bandits}
+	s.Seed(1)
+	clicks := rand.New(rand.NewSource(2))
+
+	for i := 0; i < 2000; i++ {
+		b, err := s.SelectBandit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reward := 0.0
+		if clicks.Float64() < clickRates[indexOf(bandits, b)] {
+			reward = 1
+		}
+		s.UpdateReward(ctx, b, reward)
+	}
+
+	picks := 0
+	for i := 0; i < 100; i++ {
+		b, err := s.SelectBandit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.ItemID == "high" {
+			picks++
+		}
+	}
+	if picks < 90 {
+		t.Errorf("picked the best bandit %d of 100 times, want at least 90", picks)
+	}
+}
+
+func TestThompsonSamplingSameSeedSameSelections(t *testing.T) {
+	ctx := Context{UserID: "u1"}
+	bandits := []*Bandit{{ItemID: "a"}, {ItemID: "b"}, {ItemID: "c"}}
+
+	selections := func() []string {
+		s := &ThompsonSamplingStrategy{Bandits: bandits}
+		s.Seed(42)
+		var ids []string
+		for i := 0; i < 50; i++ {
+			b, err := s.SelectBandit(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, b.ItemID)
+		}
+		return ids
+	}
+
+	first, second := selections(), selections()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("selection %d = %s and %s, want the same with the same seed", i, first[i], second[i])
+		}
+	}
+}
+
+// indexOf returns the index of b in bandits, or -1.
+func indexOf(bandits []*Bandit, b *Bandit) int {
+	for i := range bandits {
+		if bandits[i] == b {
+			return i
+		}
+	}
+	return -1
+}
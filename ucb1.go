@@ -0,0 +1,70 @@
+package main
+
+import "math"
+
+// UCB1Strategy picks the bandit with the highest upper confidence bound on
+// its reward for a context. Unpulled bandits are always tried first.
+type UCB1Strategy struct {
+	Bandits []*Bandit
+	Rewards map[Context][]float64
+	Counts  map[Context][]int
+}
+
+func (s *UCB1Strategy) SelectBandit(ctx Context) (*Bandit, error) {
+	if len(s.Bandits) == 0 {
+		return nil, errNoBandits
+	}
+
+	counts := s.Counts[ctx]
+
+	// Explore every arm once before trusting the averages
+	total := 0
+	for i := range s.Bandits {
+		if i >= len(counts) || counts[i] == 0 {
+			return s.Bandits[i], nil
+		}
+		total += counts[i]
+	}
+
+	maxBound := math.Inf(-1)
+	maxIndex := 0
+	for i, reward := range s.Rewards[ctx] {
+		bound := reward + math.Sqrt(2*math.Log(float64(total))/float64(counts[i]))
+		if bound > maxBound {
+			maxBound = bound
+			maxIndex = i
+		}
+	}
+
+	return s.Bandits[maxIndex], nil
+}
+
+func (s *UCB1Strategy) UpdateReward(ctx Context, b *Bandit, reward float64) {
+	if s.Rewards == nil {
+		s.Rewards = make(map[Context][]float64)
+		s.Counts = make(map[Context][]int)
+	}
+	if _, ok := s.Rewards[ctx]; !ok {
+		// first reward in a context we haven't seen
+		s.Rewards[ctx] = make([]float64, len(s.Bandits))
+		s.Counts[ctx] = make([]int, len(s.Bandits))
+	}
+	for i := range s.Bandits {
+		if s.Bandits[i] == b {
+			updateAverage(s.Rewards[ctx], s.Counts[ctx], i, reward)
+		}
+	}
+}
+
+func (s *UCB1Strategy) Reset() {
+	s.Rewards = make(map[Context][]float64)
+	s.Counts = make(map[Context][]int)
+}
+
+func (s *UCB1Strategy) SaveState(filename string) error {
+	return saveModel(filename, s, ModelMetadata{})
+}
+
+func (s *UCB1Strategy) LoadState(filename string) error {
+	return loadGob(filename, s)
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestUCB1PicksUnpulledBanditFirst(t *testing.T) {
+	ctx := Context{UserID: "u1", TimeOfDay: "morning", Weekday: "monday", Device: "mobile"}
+	a, b, c := &Bandit{ItemID: "a"}, &Bandit{ItemID: "b"}, &Bandit{ItemID: "c"}
+	s := &UCB1Strategy{Bandits: []*Bandit{a, b, c}}
+
+	// a and c are well sampled with a high reward, b was never pulled
+	for i := 0; i < 100; i++ {
+		s.UpdateReward(ctx, a, 1)
+		s.UpdateReward(ctx, c, 1)
+	}
+
+	got, err := s.SelectBandit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != b {
+		t.Errorf("SelectBandit() = %s, want the unpulled b", got.ItemID)
+	}
+}
+
+func TestUCB1NoBandits(t *testing.T) {
+	s := &UCB1Strategy{}
+	if _, err := s.SelectBandit(Context{}); err != errNoBandits {
+		t.Errorf("SelectBandit() error = %v, want %v", err, errNoBandits)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import "fmt"
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// versionString describes the build for -version and the model metadata.
+func versionString() string {
+	return fmt.Sprintf("smokey %s (commit %s, built %s)", version, commit, buildDate)
+}